@@ -3,12 +3,16 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/urfave/cli/v2"
 
+	"github.com/jetstack/spiffe-connector/internal/pkg/cache"
 	"github.com/jetstack/spiffe-connector/internal/pkg/config"
 	"github.com/jetstack/spiffe-connector/internal/pkg/provider"
 	"github.com/jetstack/spiffe-connector/internal/pkg/server"
+	"github.com/jetstack/spiffe-connector/types"
 )
 
 func Run(ctx *cli.Context) error {
@@ -51,23 +55,301 @@ func Run(ctx *cli.Context) error {
 		return cli.Exit(fmt.Sprintf("Couldn't set up config reloader (%s)", err.Error()), 1)
 	}
 
-	googleProvider, err := provider.NewGoogleIAMServiceAccountKeyProvider(context.Background(), provider.GoogleIAMServiceAccountKeyProviderOptions{})
-	if err != nil {
-		return cli.Exit(fmt.Sprintf("failed to set up Google IAM Provider %s", err), 1)
+	// mock providers are set up first, so that the cloud providers they replace are never constructed
+	mockProviders := map[string]provider.Provider{}
+	if cfg.Providers != nil && cfg.Providers.Mock != nil {
+		for _, name := range append([]string{"MockProvider"}, cfg.Providers.Mock.Replaces...) {
+			mockProvider, err := provider.NewMockProvider(provider.MockProviderOptions{
+				Name:      name,
+				Lifetime:  cfg.Providers.Mock.Lifetime,
+				Latency:   cfg.Providers.Mock.Latency,
+				ErrorRate: cfg.Providers.Mock.ErrorRate,
+				Errors:    cfg.Providers.Mock.Errors,
+				PingError: cfg.Providers.Mock.PingError,
+				Seed:      cfg.Providers.Mock.Seed,
+			})
+			if err != nil {
+				return cli.Exit(fmt.Sprintf("failed to set up Mock Provider %s", err), 1)
+			}
+			mockProviders[name] = &mockProvider
+		}
 	}
-	awsProvider, err := provider.NewAWSSTSAssumeRoleProvider(context.Background(), provider.AWSSTSAssumeRoleProviderOptions{})
-	if err != nil {
-		return cli.Exit(fmt.Sprintf("failed to set up AWS STS Provider %s", err), 1)
+
+	providers := map[string]provider.Provider{}
+
+	if _, replaced := mockProviders["GoogleIAMServiceAccountKeyProvider"]; !replaced {
+		googleProvider, err := provider.NewGoogleIAMServiceAccountKeyProvider(context.Background(), provider.GoogleIAMServiceAccountKeyProviderOptions{})
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("failed to set up Google IAM Provider %s", err), 1)
+		}
+		providers[googleProvider.Name()] = &googleProvider
+	}
+	if _, replaced := mockProviders["AWSSTSAssumeRoleProvider"]; !replaced {
+		awsProvider, err := provider.NewAWSSTSAssumeRoleProvider(context.Background(), provider.AWSSTSAssumeRoleProviderOptions{})
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("failed to set up AWS STS Provider %s", err), 1)
+		}
+		providers[awsProvider.Name()] = &awsProvider
+	}
+
+	if cfg.Providers != nil && cfg.Providers.SSHUserCertificate != nil {
+		sshProvider, err := provider.NewSSHUserCertificateProvider(provider.SSHUserCertificateProviderOptions{
+			CAKeyFile: cfg.Providers.SSHUserCertificate.CAKeyFile,
+			Duration:  cfg.Providers.SSHUserCertificate.Duration,
+		})
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("failed to set up SSH User Certificate Provider %s", err), 1)
+		}
+		providers[sshProvider.Name()] = &sshProvider
+	}
+
+	if cfg.Providers != nil && cfg.Providers.X509ClientCertificate != nil {
+		x509Provider, err := provider.NewX509ClientCertificateProvider(provider.X509ClientCertificateProviderOptions{
+			CACertFile: cfg.Providers.X509ClientCertificate.CACertFile,
+			CAKeyFile:  cfg.Providers.X509ClientCertificate.CAKeyFile,
+			Lifetime:   cfg.Providers.X509ClientCertificate.Lifetime,
+		})
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("failed to set up X509 Client Certificate Provider %s", err), 1)
+		}
+		providers[x509Provider.Name()] = &x509Provider
+	}
+
+	if cfg.Providers != nil && cfg.Providers.JWTSigner != nil {
+		jwtProvider, err := provider.NewJWTSignerProvider(provider.JWTSignerProviderOptions{
+			Algorithm:      cfg.Providers.JWTSigner.Algorithm,
+			KeyFile:        cfg.Providers.JWTSigner.KeyFile,
+			KeyID:          cfg.Providers.JWTSigner.KeyID,
+			Issuer:         cfg.Providers.JWTSigner.Issuer,
+			ClaimsTemplate: cfg.Providers.JWTSigner.ClaimsTemplate,
+			TTL:            cfg.Providers.JWTSigner.TTL,
+		})
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("failed to set up JWT Signer Provider %s", err), 1)
+		}
+		providers[jwtProvider.Name()] = &jwtProvider
+	}
+
+	if cfg.Providers != nil && cfg.Providers.PostgresRole != nil {
+		postgresProvider, err := provider.NewPostgresRoleProvider(provider.PostgresRoleProviderOptions{
+			DSN:        cfg.Providers.PostgresRole.DSN,
+			Host:       cfg.Providers.PostgresRole.Host,
+			Port:       cfg.Providers.PostgresRole.Port,
+			Duration:   cfg.Providers.PostgresRole.Duration,
+			RolePrefix: cfg.Providers.PostgresRole.RolePrefix,
+		})
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("failed to set up Postgres Role Provider %s", err), 1)
+		}
+		sweepInterval := 5 * time.Minute
+		if cfg.Providers.PostgresRole.SweepInterval > 0 {
+			sweepInterval = cfg.Providers.PostgresRole.SweepInterval
+		}
+		postgresProvider.StartSweeper(ctx.Context, sweepInterval)
+		providers[postgresProvider.Name()] = &postgresProvider
+	}
+
+	if cfg.Providers != nil && cfg.Providers.StaticSecret != nil {
+		staticSecretProvider, err := provider.NewStaticSecretProvider(ctx.Context, provider.StaticSecretProviderOptions{
+			Root:            cfg.Providers.StaticSecret.Root,
+			TargetDir:       cfg.Providers.StaticSecret.TargetDir,
+			RefreshInterval: cfg.Providers.StaticSecret.RefreshInterval,
+		})
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("failed to set up Static Secret Provider %s", err), 1)
+		}
+		providers[staticSecretProvider.Name()] = &staticSecretProvider
+	}
+
+	if cfg.Providers != nil && cfg.Providers.Webhook != nil {
+		webhookProvider, err := provider.NewWebhookProvider(provider.WebhookProviderOptions{
+			URL:            cfg.Providers.Webhook.URL,
+			ServerSPIFFEID: cfg.Providers.Webhook.ServerSPIFFEID,
+			Timeout:        cfg.Providers.Webhook.Timeout,
+			Retries:        cfg.Providers.Webhook.Retries,
+			RetryBackoff:   cfg.Providers.Webhook.RetryBackoff,
+		})
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("failed to set up Webhook Provider %s", err), 1)
+		}
+		providers[webhookProvider.Name()] = &webhookProvider
+	}
+
+	if cfg.Providers != nil && cfg.Providers.ConsulACLToken != nil {
+		consulACLTokenProvider, err := provider.NewConsulACLTokenProvider(ctx.Context, provider.ConsulACLTokenProviderOptions{
+			Address:   cfg.Providers.ConsulACLToken.Address,
+			TokenFile: cfg.Providers.ConsulACLToken.TokenFile,
+			TTL:       cfg.Providers.ConsulACLToken.TTL,
+		})
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("failed to set up Consul ACL Token Provider %s", err), 1)
+		}
+		providers[consulACLTokenProvider.Name()] = &consulACLTokenProvider
+	}
+
+	if cfg.Providers != nil && cfg.Providers.GoogleAccessToken != nil {
+		googleAccessTokenProvider, err := provider.NewGoogleAccessTokenProvider(context.Background(), provider.GoogleAccessTokenProviderOptions{
+			Endpoint:    cfg.Providers.GoogleAccessToken.Endpoint,
+			STSEndpoint: cfg.Providers.GoogleAccessToken.STSEndpoint,
+			Lifetime:    cfg.Providers.GoogleAccessToken.Lifetime,
+			Scopes:      cfg.Providers.GoogleAccessToken.Scopes,
+		})
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("failed to set up Google Access Token Provider %s", err), 1)
+		}
+		providers[googleAccessTokenProvider.Name()] = &googleAccessTokenProvider
+	}
+
+	for name, mockProvider := range mockProviders {
+		providers[name] = mockProvider
+	}
+
+	if err := provider.ValidateOptions(cfg.ACLs, providers); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	if err := provider.ValidateIssuance(cfg.ACLs, providers); err != nil {
+		return cli.Exit(err.Error(), 1)
 	}
 
 	s := &server.Server{
-		ACLs: cfg.ACLs,
-		Providers: map[string]provider.Provider{
-			"AWSSTSAssumeRoleProvider":           &awsProvider,
-			"GoogleIAMServiceAccountKeyProvider": &googleProvider,
-		},
+		ACLs:      cfg.ACLs,
+		Providers: providers,
+	}
+	if cfg.Server != nil {
+		s.Freshness = cfg.Server.Freshness
+		s.ProviderFreshness = cfg.Server.ProviderFreshness
+		s.Auth = cfg.Server.Auth
+	}
+	if cfg.Server != nil && cfg.Server.Cache != nil {
+		credentialCache, err := newCache(cfg.Server.Cache)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("failed to set up credential cache %s", err), 1)
+		}
+		s.Cache = credentialCache
+	}
+	if cfg.Server != nil && cfg.Server.Refresh != nil {
+		s.Refresh = &server.RefreshOptions{
+			Fraction:    cfg.Server.Refresh.Fraction,
+			Jitter:      cfg.Server.Refresh.Jitter,
+			Interval:    cfg.Server.Refresh.Interval,
+			IdleTimeout: cfg.Server.Refresh.IdleTimeout,
+		}
 	}
 
-	s.Start(ctx.Context)
+	listenOptions, err := newListenOptions(ctx, cfg.Server)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	s.Listen = listenOptions
+
+	httpOptions, err := newHTTPListenOptions(ctx, cfg.Server)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	s.HTTP = httpOptions
+
+	if err := s.Start(ctx.Context); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
 	return nil
 }
+
+// newListenOptions returns where the server listens, from the config file overridden by any flags which are set
+func newListenOptions(ctx *cli.Context, cfg *types.ServerConfig) (*server.ListenOptions, error) {
+	options := &server.ListenOptions{}
+	if cfg != nil && cfg.Listen != nil {
+		mode, _, err := cfg.Listen.SocketFileMode()
+		if err != nil {
+			return nil, err
+		}
+		options.Network = cfg.Listen.Network
+		options.Address = cfg.Listen.Address
+		options.SocketMode = os.FileMode(mode)
+		options.MaxRecvMsgSize = cfg.Listen.MaxRecvMsgSize
+		options.MaxSendMsgSize = cfg.Listen.MaxSendMsgSize
+		if cfg.Listen.Keepalive != nil {
+			options.KeepaliveTime = cfg.Listen.Keepalive.Time
+			options.KeepaliveTimeout = cfg.Listen.Keepalive.Timeout
+			options.KeepaliveMinTime = cfg.Listen.Keepalive.MinTime
+		}
+	}
+
+	if ctx.IsSet("listen-network") {
+		options.Network = ctx.String("listen-network")
+	}
+	if ctx.IsSet("listen-address") {
+		options.Address = ctx.String("listen-address")
+	}
+	if ctx.IsSet("keepalive-time") {
+		options.KeepaliveTime = ctx.Duration("keepalive-time")
+	}
+	if ctx.IsSet("keepalive-timeout") {
+		options.KeepaliveTimeout = ctx.Duration("keepalive-timeout")
+	}
+	if ctx.IsSet("max-recv-msg-size") {
+		options.MaxRecvMsgSize = ctx.Int("max-recv-msg-size")
+	}
+	if ctx.IsSet("max-send-msg-size") {
+		options.MaxSendMsgSize = ctx.Int("max-send-msg-size")
+	}
+	return options, nil
+}
+
+// newHTTPListenOptions returns where the HTTP/JSON API listens, nil if it is not enabled in the config file or by the
+// http-listen-address flag
+func newHTTPListenOptions(ctx *cli.Context, cfg *types.ServerConfig) (*server.ListenOptions, error) {
+	var options *server.ListenOptions
+	if cfg != nil && cfg.HTTP != nil {
+		mode, _, err := cfg.HTTP.SocketFileMode()
+		if err != nil {
+			return nil, err
+		}
+		options = &server.ListenOptions{
+			Network:    cfg.HTTP.Network,
+			Address:    cfg.HTTP.Address,
+			SocketMode: os.FileMode(mode),
+		}
+	}
+
+	if ctx.IsSet("http-listen-address") {
+		options = &server.ListenOptions{Network: server.NetworkTCP, Address: ctx.String("http-listen-address")}
+	}
+	return options, nil
+}
+
+// newCache returns the credential cache configured for the server, nil for the default in memory cache
+func newCache(cfg *types.CacheConfig) (cache.Cache, error) {
+	if cfg.Backend != types.CacheBackendFile && cfg.Backend != types.CacheBackendRedis {
+		return nil, nil
+	}
+
+	key, err := cache.LoadKey(cfg.KeyFile, cfg.KeyEnv)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Backend == types.CacheBackendFile {
+		fileCache, err := cache.NewFile(cfg.Path, key)
+		if err != nil {
+			return nil, err
+		}
+		return fileCache, nil
+	}
+
+	var password string
+	if cfg.Redis.PasswordEnv != "" {
+		password = os.Getenv(cfg.Redis.PasswordEnv)
+	}
+	redisCache, err := cache.NewRedis(cache.RedisOptions{
+		Address:   cfg.Redis.Address,
+		Username:  cfg.Redis.Username,
+		Password:  password,
+		DB:        cfg.Redis.DB,
+		KeyPrefix: cfg.Redis.KeyPrefix,
+		Key:       key,
+		LockTTL:   cfg.Redis.LockTTL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return redisCache, nil
+}
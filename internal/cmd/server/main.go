@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/urfave/cli/v2"
 )
@@ -22,9 +25,47 @@ func main() {
 				Hidden:    false,
 				TakesFile: true,
 			},
+			&cli.StringFlag{
+				Name:    "listen-network",
+				Usage:   "Network to listen on, tcp or unix, overriding the config file",
+				EnvVars: []string{"SPIFFE_CONNECTOR_LISTEN_NETWORK"},
+			},
+			&cli.StringFlag{
+				Name:    "listen-address",
+				Usage:   "host:port, or socket path for unix, to listen on, overriding the config file",
+				EnvVars: []string{"SPIFFE_CONNECTOR_LISTEN_ADDRESS"},
+			},
+			&cli.StringFlag{
+				Name:    "http-listen-address",
+				Usage:   "host:port to serve the HTTP/JSON API on, enabling it and overriding the config file",
+				EnvVars: []string{"SPIFFE_CONNECTOR_HTTP_LISTEN_ADDRESS"},
+			},
+			&cli.DurationFlag{
+				Name:    "keepalive-time",
+				Usage:   "How long a connection is idle before the server pings the client, overriding the config file",
+				EnvVars: []string{"SPIFFE_CONNECTOR_KEEPALIVE_TIME"},
+			},
+			&cli.DurationFlag{
+				Name:    "keepalive-timeout",
+				Usage:   "How long the server waits for a reply to a keepalive ping, overriding the config file",
+				EnvVars: []string{"SPIFFE_CONNECTOR_KEEPALIVE_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    "max-recv-msg-size",
+				Usage:   "Largest message in bytes the server receives, overriding the config file",
+				EnvVars: []string{"SPIFFE_CONNECTOR_MAX_RECV_MSG_SIZE"},
+			},
+			&cli.IntFlag{
+				Name:    "max-send-msg-size",
+				Usage:   "Largest message in bytes the server sends, overriding the config file",
+				EnvVars: []string{"SPIFFE_CONNECTOR_MAX_SEND_MSG_SIZE"},
+			},
 		},
 		Action:                 Run,
 		UseShortOptionHandling: false,
 	}
-	app.Run(os.Args)
+	// the server shuts down gracefully when it is asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	app.RunContext(ctx, os.Args)
 }
@@ -15,7 +15,7 @@ func main() {
 			&cli.StringFlag{
 				Name:     "server-address",
 				Aliases:  []string{"s"},
-				Usage:    "address / port to connect to the SPIFFE connector server",
+				Usage:    "address / port to connect to the SPIFFE connector server, or unix:///path/to/socket",
 				EnvVars:  []string{"SPIFFE_CONNECTOR_SERVER_ADDRESS"},
 				Required: true,
 				Hidden:   false,
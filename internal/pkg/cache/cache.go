@@ -0,0 +1,96 @@
+// Package cache stores the credentials issued by the server, so that they can be handed out again while fresh
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	goproto "google.golang.org/protobuf/proto"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/provider"
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+)
+
+// Cache stores entries by key. Entries must not be changed once they have been stored, a new entry is stored instead.
+type Cache interface {
+	// Get returns the entry stored under key, and false if there is none or it has expired
+	Get(key string) (*Entry, bool, error)
+
+	// Set stores the entry under key, replacing any existing entry
+	Set(key string, entry *Entry) error
+
+	// Delete removes the entry stored under key, if there is one
+	Delete(key string) error
+
+	// Keys lists the keys of the entries which have not expired
+	Keys() ([]string, error)
+}
+
+// Locker is implemented by caches which are shared between servers, so that only one of them issues a given credential
+// at a time
+type Locker interface {
+	// Lock waits until no other server holds the lock for key, then takes it. The lock is released by calling unlock,
+	// or after a timeout if the server holding it goes away.
+	Lock(key string) (unlock func(), err error)
+}
+
+// Entry is a credential held in a cache
+type Entry struct {
+	// Credential is the credential handed out to clients
+	Credential *proto.Credential
+
+	// IssuedAt is when the credential was issued or last renewed
+	IssuedAt time.Time
+
+	// RefreshAt is when the credential is issued again in the background, zero if it never is
+	RefreshAt time.Time
+
+	// Request is the request the credential was issued for, so that it can be issued again after a restart
+	Request provider.Request
+}
+
+// Expired reports whether the credential in the entry expired before now. Credentials without an expiry never expire.
+func (e *Entry) Expired(now time.Time) bool {
+	return e.Credential.NotAfter != nil && e.Credential.NotAfter.AsTime().Before(now)
+}
+
+// storedEntry is the serialized form of an Entry, the credential is encoded as protobuf rather than JSON
+type storedEntry struct {
+	Credential []byte           `json:"credential"`
+	IssuedAt   time.Time        `json:"issued_at"`
+	RefreshAt  time.Time        `json:"refresh_at,omitempty"`
+	Request    provider.Request `json:"request"`
+}
+
+// marshalEntry serializes an entry for the backends which store bytes
+func marshalEntry(entry *Entry) ([]byte, error) {
+	credential, err := goproto.Marshal(entry.Credential)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+	return json.Marshal(storedEntry{
+		Credential: credential,
+		IssuedAt:   entry.IssuedAt,
+		RefreshAt:  entry.RefreshAt,
+		Request:    entry.Request,
+	})
+}
+
+// unmarshalEntry is the reverse of marshalEntry
+func unmarshalEntry(data []byte) (*Entry, error) {
+	var stored storedEntry
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal entry: %w", err)
+	}
+	credential := &proto.Credential{}
+	if err := goproto.Unmarshal(stored.Credential, credential); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal credential: %w", err)
+	}
+	return &Entry{
+		Credential: credential,
+		IssuedAt:   stored.IssuedAt,
+		RefreshAt:  stored.RefreshAt,
+		Request:    stored.Request,
+	}, nil
+}
@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/provider"
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+// newEntry returns an entry holding a token credential which expires after lifetime, or never if lifetime is zero
+func newEntry(token string, lifetime time.Duration) *Entry {
+	credential := &proto.Credential{Token: &token}
+	if lifetime != 0 {
+		credential.NotAfter = timestamppb.New(time.Now().Add(lifetime))
+	}
+	return &Entry{
+		Credential: credential,
+		IssuedAt:   time.Now().UTC().Truncate(time.Second),
+		Request: provider.Request{
+			ObjectReference: "role",
+			Principal:       spiffeid.RequireFromString("spiffe://example.com/orders-api"),
+			MatchPrincipal:  "spiffe://example.com/orders-api",
+			Credential:      types.Credential{Provider: "AWSSTSAssumeRoleProvider", ObjectReference: "role"},
+		},
+	}
+}
+
+func TestCache(t *testing.T) {
+	testCases := map[string]func(t *testing.T) Cache{
+		"memory": func(t *testing.T) Cache {
+			return NewMemory()
+		},
+		"file": func(t *testing.T) Cache {
+			c, err := NewFile(filepath.Join(t.TempDir(), "cache"), bytes.Repeat([]byte{1}, 32))
+			require.NoError(t, err)
+			return c
+		},
+		"redis": func(t *testing.T) Cache {
+			c, err := NewRedis(RedisOptions{Address: miniredis.RunT(t).Addr(), Key: bytes.Repeat([]byte{1}, 32)})
+			require.NoError(t, err)
+			return c
+		},
+	}
+
+	for testName, newCache := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			c := newCache(t)
+
+			_, ok, err := c.Get("missing")
+			require.NoError(t, err)
+			assert.False(t, ok)
+
+			require.NoError(t, c.Set("eternal", newEntry("token-1", 0)))
+			require.NoError(t, c.Set("current", newEntry("token-2", time.Hour)))
+			require.NoError(t, c.Set("expired", newEntry("token-3", -time.Hour)))
+
+			entry, ok, err := c.Get("current")
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, "token-2", *entry.Credential.Token)
+
+			_, ok, err = c.Get("expired")
+			require.NoError(t, err)
+			assert.False(t, ok, "expired entries are not returned")
+
+			keys, err := c.Keys()
+			require.NoError(t, err)
+			sort.Strings(keys)
+			assert.Equal(t, []string{"current", "eternal"}, keys)
+
+			require.NoError(t, c.Delete("current"))
+			require.NoError(t, c.Delete("missing"))
+			keys, err = c.Keys()
+			require.NoError(t, err)
+			assert.Equal(t, []string{"eternal"}, keys)
+		})
+	}
+}
+
+func TestMarshalEntry(t *testing.T) {
+	entry := newEntry("token", time.Hour)
+	entry.RefreshAt = entry.IssuedAt.Add(45 * time.Minute)
+	entry.Request.Credential.Options = map[string]string{"duration": "1h"}
+
+	data, err := marshalEntry(entry)
+	require.NoError(t, err)
+	result, err := unmarshalEntry(data)
+	require.NoError(t, err)
+
+	assert.Equal(t, "token", *result.Credential.Token)
+	assert.True(t, entry.Credential.NotAfter.AsTime().Equal(result.Credential.NotAfter.AsTime()))
+	assert.True(t, entry.IssuedAt.Equal(result.IssuedAt))
+	assert.True(t, entry.RefreshAt.Equal(result.RefreshAt))
+	assert.Equal(t, entry.Request, result.Request)
+}
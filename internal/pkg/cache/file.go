@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileAdditionalData authenticates the format of the cache file, rather than its path, so that the file can be moved
+var fileAdditionalData = []byte("spiffe-connector file cache v1")
+
+// File is a Cache which keeps entries in memory and writes them to a file encrypted with AES-256-GCM whenever they
+// change, so that they survive the server restarting. Expired entries are pruned when the file is loaded and written.
+type File struct {
+	path string
+	aead cipher.AEAD
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+}
+
+// NewFile returns a File cache written to path, encrypted with key which must be 32 bytes. Entries are loaded from the
+// file if it exists and can be decrypted.
+func NewFile(path string, key []byte) (*File, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{path: path, aead: aead, entries: make(map[string]*Entry)}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Get returns the entry stored under key, and false if there is none or it has expired
+func (f *File) Get(key string) (*Entry, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry, ok := f.entries[key]
+	if !ok || entry.Expired(time.Now()) {
+		return nil, false, nil
+	}
+	return entry, true, nil
+}
+
+// Set stores the entry under key and writes the file
+func (f *File) Set(key string, entry *Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.entries[key] = entry
+	return f.write()
+}
+
+// Delete removes the entry stored under key and writes the file
+func (f *File) Delete(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.entries[key]; !ok {
+		return nil
+	}
+	delete(f.entries, key)
+	return f.write()
+}
+
+// Keys lists the keys of the entries which have not expired
+func (f *File) Keys() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0, len(f.entries))
+	for key, entry := range f.entries {
+		if !entry.Expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// load reads the entries from the file, skipping those which have expired. A missing file is an empty cache, as is one
+// which cannot be decrypted, since the credentials in it can be issued again. That file is replaced on the next write.
+func (f *File) load() error {
+	ciphertext, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cache file: %w", err)
+	}
+
+	plaintext, err := open(f.aead, ciphertext, fileAdditionalData)
+	if err != nil {
+		log.Printf("discarding cache file %q which cannot be decrypted, the key may have changed: %s", f.path, err)
+		return nil
+	}
+
+	var stored map[string]json.RawMessage
+	if err := json.Unmarshal(plaintext, &stored); err != nil {
+		return fmt.Errorf("failed to unmarshal cache file %q: %w", f.path, err)
+	}
+
+	now := time.Now()
+	for key, data := range stored {
+		entry, err := unmarshalEntry(data)
+		if err != nil {
+			return fmt.Errorf("cache file %q entry %q: %w", f.path, key, err)
+		}
+		if !entry.Expired(now) {
+			f.entries[key] = entry
+		}
+	}
+	return nil
+}
+
+// write prunes expired entries, then replaces the file with the remaining ones. The file is written to a temporary
+// file which is renamed over it, so a crash never leaves a partially written cache.
+func (f *File) write() error {
+	now := time.Now()
+	stored := make(map[string]json.RawMessage, len(f.entries))
+	for key, entry := range f.entries {
+		if entry.Expired(now) {
+			delete(f.entries, key)
+			continue
+		}
+		data, err := marshalEntry(entry)
+		if err != nil {
+			return fmt.Errorf("entry %q: %w", key, err)
+		}
+		stored[key] = data
+	}
+	plaintext, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache: %w", err)
+	}
+
+	ciphertext, err := seal(f.aead, plaintext, fileAdditionalData)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(ciphertext); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to replace cache file: %w", err)
+	}
+	return nil
+}
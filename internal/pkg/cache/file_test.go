@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	key := bytes.Repeat([]byte{1}, 32)
+
+	c, err := NewFile(path, key)
+	require.NoError(t, err)
+	require.NoError(t, c.Set("current", newEntry("token-1", time.Hour)))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(contents), "token-1", "the file is encrypted")
+
+	// entries which expire while the server is stopped are pruned when the file is loaded
+	writeFile(t, path, key, map[string]*Entry{
+		"current": newEntry("token-1", time.Hour),
+		"expired": newEntry("token-2", -time.Hour),
+	})
+	loaded, err := NewFile(path, key)
+	require.NoError(t, err)
+	entry, ok, err := loaded.Get("current")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "token-1", *entry.Credential.Token)
+	assert.Len(t, loaded.entries, 1)
+
+	// the file can be moved, as it is not bound to its path
+	moved := filepath.Join(t.TempDir(), "moved")
+	require.NoError(t, os.Rename(path, moved))
+	loaded, err = NewFile(moved, key)
+	require.NoError(t, err)
+	_, ok, err = loaded.Get("current")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// a file which cannot be decrypted with the key is discarded, as the credentials can be issued again
+	loaded, err = NewFile(moved, bytes.Repeat([]byte{2}, 32))
+	require.NoError(t, err)
+	assert.Empty(t, loaded.entries)
+
+	_, err = NewFile(path, []byte("short"))
+	assert.EqualError(t, err, "cache key must be 32 bytes, got 5")
+
+	c, err = NewFile(filepath.Join(t.TempDir(), "missing"), key)
+	require.NoError(t, err, "a missing file is an empty cache")
+	assert.Empty(t, c.entries)
+}
+
+// writeFile writes entries to a cache file as File does, but without pruning those which have expired
+func writeFile(t *testing.T, path string, key []byte, entries map[string]*Entry) {
+	t.Helper()
+
+	stored := make(map[string]json.RawMessage, len(entries))
+	for k, entry := range entries {
+		data, err := marshalEntry(entry)
+		require.NoError(t, err)
+		stored[k] = data
+	}
+	plaintext, err := json.Marshal(stored)
+	require.NoError(t, err)
+
+	aead, err := newAEAD(key)
+	require.NoError(t, err)
+	ciphertext, err := seal(aead, plaintext, fileAdditionalData)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, ciphertext, 0600))
+}
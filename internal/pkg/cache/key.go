@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadKey reads a cache encryption key from keyFile, or from the environment variable keyEnv if keyFile is empty. The
+// key is 32 bytes, either raw or base64 encoded.
+func LoadKey(keyFile, keyEnv string) ([]byte, error) {
+	var raw []byte
+	switch {
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cache key file: %w", err)
+		}
+		raw = data
+	case keyEnv != "":
+		value, ok := os.LookupEnv(keyEnv)
+		if !ok {
+			return nil, fmt.Errorf("cache key env var %q is not set", keyEnv)
+		}
+		raw = []byte(value)
+	default:
+		return nil, fmt.Errorf("no cache key file or env var given")
+	}
+
+	if len(raw) == 32 {
+		return raw, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, fmt.Errorf("cache key must be 32 bytes, or 32 bytes encoded as base64")
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("cache key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
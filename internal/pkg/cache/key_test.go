@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	dir := t.TempDir()
+	writeFile := func(name string, contents []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, contents, 0600))
+		return path
+	}
+	t.Setenv("CACHE_KEY", base64.StdEncoding.EncodeToString(key))
+	t.Setenv("SHORT_CACHE_KEY", base64.StdEncoding.EncodeToString(key[:16]))
+
+	testCases := map[string]struct {
+		keyFile, keyEnv string
+		expectedError   error
+	}{
+		"raw key file": {
+			keyFile: writeFile("raw", key),
+		},
+		"base64 key file with a trailing newline": {
+			keyFile: writeFile("base64", []byte(base64.StdEncoding.EncodeToString(key)+"\n")),
+		},
+		"key file takes precedence": {
+			keyFile: writeFile("precedence", key),
+			keyEnv:  "SHORT_CACHE_KEY",
+		},
+		"base64 env var": {
+			keyEnv: "CACHE_KEY",
+		},
+		"short key": {
+			keyEnv:        "SHORT_CACHE_KEY",
+			expectedError: errors.New("cache key must be 32 bytes, got 16"),
+		},
+		"unset env var": {
+			keyEnv:        "MISSING_CACHE_KEY",
+			expectedError: errors.New(`cache key env var "MISSING_CACHE_KEY" is not set`),
+		},
+		"neither": {
+			expectedError: errors.New("no cache key file or env var given"),
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			result, err := LoadKey(testCase.keyFile, testCase.keyEnv)
+			if testCase.expectedError != nil {
+				assert.EqualError(t, err, testCase.expectedError.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, key, result)
+		})
+	}
+}
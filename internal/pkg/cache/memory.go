@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Memory is a Cache which holds entries in memory, so they are lost when the server restarts
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]*Entry
+}
+
+// NewMemory returns an empty Memory cache
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string]*Entry)}
+}
+
+// Get returns the entry stored under key, pruning it if it has expired
+func (m *Memory) Get(key string) (*Entry, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if entry.Expired(time.Now()) {
+		delete(m.entries, key)
+		return nil, false, nil
+	}
+	return entry, true, nil
+}
+
+// Set stores the entry under key
+func (m *Memory) Set(key string, entry *Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = entry
+	return nil
+}
+
+// Delete removes the entry stored under key
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
+
+// Keys lists the keys of the entries which have not expired, pruning those which have
+func (m *Memory) Keys() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0, len(m.entries))
+	for key, entry := range m.entries {
+		if entry.Expired(now) {
+			delete(m.entries, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
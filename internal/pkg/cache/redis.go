@@ -0,0 +1,242 @@
+package cache
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisOptions configure a Redis cache
+type RedisOptions struct {
+	// Address is the host:port of the Redis server
+	Address string
+
+	// Username, Password and DB select the Redis user and database, all are optional
+	Username string
+	Password string
+	DB       int
+
+	// KeyPrefix is prepended to every Redis key written, defaults to "spiffe-connector:"
+	KeyPrefix string
+
+	// Key is the 32 byte key entries are encrypted with, which must be the same for every server sharing the cache
+	Key []byte
+
+	// LockTTL is how long a server can hold the lock for a credential while it is issued, defaults to 10s
+	LockTTL time.Duration
+
+	// Timeout bounds each call to Redis, defaults to 5s
+	Timeout time.Duration
+}
+
+// Redis is a Cache stored in Redis, so that servers running side by side hand out the same credentials. Entries are
+// encrypted with AES-256-GCM and expire in Redis when their credential does.
+type Redis struct {
+	client    *redis.Client
+	aead      cipher.AEAD
+	keyPrefix string
+	lockTTL   time.Duration
+	timeout   time.Duration
+}
+
+// unlockScript deletes a lock only if it is still held with the given token, so that a lock which timed out and was
+// taken by another server is not released
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// lockPollInterval is how often a server waiting for a lock tries to take it
+const lockPollInterval = 50 * time.Millisecond
+
+// NewRedis returns a Redis cache, checking that the server can be reached
+func NewRedis(options RedisOptions) (*Redis, error) {
+	aead, err := newAEAD(options.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Redis{
+		client: redis.NewClient(&redis.Options{
+			Addr:     options.Address,
+			Username: options.Username,
+			Password: options.Password,
+			DB:       options.DB,
+		}),
+		aead:      aead,
+		keyPrefix: options.KeyPrefix,
+		lockTTL:   options.LockTTL,
+		timeout:   options.Timeout,
+	}
+	if r.keyPrefix == "" {
+		r.keyPrefix = "spiffe-connector:"
+	}
+	if r.lockTTL <= 0 {
+		r.lockTTL = 10 * time.Second
+	}
+	if r.timeout <= 0 {
+		r.timeout = 5 * time.Second
+	}
+
+	ctx, cancel := r.context()
+	defer cancel()
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis at %q: %w", options.Address, err)
+	}
+	return r, nil
+}
+
+// Get returns the entry stored under key, and false if there is none
+func (r *Redis) Get(key string) (*Entry, bool, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	redisKey := r.entryKey(key)
+	ciphertext, err := r.client.Get(ctx, redisKey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get %q from redis: %w", redisKey, err)
+	}
+
+	plaintext, err := open(r.aead, ciphertext, []byte(redisKey))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decrypt %q, the key may differ between servers: %w", redisKey, err)
+	}
+	entry, err := unmarshalEntry(plaintext)
+	if err != nil {
+		return nil, false, err
+	}
+	if entry.Expired(time.Now()) {
+		return nil, false, nil
+	}
+	return entry, true, nil
+}
+
+// Set stores the entry under key, to expire from Redis along with its credential
+func (r *Redis) Set(key string, entry *Entry) error {
+	var expiration time.Duration
+	if entry.Credential.NotAfter != nil {
+		expiration = time.Until(entry.Credential.NotAfter.AsTime())
+		if expiration <= 0 {
+			return r.Delete(key)
+		}
+	}
+
+	redisKey := r.entryKey(key)
+	plaintext, err := marshalEntry(entry)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := seal(r.aead, plaintext, []byte(redisKey))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := r.context()
+	defer cancel()
+	if err := r.client.Set(ctx, redisKey, ciphertext, expiration).Err(); err != nil {
+		return fmt.Errorf("failed to set %q in redis: %w", redisKey, err)
+	}
+	return nil
+}
+
+// Delete removes the entry stored under key
+func (r *Redis) Delete(key string) error {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	redisKey := r.entryKey(key)
+	if err := r.client.Del(ctx, redisKey).Err(); err != nil {
+		return fmt.Errorf("failed to delete %q from redis: %w", redisKey, err)
+	}
+	return nil
+}
+
+// Keys lists the keys of the stored entries, which Redis has already pruned of those which expired
+func (r *Redis) Keys() ([]string, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	prefix := r.entryKey("")
+	var keys []string
+	iter := r.client.Scan(ctx, 0, escapePattern(prefix)+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), prefix))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan redis for %q: %w", prefix, err)
+	}
+	return keys, nil
+}
+
+// Lock takes the lock for key with SET NX, waiting for up to the lock TTL if another server holds it. If the lock is
+// still held after that, the server holding it is assumed to be stuck and an error is returned.
+func (r *Redis) Lock(key string) (func(), error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("failed to generate lock token: %w", err)
+	}
+	value := hex.EncodeToString(token)
+	lockKey := r.keyPrefix + "lock:" + key
+
+	deadline := time.Now().Add(r.lockTTL)
+	for {
+		ctx, cancel := r.context()
+		locked, err := r.client.SetNX(ctx, lockKey, value, r.lockTTL).Result()
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock %q in redis: %w", lockKey, err)
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock %q in redis", lockKey)
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	return func() {
+		ctx, cancel := r.context()
+		defer cancel()
+		// a failure to unlock is not reported, as the lock times out anyway
+		_ = unlockScript.Run(ctx, r.client, []string{lockKey}, value).Err()
+	}, nil
+}
+
+// Close closes the connections to Redis
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+func (r *Redis) entryKey(key string) string {
+	return r.keyPrefix + "credential:" + key
+}
+
+func (r *Redis) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), r.timeout)
+}
+
+// escapePattern escapes the characters which have a special meaning in a Redis SCAN pattern
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
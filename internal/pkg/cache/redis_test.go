@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+	key := bytes.Repeat([]byte{1}, 32)
+
+	c, err := NewRedis(RedisOptions{Address: server.Addr(), Key: key, KeyPrefix: "test:"})
+	require.NoError(t, err)
+	require.NoError(t, c.Set("AWSSTSAssumeRoleProvider/role", newEntry("token-1", time.Hour)))
+	require.NoError(t, c.Set("StaticSecretProvider/secret", newEntry("token-2", 0)))
+
+	stored, err := server.Get("test:credential:AWSSTSAssumeRoleProvider/role")
+	require.NoError(t, err)
+	assert.NotContains(t, stored, "token-1", "values are encrypted")
+	assert.InDelta(t, time.Hour, server.TTL("test:credential:AWSSTSAssumeRoleProvider/role"), float64(5*time.Second), "entries expire with their credential")
+	assert.Zero(t, server.TTL("test:credential:StaticSecretProvider/secret"), "credentials without an expiry are kept")
+
+	// values cannot be read with another key, or moved to another key
+	other, err := NewRedis(RedisOptions{Address: server.Addr(), Key: bytes.Repeat([]byte{2}, 32), KeyPrefix: "test:"})
+	require.NoError(t, err)
+	_, _, err = other.Get("AWSSTSAssumeRoleProvider/role")
+	assert.Error(t, err)
+	server.Set("test:credential:moved", stored)
+	_, _, err = c.Get("moved")
+	assert.Error(t, err)
+
+	// the entry expires from redis along with the credential
+	server.FastForward(time.Hour)
+	_, ok, err := c.Get("AWSSTSAssumeRoleProvider/role")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = NewRedis(RedisOptions{Address: "127.0.0.1:1", Key: key, Timeout: time.Second})
+	assert.Error(t, err, "the server must be reachable")
+}
+
+func TestRedis_Lock(t *testing.T) {
+	server := miniredis.RunT(t)
+	key := bytes.Repeat([]byte{1}, 32)
+	first, err := NewRedis(RedisOptions{Address: server.Addr(), Key: key, LockTTL: 500 * time.Millisecond})
+	require.NoError(t, err)
+	second, err := NewRedis(RedisOptions{Address: server.Addr(), Key: key, LockTTL: 500 * time.Millisecond})
+	require.NoError(t, err)
+
+	unlock, err := first.Lock("AWSSTSAssumeRoleProvider/role")
+	require.NoError(t, err)
+
+	keys, err := first.Keys()
+	require.NoError(t, err)
+	assert.Empty(t, keys, "locks are not listed as entries")
+
+	// a lock held by another server is waited for
+	locked := make(chan error)
+	go func() {
+		unlockSecond, err := second.Lock("AWSSTSAssumeRoleProvider/role")
+		if err == nil {
+			unlockSecond()
+		}
+		locked <- err
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock was taken while held by another server")
+	case <-time.After(200 * time.Millisecond):
+	}
+	unlock()
+	require.NoError(t, <-locked)
+
+	// a lock which is never released times out
+	_, err = first.Lock("AWSSTSAssumeRoleProvider/role")
+	require.NoError(t, err)
+	_, err = second.Lock("AWSSTSAssumeRoleProvider/role")
+	assert.EqualError(t, err, `timed out waiting for lock "spiffe-connector:lock:AWSSTSAssumeRoleProvider/role" in redis`)
+}
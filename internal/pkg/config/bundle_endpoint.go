@@ -0,0 +1,122 @@
+package config
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/federation"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+const (
+	// defaultBundleRefreshInterval is how often a bundle is fetched when its endpoint gives no refresh hint
+	defaultBundleRefreshInterval = 5 * time.Minute
+
+	// bundleRetryInterval is the longest a failed fetch waits to be retried
+	bundleRetryInterval = 30 * time.Second
+
+	// bundleFetchTimeout bounds each request to a bundle endpoint
+	bundleFetchTimeout = 30 * time.Second
+)
+
+// watchBundleEndpoint fetches the bundle of the trust domain from its SPIFFE bundle endpoint, then keeps fetching it
+// in the background until the context is cancelled. The bundle is fetched again after the refresh hint the endpoint
+// gives, or the configured interval if it gives none. The first fetch must succeed unless a bundle has already been
+// loaded to bootstrap the endpoint, so that a misconfigured endpoint is found at startup.
+func (s *SpiffeConnectorSource) watchBundleEndpoint(ctx context.Context, td spiffeid.TrustDomain, cfg types.BundleEndpointConfig) error {
+	options, err := s.bundleEndpointOptions(cfg)
+	if err != nil {
+		return fmt.Errorf("trust domain %q: %w", td, err)
+	}
+	interval := cfg.RefreshInterval
+	if interval <= 0 {
+		interval = defaultBundleRefreshInterval
+	}
+	retry := bundleRetryInterval
+	if interval < retry {
+		retry = interval
+	}
+
+	// fetch updates the bundle and returns when it should next be fetched
+	fetch := func() (time.Duration, error) {
+		fetchCtx, cancel := context.WithTimeout(ctx, bundleFetchTimeout)
+		defer cancel()
+		bundle, err := federation.FetchBundle(fetchCtx, td, cfg.URL, options...)
+		if err != nil {
+			return retry, fmt.Errorf("failed to fetch bundle of trust domain %q from %q: %w", td, cfg.URL, err)
+		}
+		s.bundles.Add(bundle.X509Bundle())
+		// an endpoint without JWT authorities leaves them to the Workload API, if it is used
+		if len(bundle.JWTAuthorities()) > 0 {
+			s.jwtBundles.Add(bundle.JWTBundle())
+		} else {
+			s.jwtBundles.Remove(td)
+		}
+		if hint, ok := bundle.RefreshHint(); ok && hint > 0 {
+			return hint, nil
+		}
+		return interval, nil
+	}
+
+	next, err := fetch()
+	if err != nil {
+		if !s.bundles.Has(td) {
+			return err
+		}
+		log.Printf("%s, using the bootstrap bundle", err)
+	}
+
+	go func() {
+		t := time.NewTimer(next)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			next, err := fetch()
+			if err != nil {
+				log.Println(err)
+			}
+			t.Reset(next)
+		}
+	}()
+	return nil
+}
+
+// bundleEndpointOptions returns how the bundle endpoint is authenticated. With the https_spiffe profile the endpoint
+// is verified with the bundles of the source, so that each fetch is verified with the latest bundle of its trust
+// domain.
+func (s *SpiffeConnectorSource) bundleEndpointOptions(cfg types.BundleEndpointConfig) ([]federation.FetchOption, error) {
+	switch cfg.Profile {
+	case types.BundleEndpointProfileWeb:
+		if cfg.CAFile == "" {
+			return nil, nil
+		}
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle endpoint CA file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in bundle endpoint CA file %q", cfg.CAFile)
+		}
+		return []federation.FetchOption{federation.WithWebPKIRoots(roots)}, nil
+	case types.BundleEndpointProfileSPIFFE:
+		endpointID, err := spiffeid.FromString(cfg.EndpointSPIFFEID)
+		if err != nil {
+			return nil, fmt.Errorf("bundle endpoint SPIFFE ID is invalid: %w", err)
+		}
+		return []federation.FetchOption{federation.WithSPIFFEAuth(s, endpointID)}, nil
+	default:
+		return nil, errors.New("bundle endpoint profile must be https_web or https_spiffe")
+	}
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/spiffebundle"
+	"github.com/spiffe/go-spiffe/v2/federation"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/cryptoutil"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+// testBundle returns a bundle for the trust domain with a new CA, refreshed after refreshHint
+func testBundle(t *testing.T, td spiffeid.TrustDomain, refreshHint time.Duration) *spiffebundle.Bundle {
+	certs, err := cryptoutil.GenerateTestCerts("spiffe://" + td.String() + "/workload")
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(certs[0].Certificate[1])
+	require.NoError(t, err)
+	bundle := spiffebundle.FromX509Authorities(td, []*x509.Certificate{ca})
+	bundle.SetRefreshHint(refreshHint)
+	return bundle
+}
+
+func TestSpiffeConnectorSource_BundleEndpoint_Web(t *testing.T) {
+	ownCerts, err := cryptoutil.GenerateTestCerts("spiffe://example.com/server")
+	require.NoError(t, err)
+	partnerTD := spiffeid.RequireTrustDomainFromString("partner.example")
+
+	served := spiffebundle.NewSet(testBundle(t, partnerTD, time.Second))
+	handler, err := federation.NewHandler(partnerTD, served)
+	require.NoError(t, err)
+	endpoint := httptest.NewTLSServer(handler)
+	defer endpoint.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: endpoint.Certificate().Raw}), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source, err := ConstructSpiffeConnectorSource(ctx, cancel, &types.SpiffeConfig{
+		SVIDSources: types.SVIDSources{InMemory: inMemorySVID(t, ownCerts[0])},
+		TrustDomains: []types.TrustDomainConfig{
+			{Name: "example.com"},
+			{Name: "partner.example", BundleEndpoint: &types.BundleEndpointConfig{
+				URL:     endpoint.URL,
+				Profile: types.BundleEndpointProfileWeb,
+				CAFile:  caFile,
+			}},
+		},
+	})
+	require.NoError(t, err)
+	assert.True(t, source.AcceptsTrustDomain(partnerTD))
+
+	first, _ := served.Get(partnerTD)
+	bundle, err := source.GetX509BundleForTrustDomain(partnerTD)
+	require.NoError(t, err)
+	assert.True(t, first.X509Bundle().Equal(bundle), "the bundle is fetched at startup")
+
+	// the bundle is fetched again after the refresh hint
+	second := testBundle(t, partnerTD, time.Minute)
+	served.Add(second)
+	assert.Eventually(t, func() bool {
+		bundle, err := source.GetX509BundleForTrustDomain(partnerTD)
+		return err == nil && second.X509Bundle().Equal(bundle)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// without the CA of the endpoint it cannot be authenticated, and there is no bundle to fall back on
+	_, err = ConstructSpiffeConnectorSource(ctx, cancel, &types.SpiffeConfig{
+		SVIDSources: types.SVIDSources{InMemory: inMemorySVID(t, ownCerts[0])},
+		TrustDomains: []types.TrustDomainConfig{
+			{Name: "partner.example", BundleEndpoint: &types.BundleEndpointConfig{
+				URL:     endpoint.URL,
+				Profile: types.BundleEndpointProfileWeb,
+			}},
+		},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `failed to fetch bundle of trust domain "partner.example"`)
+}
+
+func TestSpiffeConnectorSource_BundleEndpoint_SPIFFE(t *testing.T) {
+	ownCerts, err := cryptoutil.GenerateTestCerts("spiffe://example.com/server")
+	require.NoError(t, err)
+	partnerTD := spiffeid.RequireTrustDomainFromString("partner.example")
+
+	// the endpoint is authenticated by its SVID, issued by the partner CA
+	partnerCerts, err := cryptoutil.GenerateTestCerts("spiffe://partner.example/bundle-endpoint")
+	require.NoError(t, err)
+	endpointSVIDConfig := inMemorySVID(t, partnerCerts[0])
+	endpointSVID, err := x509svid.Parse(endpointSVIDConfig.SVIDCert, endpointSVIDConfig.SVIDKey)
+	require.NoError(t, err)
+	partnerCA, err := x509.ParseCertificate(partnerCerts[0].Certificate[1])
+	require.NoError(t, err)
+	servedBundle := spiffebundle.FromX509Authorities(partnerTD, []*x509.Certificate{partnerCA})
+
+	handler, err := federation.NewHandler(partnerTD, spiffebundle.NewSet(servedBundle))
+	require.NoError(t, err)
+	endpoint := httptest.NewUnstartedServer(handler)
+	endpoint.TLS = tlsconfig.TLSServerConfig(endpointSVID)
+	endpoint.StartTLS()
+	defer endpoint.Close()
+
+	testCases := map[string]struct {
+		bootstrap        []byte
+		endpointSPIFFEID string
+		expectError      bool
+	}{
+		"bootstrapped from a bundle": {
+			bootstrap:        endpointSVIDConfig.TrustDomainCA,
+			endpointSPIFFEID: "spiffe://partner.example/bundle-endpoint",
+		},
+		"without a bootstrap bundle": {
+			endpointSPIFFEID: "spiffe://partner.example/bundle-endpoint",
+			expectError:      true,
+		},
+		"unexpected endpoint SPIFFE ID falls back on the bootstrap bundle": {
+			bootstrap:        endpointSVIDConfig.TrustDomainCA,
+			endpointSPIFFEID: "spiffe://partner.example/other",
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			source, err := ConstructSpiffeConnectorSource(ctx, cancel, &types.SpiffeConfig{
+				SVIDSources: types.SVIDSources{InMemory: inMemorySVID(t, ownCerts[0])},
+				TrustDomains: []types.TrustDomainConfig{
+					{Name: "partner.example", Bundle: testCase.bootstrap, BundleEndpoint: &types.BundleEndpointConfig{
+						URL:              endpoint.URL,
+						Profile:          types.BundleEndpointProfileSPIFFE,
+						EndpointSPIFFEID: testCase.endpointSPIFFEID,
+					}},
+				},
+			})
+			if testCase.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			bundle, err := source.GetX509BundleForTrustDomain(partnerTD)
+			require.NoError(t, err)
+			assert.True(t, servedBundle.X509Bundle().Equal(bundle))
+		})
+	}
+}
@@ -113,6 +113,539 @@ acls:
 `,
 			ExpectedError: errors.New("config validation failed: principal \"spiffe://foo/bar/baz\" is invalid: duplicate provider \"google\" (seen 2 times)"),
 		},
+		"valid config with SSH user certificate provider": {
+			InputFile: `---
+providers:
+  ssh_user_certificate:
+    ca_key_file: /etc/spiffe-connector/ssh-ca
+    duration: 30m
+acls:
+- match_principal: "spiffe://foo/bar/baz"
+  credentials:
+  - provider: "SSHUserCertificateProvider"
+    object_reference: "deploy"
+`,
+			ExpectedConfig: &types.ConfigFile{
+				Providers: &types.ProvidersConfig{
+					SSHUserCertificate: &types.SSHUserCertificateProviderConfig{
+						CAKeyFile: "/etc/spiffe-connector/ssh-ca",
+						Duration:  30 * time.Minute,
+					},
+				},
+				ACLs: []types.ACL{
+					{
+						MatchPrincipal: "spiffe://foo/bar/baz",
+						Credentials: []types.Credential{
+							{
+								Provider:        "SSHUserCertificateProvider",
+								ObjectReference: "deploy",
+							},
+						},
+					},
+				},
+			},
+		},
+		"invalid config with SSH user certificate provider missing CA": {
+			InputFile: `---
+providers:
+  ssh_user_certificate:
+    duration: 30m
+`,
+			ExpectedError: errors.New("config validation failed: providers config is invalid: ssh_user_certificate: ca_key_file must be set"),
+		},
+		"valid config with X509 client certificate provider": {
+			InputFile: `---
+providers:
+  x509_client_certificate:
+    ca_cert_file: /etc/spiffe-connector/client-ca.pem
+    ca_key_file: /etc/spiffe-connector/client-ca-key.pem
+    lifetime: 1h
+acls:
+- match_principal: "spiffe://foo/bar/baz"
+  credentials:
+  - provider: "X509ClientCertificateProvider"
+    object_reference: "cn=deploy"
+`,
+			ExpectedConfig: &types.ConfigFile{
+				Providers: &types.ProvidersConfig{
+					X509ClientCertificate: &types.X509ClientCertificateProviderConfig{
+						CACertFile: "/etc/spiffe-connector/client-ca.pem",
+						CAKeyFile:  "/etc/spiffe-connector/client-ca-key.pem",
+						Lifetime:   time.Hour,
+					},
+				},
+				ACLs: []types.ACL{
+					{
+						MatchPrincipal: "spiffe://foo/bar/baz",
+						Credentials: []types.Credential{
+							{
+								Provider:        "X509ClientCertificateProvider",
+								ObjectReference: "cn=deploy",
+							},
+						},
+					},
+				},
+			},
+		},
+		"invalid config with X509 client certificate provider missing CA key": {
+			InputFile: `---
+providers:
+  x509_client_certificate:
+    ca_cert_file: /etc/spiffe-connector/client-ca.pem
+`,
+			ExpectedError: errors.New("config validation failed: providers config is invalid: x509_client_certificate: ca_cert_file and ca_key_file must be set"),
+		},
+		"valid config with webhook provider not retrying": {
+			InputFile: `---
+providers:
+  webhook:
+    url: https://issuer.example.com/credentials
+    retries: 0
+`,
+			ExpectedConfig: &types.ConfigFile{
+				Providers: &types.ProvidersConfig{
+					Webhook: &types.WebhookProviderConfig{
+						URL:     "https://issuer.example.com/credentials",
+						Retries: new(int),
+					},
+				},
+			},
+		},
+		"invalid config with webhook provider retrying a negative number of times": {
+			InputFile: `---
+providers:
+  webhook:
+    url: https://issuer.example.com/credentials
+    retries: -1
+`,
+			ExpectedError: errors.New("config validation failed: providers config is invalid: webhook: retries cannot be negative"),
+		},
+		"valid config with mock provider replacing AWS": {
+			InputFile: `---
+providers:
+  mock:
+    replaces:
+    - AWSSTSAssumeRoleProvider
+    lifetime: 5m
+    error_rate: 0.1
+    errors:
+      "arn:aws:iam::123456789012:role/denied": "AccessDenied"
+acls:
+- match_principal: "spiffe://foo/bar/baz"
+  credentials:
+  - provider: "AWSSTSAssumeRoleProvider"
+    object_reference: "arn:aws:iam::123456789012:role/reader"
+`,
+			ExpectedConfig: &types.ConfigFile{
+				Providers: &types.ProvidersConfig{
+					Mock: &types.MockProviderConfig{
+						Replaces:  []string{"AWSSTSAssumeRoleProvider"},
+						Lifetime:  5 * time.Minute,
+						ErrorRate: 0.1,
+						Errors:    map[string]string{"arn:aws:iam::123456789012:role/denied": "AccessDenied"},
+					},
+				},
+				ACLs: []types.ACL{
+					{
+						MatchPrincipal: "spiffe://foo/bar/baz",
+						Credentials: []types.Credential{
+							{
+								Provider:        "AWSSTSAssumeRoleProvider",
+								ObjectReference: "arn:aws:iam::123456789012:role/reader",
+							},
+						},
+					},
+				},
+			},
+		},
+		"invalid config with mock provider error rate": {
+			InputFile: `---
+providers:
+  mock:
+    error_rate: 2
+`,
+			ExpectedError: errors.New("config validation failed: providers config is invalid: mock: error_rate must be between 0 and 1"),
+		},
+		"valid config with output overrides": {
+			InputFile: `---
+acls:
+- match_principal: "spiffe://foo/bar/baz"
+  credentials:
+  - provider: "GoogleIAMServiceAccountKeyProvider"
+    object_reference: "service-account@example.com"
+    output:
+      files:
+        application_default_credentials:
+          path: /var/run/secrets/gcp/adc.json
+          mode: "0600"
+      file_env_vars:
+        GOOGLE_APPLICATION_CREDENTIALS: application_default_credentials
+`,
+			ExpectedConfig: &types.ConfigFile{
+				ACLs: []types.ACL{
+					{
+						MatchPrincipal: "spiffe://foo/bar/baz",
+						Credentials: []types.Credential{
+							{
+								Provider:        "GoogleIAMServiceAccountKeyProvider",
+								ObjectReference: "service-account@example.com",
+								Output: &types.CredentialOutput{
+									Files: map[string]types.FileOutput{
+										"application_default_credentials": {Path: "/var/run/secrets/gcp/adc.json", Mode: "0600"},
+									},
+									FileEnvVars: map[string]string{"GOOGLE_APPLICATION_CREDENTIALS": "application_default_credentials"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		"valid config with credential issuance and options": {
+			InputFile: `---
+acls:
+- match_principal: "spiffe://foo/bar/batch"
+  credentials:
+  - provider: "AWSSTSAssumeRoleProvider"
+    object_reference: "arn:aws:iam::123456789012:role/reader"
+    issuance: per-principal
+    options:
+      duration: 15m
+`,
+			ExpectedConfig: &types.ConfigFile{
+				ACLs: []types.ACL{
+					{
+						MatchPrincipal: "spiffe://foo/bar/batch",
+						Credentials: []types.Credential{
+							{
+								Provider:        "AWSSTSAssumeRoleProvider",
+								ObjectReference: "arn:aws:iam::123456789012:role/reader",
+								Issuance:        types.IssuancePerPrincipal,
+								Options:         map[string]string{"duration": "15m"},
+							},
+						},
+					},
+				},
+			},
+		},
+		"valid config with background refresh": {
+			InputFile: `---
+server:
+  refresh:
+    fraction: 0.5
+    idle_timeout: 30m
+`,
+			ExpectedConfig: &types.ConfigFile{
+				Server: &types.ServerConfig{
+					Refresh: &types.RefreshConfig{
+						Fraction:    0.5,
+						IdleTimeout: 30 * time.Minute,
+					},
+				},
+			},
+		},
+		"invalid config with background refresh jitter": {
+			InputFile: `---
+server:
+  refresh:
+    fraction: 0.5
+    jitter: 0.5
+`,
+			ExpectedError: errors.New("config validation failed: server config is invalid: refresh: jitter cannot be negative or as large as fraction"),
+		},
+		"valid config with freshness policies": {
+			InputFile: `---
+server:
+  freshness:
+    renew_before: 10m
+    without_expiry: reuse
+  provider_freshness:
+    GoogleIAMServiceAccountKeyProvider:
+      renew_before: 10%
+acls:
+- match_principal: "spiffe://foo/bar/baz"
+  credentials:
+  - provider: "AWSSTSAssumeRoleProvider"
+    object_reference: "arn:aws:iam::123456789012:role/reader"
+    freshness:
+      renew_before: 50%
+`,
+			ExpectedConfig: &types.ConfigFile{
+				Server: &types.ServerConfig{
+					Freshness: &types.FreshnessPolicy{RenewBefore: "10m", WithoutExpiry: "reuse"},
+					ProviderFreshness: map[string]types.FreshnessPolicy{
+						"GoogleIAMServiceAccountKeyProvider": {RenewBefore: "10%"},
+					},
+				},
+				ACLs: []types.ACL{
+					{
+						MatchPrincipal: "spiffe://foo/bar/baz",
+						Credentials: []types.Credential{
+							{
+								Provider:        "AWSSTSAssumeRoleProvider",
+								ObjectReference: "arn:aws:iam::123456789012:role/reader",
+								Freshness:       &types.FreshnessPolicy{RenewBefore: "50%"},
+							},
+						},
+					},
+				},
+			},
+		},
+		"invalid config with provider freshness": {
+			InputFile: `---
+server:
+  provider_freshness:
+    AWSSTSAssumeRoleProvider:
+      renew_before: soon
+`,
+			ExpectedError: errors.New(`config validation failed: server config is invalid: provider_freshness: AWSSTSAssumeRoleProvider: renew_before "soon" must be a positive duration or a percentage`),
+		},
+		"valid config with a file cache": {
+			InputFile: `---
+server:
+  cache:
+    backend: file
+    path: /var/lib/spiffe-connector/cache
+    key_env: SPIFFE_CONNECTOR_CACHE_KEY
+`,
+			ExpectedConfig: &types.ConfigFile{
+				Server: &types.ServerConfig{
+					Cache: &types.CacheConfig{
+						Backend: "file",
+						Path:    "/var/lib/spiffe-connector/cache",
+						KeyEnv:  "SPIFFE_CONNECTOR_CACHE_KEY",
+					},
+				},
+			},
+		},
+		"invalid config with a file cache without a key": {
+			InputFile: `---
+server:
+  cache:
+    backend: file
+    path: /var/lib/spiffe-connector/cache
+`,
+			ExpectedError: errors.New("config validation failed: server config is invalid: cache: exactly one of key_file or key_env is required for the file backend"),
+		},
+		"valid config with a redis cache": {
+			InputFile: `---
+server:
+  cache:
+    backend: redis
+    key_file: /etc/spiffe-connector/cache.key
+    redis:
+      address: redis:6379
+      password_env: REDIS_PASSWORD
+      lock_ttl: 5s
+`,
+			ExpectedConfig: &types.ConfigFile{
+				Server: &types.ServerConfig{
+					Cache: &types.CacheConfig{
+						Backend: "redis",
+						KeyFile: "/etc/spiffe-connector/cache.key",
+						Redis: &types.RedisCacheConfig{
+							Address:     "redis:6379",
+							PasswordEnv: "REDIS_PASSWORD",
+							LockTTL:     5 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		"invalid config with a redis cache without an address": {
+			InputFile: `---
+server:
+  cache:
+    backend: redis
+    key_env: SPIFFE_CONNECTOR_CACHE_KEY
+`,
+			ExpectedError: errors.New("config validation failed: server config is invalid: cache: redis address is required for the redis backend"),
+		},
+		"valid config with a unix socket listener": {
+			InputFile: `---
+server:
+  listen:
+    network: unix
+    address: /run/spiffe-connector/server.sock
+    socket_mode: "0660"
+    keepalive:
+      time: 1m
+      timeout: 10s
+    max_recv_msg_size: 1048576
+`,
+			ExpectedConfig: &types.ConfigFile{
+				Server: &types.ServerConfig{
+					Listen: &types.ListenConfig{
+						Network:        "unix",
+						Address:        "/run/spiffe-connector/server.sock",
+						SocketMode:     "0660",
+						Keepalive:      &types.KeepaliveConfig{Time: time.Minute, Timeout: 10 * time.Second},
+						MaxRecvMsgSize: 1048576,
+					},
+				},
+			},
+		},
+		"invalid config with a unix socket listener without a path": {
+			InputFile: `---
+server:
+  listen:
+    network: unix
+`,
+			ExpectedError: errors.New("config validation failed: server config is invalid: listen: address must be a socket path for the unix network"),
+		},
+		"valid config with federated trust domains": {
+			InputFile: `---
+spiffe:
+  svid_sources:
+    workload_api:
+      socket_path: unix:///run/spire/sockets/agent.sock
+  trust_domains:
+  - name: example.com
+  - name: partner.example
+    bundle_file: /etc/spiffe-connector/partner.example.pem
+`,
+			ExpectedConfig: &types.ConfigFile{
+				SPIFFE: &types.SpiffeConfig{
+					SVIDSources: types.SVIDSources{
+						WorkloadAPI: &types.WorkloadAPI{SocketPath: "unix:///run/spire/sockets/agent.sock"},
+					},
+					TrustDomains: []types.TrustDomainConfig{
+						{Name: "example.com"},
+						{Name: "partner.example", BundleFile: "/etc/spiffe-connector/partner.example.pem"},
+					},
+				},
+			},
+		},
+		"valid config with a trust domain bundle endpoint": {
+			InputFile: `---
+spiffe:
+  trust_domains:
+  - name: partner.example
+    bundle_file: /etc/spiffe-connector/partner.example.pem
+    bundle_endpoint:
+      url: https://spire.partner.example:8443
+      profile: https_spiffe
+      endpoint_spiffe_id: spiffe://partner.example/spire/server
+`,
+			ExpectedConfig: &types.ConfigFile{
+				SPIFFE: &types.SpiffeConfig{
+					TrustDomains: []types.TrustDomainConfig{
+						{
+							Name:       "partner.example",
+							BundleFile: "/etc/spiffe-connector/partner.example.pem",
+							BundleEndpoint: &types.BundleEndpointConfig{
+								URL:              "https://spire.partner.example:8443",
+								Profile:          "https_spiffe",
+								EndpointSPIFFEID: "spiffe://partner.example/spire/server",
+							},
+						},
+					},
+				},
+			},
+		},
+		"invalid config with a trust domain bundle endpoint": {
+			InputFile: `---
+spiffe:
+  trust_domains:
+  - name: partner.example
+    bundle_endpoint:
+      url: http://spire.partner.example
+      profile: https_spiffe
+`,
+			ExpectedError: errors.New(`config validation failed: spiffe config is invalid: trust domain "partner.example": bundle_endpoint: url "http://spire.partner.example" must be an https URL, spiffe config is invalid: trust domain "partner.example": bundle_endpoint: endpoint_spiffe_id "" is invalid: cannot be empty`),
+		},
+		"invalid config with a duplicate trust domain": {
+			InputFile: `---
+spiffe:
+  trust_domains:
+  - name: example.com
+  - name: example.com
+`,
+			ExpectedError: errors.New(`config validation failed: spiffe config is invalid: duplicate trust domain "example.com"`),
+		},
+		"valid config with JWT-SVID authentication": {
+			InputFile: `---
+spiffe:
+  svid_sources:
+    workload_api:
+      socket_path: unix:///run/spire/sockets/agent.sock
+      jwt_bundles: true
+  trust_domains:
+  - name: example.com
+  - name: partner.example
+    bundle_file: /etc/spiffe-connector/partner.example.pem
+    jwt_bundle_file: /etc/spiffe-connector/partner.example.jwks
+server:
+  auth:
+    methods: [x509, jwt]
+    jwt_audience: [spiffe-connector]
+`,
+			ExpectedConfig: &types.ConfigFile{
+				SPIFFE: &types.SpiffeConfig{
+					SVIDSources: types.SVIDSources{
+						WorkloadAPI: &types.WorkloadAPI{SocketPath: "unix:///run/spire/sockets/agent.sock", JWTBundles: true},
+					},
+					TrustDomains: []types.TrustDomainConfig{
+						{Name: "example.com"},
+						{
+							Name:          "partner.example",
+							BundleFile:    "/etc/spiffe-connector/partner.example.pem",
+							JWTBundleFile: "/etc/spiffe-connector/partner.example.jwks",
+						},
+					},
+				},
+				Server: &types.ServerConfig{
+					Auth: &types.AuthConfig{
+						Methods:     []string{"x509", "jwt"},
+						JWTAudience: []string{"spiffe-connector"},
+					},
+				},
+			},
+		},
+		"invalid config with JWT-SVID authentication without an audience or JWT bundles": {
+			InputFile: `---
+spiffe:
+  svid_sources:
+    workload_api:
+      socket_path: unix:///run/spire/sockets/agent.sock
+server:
+  auth:
+    methods: [jwt, oidc]
+`,
+			ExpectedError: errors.New(`config validation failed: server config is invalid: auth: method "oidc" must be one of x509 or jwt, server config is invalid: auth: jwt_audience is required for the jwt method, server config is invalid: auth: the jwt method needs JWT bundles from the workload API, a jwt_bundle_file or a bundle endpoint`),
+		},
+		"invalid config with a JWT bundle file and a bundle endpoint": {
+			InputFile: `---
+spiffe:
+  trust_domains:
+  - name: partner.example
+    jwt_bundle_file: /etc/spiffe-connector/partner.example.jwks
+    bundle_endpoint:
+      url: https://spire.partner.example
+      profile: https_web
+`,
+			ExpectedError: errors.New(`config validation failed: spiffe config is invalid: trust domain "partner.example": jwt_bundle_file cannot be used with a bundle endpoint, which serves the JWT authorities`),
+		},
+		"valid config with the HTTP API": {
+			InputFile: `---
+server:
+  http:
+    address: "[::]:8443"
+`,
+			ExpectedConfig: &types.ConfigFile{
+				Server: &types.ServerConfig{
+					HTTP: &types.HTTPConfig{Address: "[::]:8443"},
+				},
+			},
+		},
+		"invalid config with the HTTP API on an unknown network": {
+			InputFile: `---
+server:
+  http:
+    network: udp
+`,
+			ExpectedError: errors.New("config validation failed: server config is invalid: http: network must be tcp or unix"),
+		},
 		"invalid config with bad ACL match_principals": {
 			InputFile: `---
 acls:
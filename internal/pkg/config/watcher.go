@@ -13,6 +13,7 @@ import (
 type Watcher struct {
 	actions []func() error
 	notify  chan struct{}
+	done    chan struct{}
 }
 
 // Notify manually runs all actions in a watcher
@@ -22,10 +23,26 @@ func (w *Watcher) Notify() {
 	}(w)
 }
 
+// Done is closed once the watcher has stopped, after its context is cancelled
+func (w *Watcher) Done() <-chan struct{} {
+	return w.done
+}
+
 func NewWatcher(ctx context.Context, filePath string, actions ...func() error) (*Watcher, error) {
+	return newWatcher(ctx, filePath, false, actions...)
+}
+
+// NewDirectoryWatcher watches a directory for changes to its entries. Unlike a file, a removed directory is not
+// expected to be replaced, so when it is removed the actions are run a last time and the watcher stops.
+func NewDirectoryWatcher(ctx context.Context, dir string, actions ...func() error) (*Watcher, error) {
+	return newWatcher(ctx, dir, true, actions...)
+}
+
+func newWatcher(ctx context.Context, filePath string, directory bool, actions ...func() error) (*Watcher, error) {
 	w := &Watcher{
 		actions: actions,
 		notify:  make(chan struct{}),
+		done:    make(chan struct{}),
 	}
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -37,6 +54,7 @@ func NewWatcher(ctx context.Context, filePath string, actions ...func() error) (
 	}
 
 	go func(w *Watcher, watcher *fsnotify.Watcher) {
+		defer close(w.done)
 		// only perform actions every 5 seconds at most
 		t := time.NewTicker(5 * time.Second)
 		defer t.Stop()
@@ -78,13 +96,23 @@ func NewWatcher(ctx context.Context, filePath string, actions ...func() error) (
 				// When a config map is updated, behind the scenes Kubernetes creates
 				// a new directory with the new contents, then replaces the symlink to point
 				// to the new config map, then deletes the old one. In this case, we get a delete
-				// event rather than a write event.
+				// event rather than a write event. When watching a directory, removing one of its files does not
+				// affect the watch.
 				if event.Op == fsnotify.Remove {
-					// Only error here would be attempting to remove a non-existent watch
-					_ = watcher.Remove(event.Name)
-					err := watcher.Add(event.Name)
-					if err != nil {
-						log.Fatalf("file %s change detected, but could not re-watch the file: %s", event.Name, err.Error())
+					if event.Name == filePath && directory {
+						for _, e := range runAll(w.actions...) {
+							log.Printf("error while reloading removed directory %s (%s)", event.Name, e.Error())
+						}
+						watcher.Close()
+						return
+					}
+					if event.Name == filePath {
+						// Only error here would be attempting to remove a non-existent watch
+						_ = watcher.Remove(event.Name)
+						err := watcher.Add(event.Name)
+						if err != nil {
+							log.Fatalf("file %s change detected, but could not re-watch the file: %s", event.Name, err.Error())
+						}
 					}
 					lastEvent = &event
 				}
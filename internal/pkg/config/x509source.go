@@ -7,6 +7,7 @@ import (
 	"os"
 	"sync/atomic"
 
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
 	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
@@ -18,23 +19,39 @@ import (
 // Interface guards
 var _ x509svid.Source = &SpiffeConnectorSource{}
 var _ x509bundle.Source = &SpiffeConnectorSource{}
+var _ jwtbundle.Source = &SpiffeConnectorSource{}
 
-// SpiffeConnectorSource implements x509svid.Source and x509bundle.Source by either
+// SpiffeConnectorSource implements x509svid.Source, x509bundle.Source and jwtbundle.Source by either
 // reading files or communicating with the SPIRE workload API.
 type SpiffeConnectorSource struct {
 	cancelFunc context.CancelFunc
 
 	workloadAPISource *workloadapi.X509Source
 
-	currentSVID        atomic.Value // *x509svid.SVID
-	currentTrustBundle atomic.Value // *x509bundle.Bundle
+	// workloadAPIJWTSource watches the JWT bundles from the Workload API, if they are used
+	workloadAPIJWTSource *workloadapi.JWTSource
+
+	currentSVID atomic.Value // *x509svid.SVID
+
+	// bundles holds the trust bundles which do not come from the Workload API
+	bundles *x509bundle.Set
+
+	// jwtBundles holds the JWT bundles which do not come from the Workload API
+	jwtBundles *jwtbundle.Set
+
+	// trustDomains are the trust domains whose workloads are accepted, if empty only the trust domain of the current
+	// SVID is
+	trustDomains map[spiffeid.TrustDomain]bool
 }
 
 // ConstructSpiffeConnectorSource constructs a new SPIFFE Connector source ready to become the current source.
 // When disposing of the source be sure to cancel the Context, as this will clean up the fsnotify watchers.
 func ConstructSpiffeConnectorSource(ctx context.Context, cancel context.CancelFunc, config *types.SpiffeConfig) (*SpiffeConnectorSource, error) {
 	source := &SpiffeConnectorSource{
-		cancelFunc: cancel,
+		cancelFunc:   cancel,
+		bundles:      x509bundle.NewSet(),
+		jwtBundles:   jwtbundle.NewSet(),
+		trustDomains: make(map[spiffeid.TrustDomain]bool),
 	}
 	if config == nil {
 		return nil, errors.New("no SPIFFE config provided")
@@ -42,11 +59,22 @@ func ConstructSpiffeConnectorSource(ctx context.Context, cancel context.CancelFu
 
 	// If Workload API is set, just use that.
 	if config.SVIDSources.WorkloadAPI != nil {
-		x509source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(config.SVIDSources.WorkloadAPI.SocketPath)))
+		clientOptions := workloadapi.WithClientOptions(workloadapi.WithAddr(config.SVIDSources.WorkloadAPI.SocketPath))
+		x509source, err := workloadapi.NewX509Source(ctx, clientOptions)
 		if err != nil {
 			return nil, err
 		}
 		source.workloadAPISource = x509source
+		if config.SVIDSources.WorkloadAPI.JWTBundles {
+			jwtSource, err := workloadapi.NewJWTSource(ctx, clientOptions)
+			if err != nil {
+				return nil, fmt.Errorf("failed to watch JWT bundles: %w", err)
+			}
+			source.workloadAPIJWTSource = jwtSource
+		}
+		if err := source.loadTrustDomains(ctx, config.TrustDomains); err != nil {
+			return nil, err
+		}
 		return source, nil
 	}
 
@@ -60,12 +88,15 @@ func ConstructSpiffeConnectorSource(ctx context.Context, cancel context.CancelFu
 		}
 		source.currentSVID.Store(svid)
 
-		bundle, err := x509bundle.Parse(spiffeid.RequireTrustDomainFromString("todo"), config.SVIDSources.InMemory.TrustDomainCA)
+		bundle, err := x509bundle.Parse(svid.ID.TrustDomain(), config.SVIDSources.InMemory.TrustDomainCA)
 		if err != nil {
 			return source, err
 		}
-		source.currentTrustBundle.Store(bundle)
+		source.bundles.Add(bundle)
 
+		if err := source.loadTrustDomains(ctx, config.TrustDomains); err != nil {
+			return source, err
+		}
 		return source, nil
 	}
 
@@ -78,7 +109,6 @@ func ConstructSpiffeConnectorSource(ctx context.Context, cancel context.CancelFu
 	}
 
 	source.currentSVID.Store(new(x509svid.SVID))
-	source.currentTrustBundle.Store(new(x509bundle.Bundle))
 
 	// Start watching for SVID updates
 	updateSVID := func() error {
@@ -102,13 +132,14 @@ func ConstructSpiffeConnectorSource(ctx context.Context, cancel context.CancelFu
 		return nil, err
 	}
 
-	// Start watching for Trust bundle updates
+	// Start watching for Trust bundle updates, the CAs are those of the trust domain of the SVID
 	updateTrustBundle := func() error {
-		bundle, err := x509bundle.Load(spiffeid.RequireTrustDomainFromString("todo"), config.SVIDSources.Files.TrustDomainCA)
+		svid, _ := source.GetX509SVID()
+		bundle, err := x509bundle.Load(svid.ID.TrustDomain(), config.SVIDSources.Files.TrustDomainCA)
 		if err != nil {
 			return fmt.Errorf("failed to load trust bundle: %w", err)
 		}
-		source.currentTrustBundle.Store(bundle)
+		source.bundles.Add(bundle)
 		return nil
 	}
 	if err := updateTrustBundle(); err != nil {
@@ -117,9 +148,97 @@ func ConstructSpiffeConnectorSource(ctx context.Context, cancel context.CancelFu
 	if _, err := NewWatcher(ctx, config.SVIDSources.Files.TrustDomainCA, updateTrustBundle); err != nil {
 		return nil, fmt.Errorf("failed to start new config watcher: %w", err)
 	}
+
+	if err := source.loadTrustDomains(ctx, config.TrustDomains); err != nil {
+		return nil, err
+	}
 	return source, nil
 }
 
+// loadTrustDomains loads the bundles of the accepted trust domains which have their own, watching bundle files for
+// changes. Every other accepted trust domain must have its bundle in the Workload API, or be the server's own.
+func (s *SpiffeConnectorSource) loadTrustDomains(ctx context.Context, trustDomains []types.TrustDomainConfig) error {
+	for _, tdConfig := range trustDomains {
+		tdConfig := tdConfig
+		td, err := spiffeid.TrustDomainFromString(tdConfig.Name)
+		if err != nil {
+			return fmt.Errorf("trust domain %q is invalid: %w", tdConfig.Name, err)
+		}
+		s.trustDomains[td] = true
+
+		if err := s.loadJWTBundle(ctx, td, tdConfig); err != nil {
+			return err
+		}
+
+		// a bundle endpoint keeps the bundle up to date, so a bundle configured alongside it only bootstraps the
+		// first fetch and is not watched
+		if tdConfig.BundleEndpoint != nil {
+			if err := s.loadBootstrapBundle(td, tdConfig); err != nil {
+				return err
+			}
+			if err := s.watchBundleEndpoint(ctx, td, *tdConfig.BundleEndpoint); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch {
+		case tdConfig.Bundle != nil:
+			bundle, err := x509bundle.Parse(td, tdConfig.Bundle)
+			if err != nil {
+				return fmt.Errorf("failed to parse bundle of trust domain %q: %w", td, err)
+			}
+			s.bundles.Add(bundle)
+		case tdConfig.BundleFile != "":
+			updateBundle := func() error {
+				bundle, err := x509bundle.Load(td, tdConfig.BundleFile)
+				if err != nil {
+					return fmt.Errorf("failed to load bundle of trust domain %q: %w", td, err)
+				}
+				s.bundles.Add(bundle)
+				return nil
+			}
+			if err := updateBundle(); err != nil {
+				return err
+			}
+			if _, err := NewWatcher(ctx, tdConfig.BundleFile, updateBundle); err != nil {
+				return fmt.Errorf("failed to start new config watcher: %w", err)
+			}
+		case s.workloadAPISource == nil && !s.bundles.Has(td):
+			return fmt.Errorf("trust domain %q has no bundle, one must be configured unless the workload API is used", td)
+		}
+	}
+	return nil
+}
+
+// loadJWTBundle loads the JWT bundle of the trust domain if one is configured, watching the file for changes
+func (s *SpiffeConnectorSource) loadJWTBundle(ctx context.Context, td spiffeid.TrustDomain, tdConfig types.TrustDomainConfig) error {
+	switch {
+	case tdConfig.JWTBundle != nil:
+		bundle, err := jwtbundle.Parse(td, tdConfig.JWTBundle)
+		if err != nil {
+			return fmt.Errorf("failed to parse JWT bundle of trust domain %q: %w", td, err)
+		}
+		s.jwtBundles.Add(bundle)
+	case tdConfig.JWTBundleFile != "":
+		updateBundle := func() error {
+			bundle, err := jwtbundle.Load(td, tdConfig.JWTBundleFile)
+			if err != nil {
+				return fmt.Errorf("failed to load JWT bundle of trust domain %q: %w", td, err)
+			}
+			s.jwtBundles.Add(bundle)
+			return nil
+		}
+		if err := updateBundle(); err != nil {
+			return err
+		}
+		if _, err := NewWatcher(ctx, tdConfig.JWTBundleFile, updateBundle); err != nil {
+			return fmt.Errorf("failed to start new config watcher: %w", err)
+		}
+	}
+	return nil
+}
+
 func (s *SpiffeConnectorSource) GetX509SVID() (*x509svid.SVID, error) {
 	if s.workloadAPISource != nil {
 		return s.workloadAPISource.GetX509SVID()
@@ -127,11 +246,62 @@ func (s *SpiffeConnectorSource) GetX509SVID() (*x509svid.SVID, error) {
 	return s.currentSVID.Load().(*x509svid.SVID), nil
 }
 
+// loadBootstrapBundle loads the bundle used to authenticate the bundle endpoint of the trust domain the first time, if
+// one is configured
+func (s *SpiffeConnectorSource) loadBootstrapBundle(td spiffeid.TrustDomain, tdConfig types.TrustDomainConfig) error {
+	var bundle *x509bundle.Bundle
+	var err error
+	switch {
+	case tdConfig.Bundle != nil:
+		bundle, err = x509bundle.Parse(td, tdConfig.Bundle)
+	case tdConfig.BundleFile != "":
+		bundle, err = x509bundle.Load(td, tdConfig.BundleFile)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load bootstrap bundle of trust domain %q: %w", td, err)
+	}
+	s.bundles.Add(bundle)
+	return nil
+}
+
+// GetX509BundleForTrustDomain returns the bundle configured for the trust domain, or otherwise the one from the Workload
+// API if it is used
 func (s *SpiffeConnectorSource) GetX509BundleForTrustDomain(trustDomain spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
+	if s.bundles != nil {
+		if bundle, ok := s.bundles.Get(trustDomain); ok {
+			return bundle, nil
+		}
+	}
 	if s.workloadAPISource != nil {
 		return s.workloadAPISource.GetX509BundleForTrustDomain(trustDomain)
 	}
-	return s.currentTrustBundle.Load().(*x509bundle.Bundle), nil
+	return nil, fmt.Errorf("no bundle for trust domain %q", trustDomain)
+}
+
+// GetJWTBundleForTrustDomain returns the JWT bundle configured for the trust domain, or otherwise the one from the
+// Workload API if its JWT bundles are used
+func (s *SpiffeConnectorSource) GetJWTBundleForTrustDomain(trustDomain spiffeid.TrustDomain) (*jwtbundle.Bundle, error) {
+	if s.jwtBundles != nil {
+		if bundle, ok := s.jwtBundles.Get(trustDomain); ok {
+			return bundle, nil
+		}
+	}
+	if s.workloadAPIJWTSource != nil {
+		return s.workloadAPIJWTSource.GetJWTBundleForTrustDomain(trustDomain)
+	}
+	return nil, fmt.Errorf("no JWT bundle for trust domain %q", trustDomain)
+}
+
+// AcceptsTrustDomain reports whether workloads in the trust domain may connect. Those are the trust domain of the
+// server's own SVID and any configured trust domains.
+func (s *SpiffeConnectorSource) AcceptsTrustDomain(trustDomain spiffeid.TrustDomain) bool {
+	if s.trustDomains[trustDomain] {
+		return true
+	}
+	svid, err := s.GetX509SVID()
+	return err == nil && svid != nil && svid.ID.TrustDomain() == trustDomain
 }
 
 func (s *SpiffeConnectorSource) Cancel() {
@@ -149,3 +319,11 @@ func (d DynamicSource) GetX509SVID() (*x509svid.SVID, error) {
 func (d DynamicSource) GetX509BundleForTrustDomain(trustDomain spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
 	return GetCurrentSource().GetX509BundleForTrustDomain(trustDomain)
 }
+
+func (d DynamicSource) GetJWTBundleForTrustDomain(trustDomain spiffeid.TrustDomain) (*jwtbundle.Bundle, error) {
+	return GetCurrentSource().GetJWTBundleForTrustDomain(trustDomain)
+}
+
+func (d DynamicSource) AcceptsTrustDomain(trustDomain spiffeid.TrustDomain) bool {
+	return GetCurrentSource().AcceptsTrustDomain(trustDomain)
+}
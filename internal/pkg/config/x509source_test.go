@@ -0,0 +1,149 @@
+package config
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/cryptoutil"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+// inMemorySVID encodes a test certificate and its CA as the config of an in memory SVID source
+func inMemorySVID(t *testing.T, cert tls.Certificate) *types.InMemory {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	return &types.InMemory{
+		TrustDomainCA: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[1]}),
+		SVIDCert:      pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}),
+		SVIDKey:       pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}),
+	}
+}
+
+func TestSpiffeConnectorSource_TrustDomains(t *testing.T) {
+	serverCerts, err := cryptoutil.GenerateTestCerts("spiffe://example.com/server")
+	require.NoError(t, err)
+	partnerCerts, err := cryptoutil.GenerateTestCerts("spiffe://partner.example/client")
+	require.NoError(t, err)
+	svid := inMemorySVID(t, serverCerts[0])
+	partnerBundle := inMemorySVID(t, partnerCerts[0]).TrustDomainCA
+
+	exampleTD := spiffeid.RequireTrustDomainFromString("example.com")
+	partnerTD := spiffeid.RequireTrustDomainFromString("partner.example")
+	otherTD := spiffeid.RequireTrustDomainFromString("other.example")
+
+	testCases := map[string]struct {
+		trustDomains  []types.TrustDomainConfig
+		expected      map[spiffeid.TrustDomain]bool
+		expectedError error
+	}{
+		"own trust domain by default": {
+			expected: map[spiffeid.TrustDomain]bool{exampleTD: true, partnerTD: false, otherTD: false},
+		},
+		"federated trust domain": {
+			trustDomains: []types.TrustDomainConfig{
+				{Name: "example.com"},
+				{Name: "partner.example", Bundle: partnerBundle},
+			},
+			expected: map[spiffeid.TrustDomain]bool{exampleTD: true, partnerTD: true, otherTD: false},
+		},
+		"own trust domain with one federated trust domain": {
+			trustDomains: []types.TrustDomainConfig{{Name: "partner.example", Bundle: partnerBundle}},
+			expected:     map[spiffeid.TrustDomain]bool{exampleTD: true, partnerTD: true, otherTD: false},
+		},
+		"trust domain without a bundle": {
+			trustDomains:  []types.TrustDomainConfig{{Name: "other.example"}},
+			expectedError: errors.New(`trust domain "other.example" has no bundle, one must be configured unless the workload API is used`),
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			source, err := ConstructSpiffeConnectorSource(ctx, cancel, &types.SpiffeConfig{
+				SVIDSources:  types.SVIDSources{InMemory: svid},
+				TrustDomains: testCase.trustDomains,
+			})
+			if testCase.expectedError != nil {
+				assert.EqualError(t, err, testCase.expectedError.Error())
+				return
+			}
+			require.NoError(t, err)
+
+			for td, expected := range testCase.expected {
+				assert.Equal(t, expected, source.AcceptsTrustDomain(td), td.String())
+			}
+
+			// each trust domain has its own bundle
+			bundle, err := source.GetX509BundleForTrustDomain(exampleTD)
+			require.NoError(t, err)
+			assert.Equal(t, serverCerts[0].Certificate[1], bundle.X509Authorities()[0].Raw)
+			_, err = source.GetX509BundleForTrustDomain(otherTD)
+			assert.EqualError(t, err, `no bundle for trust domain "other.example"`)
+		})
+	}
+}
+
+func TestSpiffeConnectorSource_JWTBundles(t *testing.T) {
+	serverCerts, err := cryptoutil.GenerateTestCerts("spiffe://example.com/server")
+	require.NoError(t, err)
+	partnerTD := spiffeid.RequireTrustDomainFromString("partner.example")
+
+	// jwks returns a JWT bundle of the partner trust domain with a new key
+	jwks := func(keyID string) []byte {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		bundle, err := jwtbundle.FromJWTAuthorities(partnerTD, map[string]crypto.PublicKey{keyID: key.Public()}).Marshal()
+		require.NoError(t, err)
+		return bundle
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bundleFile := filepath.Join(t.TempDir(), "partner.example.jwks")
+	require.NoError(t, os.WriteFile(bundleFile, jwks("first"), 0600))
+
+	partnerBundle := inMemorySVID(t, serverCerts[0]).TrustDomainCA
+	source, err := ConstructSpiffeConnectorSource(ctx, cancel, &types.SpiffeConfig{
+		SVIDSources: types.SVIDSources{InMemory: inMemorySVID(t, serverCerts[0])},
+		TrustDomains: []types.TrustDomainConfig{
+			{Name: "example.com", JWTBundle: jwks("own")},
+			{Name: "partner.example", Bundle: partnerBundle, JWTBundleFile: bundleFile},
+		},
+	})
+	require.NoError(t, err)
+
+	bundle, err := source.GetJWTBundleForTrustDomain(spiffeid.RequireTrustDomainFromString("example.com"))
+	require.NoError(t, err)
+	assert.True(t, bundle.HasJWTAuthority("own"))
+
+	bundle, err = source.GetJWTBundleForTrustDomain(partnerTD)
+	require.NoError(t, err)
+	assert.True(t, bundle.HasJWTAuthority("first"))
+
+	_, err = source.GetJWTBundleForTrustDomain(spiffeid.RequireTrustDomainFromString("other.example"))
+	assert.EqualError(t, err, `no JWT bundle for trust domain "other.example"`)
+
+	// the bundle file is reloaded when it changes, which the watcher does every 5s at most
+	require.NoError(t, os.WriteFile(bundleFile, jwks("second"), 0600))
+	assert.Eventually(t, func() bool {
+		bundle, err := source.GetJWTBundleForTrustDomain(partnerTD)
+		return err == nil && bundle.HasJWTAuthority("second")
+	}, 10*time.Second, 100*time.Millisecond)
+}
@@ -2,6 +2,7 @@
 package cryptoutil
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -14,6 +15,51 @@ import (
 	"time"
 )
 
+// GenerateClientCertificate generates a new key and uses the supplied CA to sign a client certificate for it with the
+// given subject. The validity period will not extend beyond that of the CA.
+func GenerateClientCertificate(subject pkix.Name, lifetime time.Duration, caCert *x509.Certificate, caKey crypto.Signer) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// backdate the certificate slightly to allow for clock skew between hosts
+	now := time.Now()
+	notAfter := now.Add(lifetime)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		BasicConstraintsValid: true,
+		PublicKey:             key.Public(),
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  false,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
 // GenerateTestCerts generates a root for the trust domain and uses it to sign an x509 SVID for each supplied SPIFFEID
 func GenerateTestCerts(spiffeids ...string) ([]tls.Certificate, error) {
 	var tlsCerts []tls.Certificate
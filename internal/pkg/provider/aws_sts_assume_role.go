@@ -2,19 +2,28 @@ package provider
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
 )
 
 // AWSSTSAssumeRoleProviderOptions are the options available to configure a AWSSTSAssumeRoleProvider
@@ -36,10 +45,20 @@ type AWSSTSAssumeRoleProviderOptions struct {
 // AWSSTSAssumeRoleProvider is a provider used to get short lived credentials from AWS STS
 type AWSSTSAssumeRoleProvider struct {
 	pingHost   string
+	session    *session.Session
 	stsService *sts.STS
 	duration   int64
 }
 
+// maxChainedRoleDuration is the longest session AWS allows when a role is assumed using credentials from another role
+const maxChainedRoleDuration = int64(60 * 60)
+
+// awsRoleHop is a single role to assume in a chain
+type awsRoleHop struct {
+	roleARN    string
+	externalID string
+}
+
 // NewAWSSTSAssumeRoleProvider will configure a new AWSSTSAssumeRoleProvider using the supplied options
 func NewAWSSTSAssumeRoleProvider(ctx context.Context, options AWSSTSAssumeRoleProviderOptions) (AWSSTSAssumeRoleProvider, error) {
 	// from https://docs.aws.amazon.com/STS/latest/APIReference/welcome.html
@@ -98,6 +117,7 @@ func NewAWSSTSAssumeRoleProvider(ctx context.Context, options AWSSTSAssumeRolePr
 	}
 
 	return AWSSTSAssumeRoleProvider{
+		session:    sess,
 		stsService: sts.New(sess),
 		pingHost:   pingHost,
 		duration:   duration,
@@ -109,6 +129,15 @@ func (p *AWSSTSAssumeRoleProvider) Name() string {
 	return "AWSSTSAssumeRoleProvider"
 }
 
+// FileOutputs describes the shared credentials and config files, which are only written for the credentials_file and
+// config_file outputs
+func (p *AWSSTSAssumeRoleProvider) FileOutputs() []FileOutput {
+	return []FileOutput{
+		{Name: "credentials", Path: "~/.aws/credentials"},
+		{Name: "config", Path: "~/.aws/config"},
+	}
+}
+
 // Ping tests the configured credential providing endpoint is reachable
 // Note: this does not test AWS authn/authz
 func (p *AWSSTSAssumeRoleProvider) Ping() error {
@@ -122,42 +151,344 @@ func (p *AWSSTSAssumeRoleProvider) Ping() error {
 }
 
 // GetCredential will use STS to get a short lived credential for the given objectReference (Role)
-// spiffe-connector must be able to AssumeRole for the supplied role for this to work
+// spiffe-connector must be able to AssumeRole for the supplied role for this to work.
+//
+// The objectReference may also be a whitespace separated chain of roles, each of which is assumed using the credentials
+// of the one before, for example "arn:aws:iam::111111111111:role/Hub arn:aws:iam::222222222222:role/Spoke". IAM does
+// not allow whitespace in role names or paths, unlike commas. An external ID can be given for any role by appending
+// ";external_id=<id>" to it.
 func (p *AWSSTSAssumeRoleProvider) GetCredential(objectReference string) (*proto.Credential, error) {
+	return p.assumeRole(objectReference, awsAssumeRoleOptions{duration: p.duration})
+}
+
+// ValidateOptions accepts a "duration" option, which overrides the session duration for the credential, for example
+// "15m". AWS allows between 15 minutes and the maximum session duration of the role, up to 12 hours.
+func (p *AWSSTSAssumeRoleProvider) ValidateOptions(options map[string]string) error {
+	_, err := p.sessionDuration(options)
+	return err
+}
+
+// sessionDuration returns the duration in seconds from the options, or the default of the provider
+func (p *AWSSTSAssumeRoleProvider) sessionDuration(options map[string]string) (int64, error) {
+	duration := p.duration
+	for key, value := range options {
+		switch key {
+		case "duration":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return 0, fmt.Errorf("duration %q is invalid: %w", value, err)
+			}
+			if d < 15*time.Minute || d > 12*time.Hour {
+				return 0, fmt.Errorf("duration %q must be between 15m and 12h", value)
+			}
+			duration = int64(d.Seconds())
+		default:
+			return 0, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return duration, nil
+}
+
+// PerPrincipal reports whether the session policies of the request are templated, in which case they are rendered
+// differently for each caller
+func (p *AWSSTSAssumeRoleProvider) PerPrincipal(request Request) bool {
+	if request.Credential.AWS == nil {
+		return false
+	}
+	if isTemplate(request.Credential.AWS.SessionPolicy) {
+		return true
+	}
+	for _, arn := range request.Credential.AWS.PolicyARNs {
+		if isTemplate(arn) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCredentialForRequest is GetCredential, with the session policies of the ACL credential applied to the final role
+// so that the issued credentials only have the permissions allowed by both the role and the policies. The credentials
+// are written to the profile and in the output style of the ACL credential. Credentials issued per principal have a
+// session name identifying the caller.
+func (p *AWSSTSAssumeRoleProvider) GetCredentialForRequest(request Request) (*proto.Credential, error) {
+	duration, err := p.sessionDuration(request.Credential.Options)
+	if err != nil {
+		return &proto.Credential{}, err
+	}
+	options := awsAssumeRoleOptions{duration: duration}
+
+	// credentials issued per principal are told apart in CloudTrail by their session name
+	if request.Credential.Issuance == types.IssuancePerPrincipal {
+		if request.Principal.IsZero() {
+			return &proto.Credential{}, errors.New("per-principal credentials can only be issued for a known principal")
+		}
+		options.sessionName = awsSessionName(request.Principal)
+	}
+
+	if request.Credential.AWS == nil {
+		return p.assumeRole(request.ObjectReference, options)
+	}
+	options.output = request.Credential.AWS
+
+	if request.Credential.AWS.SessionPolicy != "" {
+		rendered, err := renderTemplate("session policy", request.Credential.AWS.SessionPolicy, request)
+		if err != nil {
+			return &proto.Credential{}, err
+		}
+		if !json.Valid([]byte(rendered)) {
+			return &proto.Credential{}, errors.New("session policy did not render a JSON document")
+		}
+		options.policy = &rendered
+	}
+
+	for _, arn := range request.Credential.AWS.PolicyARNs {
+		rendered, err := renderTemplate("policy ARN", arn, request)
+		if err != nil {
+			return &proto.Credential{}, err
+		}
+		options.policyARNs = append(options.policyARNs, &sts.PolicyDescriptorType{Arn: aws.String(rendered)})
+	}
+
+	return p.assumeRole(request.ObjectReference, options)
+}
+
+// MergeFiles combines AWS credentials or config files from more than one credential. Each credential writes its own
+// profile, so the files are joined, refusing any profile which appears in both.
+func (p *AWSSTSAssumeRoleProvider) MergeFiles(existing, additional *proto.File) (*proto.File, error) {
+	sections := make(map[string]bool)
+	for _, f := range []*proto.File{existing, additional} {
+		for _, line := range strings.Split(string(f.Contents), "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "[") {
+				continue
+			}
+			if sections[line] {
+				return nil, fmt.Errorf("section %s is written by more than one credential", line)
+			}
+			sections[line] = true
+		}
+	}
+
+	contents := append([]byte{}, existing.Contents...)
+	contents = append(contents, '\n')
+	contents = append(contents, additional.Contents...)
+
+	return &proto.File{
+		Path: existing.Path,
+		// the merged file is only as readable as the most restrictive of the two
+		Mode:     existing.Mode & additional.Mode,
+		Contents: contents,
+	}, nil
+}
+
+// awsAssumeRoleOptions are the settings of a single credential issued by assumeRole
+type awsAssumeRoleOptions struct {
+	// duration is the session duration in seconds
+	duration int64
+	// sessionName defaults to spiffe-connector
+	sessionName string
+	// policy and policyARNs are the session policies applied to the last role in the chain
+	policy     *string
+	policyARNs []*sts.PolicyDescriptorType
+	// output is the profile and output style of the credential
+	output *types.AWSCredential
+}
+
+func (p *AWSSTSAssumeRoleProvider) assumeRole(objectReference string, options awsAssumeRoleOptions) (*proto.Credential, error) {
+	hops, err := parseAWSRoleChain(objectReference)
+	if err != nil {
+		return &proto.Credential{}, err
+	}
+
+	// AWS rejects chained sessions longer than an hour, so the duration is capped rather than failing
+	duration := options.duration
+	if len(hops) > 1 && duration > maxChainedRoleDuration {
+		duration = maxChainedRoleDuration
+	}
+
 	// sessionName is just a label, there can be many sessions with the same name
 	sessionName := "spiffe-connector"
-	input := &sts.AssumeRoleInput{
-		DurationSeconds: &p.duration,
-		RoleSessionName: &sessionName,
-		RoleArn:         aws.String(objectReference),
+	if options.sessionName != "" {
+		sessionName = options.sessionName
 	}
+	stsService := p.stsService
+	var result *sts.AssumeRoleOutput
+	var notAfter time.Time
+	for i, hop := range hops {
+		if i > 0 {
+			stsService = sts.New(p.session, &aws.Config{
+				Credentials: credentials.NewStaticCredentials(
+					*result.Credentials.AccessKeyId,
+					*result.Credentials.SecretAccessKey,
+					*result.Credentials.SessionToken,
+				),
+			})
+		}
 
-	result, err := p.stsService.AssumeRole(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			return &proto.Credential{}, fmt.Errorf("failed to get temporary credentials from STS: %s: %s", aerr.Code(), aerr.Message())
+		input := &sts.AssumeRoleInput{
+			DurationSeconds: &duration,
+			RoleSessionName: &sessionName,
+			RoleArn:         aws.String(hop.roleARN),
+		}
+		if hop.externalID != "" {
+			input.ExternalId = aws.String(hop.externalID)
+		}
+		// session policies only need to restrict the credentials which are handed out
+		if i == len(hops)-1 {
+			input.Policy = options.policy
+			input.PolicyArns = options.policyARNs
+		}
+
+		result, err = stsService.AssumeRole(input)
+		if err != nil {
+			message := "failed to get temporary credentials from STS"
+			if len(hops) > 1 {
+				message = fmt.Sprintf("%s for role %d of %d (%s)", message, i+1, len(hops), hop.roleARN)
+			}
+			if aerr, ok := err.(awserr.Error); ok {
+				return &proto.Credential{}, fmt.Errorf("%s: %s: %s", message, aerr.Code(), aerr.Message())
+			}
+			return &proto.Credential{}, fmt.Errorf("%s: %w", message, err)
+		}
+
+		// the credential is only as good as the shortest lived session used to obtain it
+		if notAfter.IsZero() || result.Credentials.Expiration.Before(notAfter) {
+			notAfter = *result.Credentials.Expiration
 		}
-		return &proto.Credential{}, fmt.Errorf("failed to get temporary credentials from STS: %w", err)
 	}
 
-	credentialsFile := fmt.Sprintf(`[default]
-aws_access_key_id = %s
+	return awsCredential(result.Credentials, notAfter, options.output), nil
+}
+
+// awsSessionName returns a role session name identifying the principal. Session names may only contain letters, digits
+// and +=,.@_- and be at most 64 characters, so long IDs are truncated and suffixed with a hash to keep them distinct.
+func awsSessionName(principal spiffeid.ID) string {
+	name := awsSessionNameInvalidCharacters.ReplaceAllString(principal.TrustDomain().String()+principal.Path(), "-")
+	if len(name) > 64 {
+		sum := sha256.Sum256([]byte(principal.String()))
+		name = name[:55] + "-" + hex.EncodeToString(sum[:4])
+	}
+	return name
+}
+
+// awsSessionNameInvalidCharacters matches runs of characters which cannot be used in a role session name
+var awsSessionNameInvalidCharacters = regexp.MustCompile(`[^\w+=,.@-]+`)
+
+// awsCredential presents the STS credentials in the output style and profile of the ACL credential. Without options,
+// the default profile of ~/.aws/credentials is written.
+func awsCredential(stsCredentials *sts.Credentials, notAfter time.Time, options *types.AWSCredential) *proto.Credential {
+	credential := &proto.Credential{
+		NotAfter: timestamppb.New(notAfter),
+	}
+
+	var region string
+	if options != nil {
+		region = options.Region
+	}
+	keys := fmt.Sprintf(`aws_access_key_id = %s
 aws_secret_access_key = %s
 aws_session_token = %s
 `,
-		*result.Credentials.AccessKeyId,
-		*result.Credentials.SecretAccessKey,
-		*result.Credentials.SessionToken,
+		*stsCredentials.AccessKeyId,
+		*stsCredentials.SecretAccessKey,
+		*stsCredentials.SessionToken,
 	)
 
-	return &proto.Credential{
-		NotAfter: timestamppb.New(*result.Credentials.Expiration),
-		Files: []*proto.File{
+	// the config file prefixes all but the default profile with "profile", the credentials file does not
+	profile := options.ProfileName()
+	configSection := fmt.Sprintf("[profile %s]\n", profile)
+	if profile == "default" {
+		configSection = "[default]\n"
+	}
+
+	switch options.OutputStyle() {
+	case types.AWSOutputEnvVars:
+		credential.EnvVars = map[string]string{
+			"AWS_ACCESS_KEY_ID":     *stsCredentials.AccessKeyId,
+			"AWS_SECRET_ACCESS_KEY": *stsCredentials.SecretAccessKey,
+			"AWS_SESSION_TOKEN":     *stsCredentials.SessionToken,
+		}
+		if region != "" {
+			credential.EnvVars["AWS_REGION"] = region
+			credential.EnvVars["AWS_DEFAULT_REGION"] = region
+		}
+	case types.AWSOutputConfigFile:
+		contents := configSection + keys
+		if region != "" {
+			contents += fmt.Sprintf("region = %s\n", region)
+		}
+		credential.Files = []*proto.File{
+			{
+				Path:     "~/.aws/config",
+				Mode:     0600,
+				Contents: []byte(contents),
+			},
+		}
+	default:
+		credential.Files = []*proto.File{
 			{
 				Path:     "~/.aws/credentials",
 				Mode:     0644,
-				Contents: []byte(credentialsFile),
+				Contents: []byte(fmt.Sprintf("[%s]\n%s", profile, keys)),
 			},
-		},
-	}, nil
+		}
+		if region != "" {
+			credential.Files = append(credential.Files, &proto.File{
+				Path:     "~/.aws/config",
+				Mode:     0644,
+				Contents: []byte(fmt.Sprintf("%sregion = %s\n", configSection, region)),
+			})
+		}
+	}
+
+	return credential
 }
+
+// parseAWSRoleChain parses a whitespace separated chain of role ARNs, each optionally followed by ";external_id=<id>"
+func parseAWSRoleChain(objectReference string) ([]awsRoleHop, error) {
+	parts := strings.Fields(objectReference)
+	if len(parts) == 0 {
+		return nil, errors.New("object reference must be a role ARN")
+	}
+
+	var hops []awsRoleHop
+	for _, part := range parts {
+		// chains used to be comma separated, which is ambiguous as role names may contain commas
+		if strings.Contains(part, ",arn:") {
+			return nil, fmt.Errorf("object reference %q must separate the roles of a chain with whitespace, not commas", objectReference)
+		}
+		fields := strings.Split(part, ";")
+		hop := awsRoleHop{roleARN: fields[0]}
+		if err := validateAWSRoleARN(hop.roleARN); err != nil {
+			return nil, err
+		}
+		for _, field := range fields[1:] {
+			option := strings.SplitN(field, "=", 2)
+			if len(option) != 2 || option[0] != "external_id" || option[1] == "" {
+				return nil, fmt.Errorf("unsupported option %q for role %s", field, hop.roleARN)
+			}
+			hop.externalID = option[1]
+		}
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// validateAWSRoleARN checks that roleARN is the ARN of an IAM role, such as "arn:aws:iam::111111111111:role/Hub"
+func validateAWSRoleARN(roleARN string) error {
+	parsed, err := arn.Parse(roleARN)
+	if err != nil {
+		return fmt.Errorf("role %q is not a valid ARN: %w", roleARN, err)
+	}
+	if parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+		return fmt.Errorf("role %q is not the ARN of an IAM role", roleARN)
+	}
+	name := parsed.Resource[strings.LastIndex(parsed.Resource, "/")+1:]
+	if !awsRoleName.MatchString(name) {
+		return fmt.Errorf("role %q does not have a valid role name", roleARN)
+	}
+	return nil
+}
+
+// awsRoleName matches the characters IAM allows in role names, which include commas
+var awsRoleName = regexp.MustCompile(`^[\w+=,.@-]{1,64}$`)
@@ -6,16 +6,22 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/maxatome/go-testdeep/td"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
 )
 
 func TestAWSSTSAssumeRoleProvider_Name(t *testing.T) {
@@ -164,3 +170,364 @@ aws_session_token = sessiontoken
 		})
 	}
 }
+
+func TestAWSSTSAssumeRoleProvider_GetCredential_RoleChain(t *testing.T) {
+	type assumeRoleCall struct {
+		RoleArn, ExternalId, DurationSeconds, AccessKeyId string
+	}
+
+	var calls []assumeRoleCall
+	// each hop is given a shorter session than the last, so the earliest expiry can be checked
+	expirations := []time.Time{
+		time.Now().UTC().Add(time.Hour).Truncate(time.Second),
+		time.Now().UTC().Add(45 * time.Minute).Truncate(time.Second),
+		time.Now().UTC().Add(30 * time.Minute).Truncate(time.Second),
+	}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		// the signing access key is the second part of the SigV4 Credential, e.g. "Credential=foo/20220101/..."
+		authorization := strings.SplitN(r.Header.Get("Authorization"), "Credential=", 2)
+		require.Len(t, authorization, 2)
+		calls = append(calls, assumeRoleCall{
+			RoleArn:         r.Form.Get("RoleArn"),
+			ExternalId:      r.Form.Get("ExternalId"),
+			DurationSeconds: r.Form.Get("DurationSeconds"),
+			AccessKeyId:     strings.SplitN(authorization[1], "/", 2)[0],
+		})
+
+		if strings.HasSuffix(r.Form.Get("RoleArn"), "Denied") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<ErrorResponse><Error><Code>AccessDenied</Code><Message>not authorized</Message></Error></ErrorResponse>`))
+			return
+		}
+		n := len(calls)
+		w.Write([]byte(fmt.Sprintf(`
+<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>keyid-%d</AccessKeyId>
+      <SecretAccessKey>key-%d</SecretAccessKey>
+      <SessionToken>sessiontoken-%d</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>
+`, n, n, n, expirations[n-1].Format("2006-01-02T15:04:05Z"))))
+	}))
+	defer testServer.Close()
+
+	p, err := NewAWSSTSAssumeRoleProvider(context.Background(), AWSSTSAssumeRoleProviderOptions{
+		Endpoint:            testServer.URL,
+		CredentialsOverride: credentials.NewStaticCredentials("foo", "bar", "baz"),
+		Duration:            4 * 60 * 60,
+	})
+	require.NoError(t, err)
+
+	cred, err := p.GetCredential("arn:aws:iam::111111111111:role/Hub arn:aws:iam::222222222222:role/Spoke;external_id=spoke-secret\narn:aws:iam::333333333333:role/Leaf")
+	require.NoError(t, err)
+
+	assert.Equal(t, []assumeRoleCall{
+		{RoleArn: "arn:aws:iam::111111111111:role/Hub", DurationSeconds: "3600", AccessKeyId: "foo"},
+		{RoleArn: "arn:aws:iam::222222222222:role/Spoke", ExternalId: "spoke-secret", DurationSeconds: "3600", AccessKeyId: "keyid-1"},
+		{RoleArn: "arn:aws:iam::333333333333:role/Leaf", DurationSeconds: "3600", AccessKeyId: "keyid-2"},
+	}, calls)
+	assert.Equal(t, expirations[2], cred.NotAfter.AsTime())
+	require.Len(t, cred.Files, 1)
+	assert.Contains(t, string(cred.Files[0].Contents), "aws_access_key_id = keyid-3\n")
+
+	calls = nil
+	_, err = p.GetCredential("arn:aws:iam::111111111111:role/Hub arn:aws:iam::222222222222:role/Denied")
+	assert.EqualError(t, err, "failed to get temporary credentials from STS for role 2 of 2 (arn:aws:iam::222222222222:role/Denied): AccessDenied: not authorized")
+	assert.Len(t, calls, 2)
+}
+
+func TestParseAWSRoleChain(t *testing.T) {
+	testCases := map[string]struct {
+		objectReference string
+		expectedHops    []awsRoleHop
+		expectedErr     string
+	}{
+		"single role with external ID": {
+			objectReference: "arn:aws:iam::111111111111:role/Hub;external_id=abc",
+			expectedHops:    []awsRoleHop{{roleARN: "arn:aws:iam::111111111111:role/Hub", externalID: "abc"}},
+		},
+		"role names and paths may contain commas": {
+			objectReference: "arn:aws:iam::111111111111:role/team,ops/Hub,Admin  arn:aws:iam::222222222222:role/Spoke",
+			expectedHops: []awsRoleHop{
+				{roleARN: "arn:aws:iam::111111111111:role/team,ops/Hub,Admin"},
+				{roleARN: "arn:aws:iam::222222222222:role/Spoke"},
+			},
+		},
+		"empty": {
+			objectReference: " ",
+			expectedErr:     "object reference must be a role ARN",
+		},
+		"comma separated chain": {
+			objectReference: "arn:aws:iam::111111111111:role/Hub,arn:aws:iam::222222222222:role/Spoke",
+			expectedErr:     `object reference "arn:aws:iam::111111111111:role/Hub,arn:aws:iam::222222222222:role/Spoke" must separate the roles of a chain with whitespace, not commas`,
+		},
+		"not an ARN": {
+			objectReference: "Hub",
+			expectedErr:     `role "Hub" is not a valid ARN: arn: invalid prefix`,
+		},
+		"not a role": {
+			objectReference: "arn:aws:iam::111111111111:user/Hub",
+			expectedErr:     `role "arn:aws:iam::111111111111:user/Hub" is not the ARN of an IAM role`,
+		},
+		"invalid role name": {
+			objectReference: "arn:aws:iam::111111111111:role/Hub*",
+			expectedErr:     `role "arn:aws:iam::111111111111:role/Hub*" does not have a valid role name`,
+		},
+		"unsupported option": {
+			objectReference: "arn:aws:iam::111111111111:role/Hub;session_name=x",
+			expectedErr:     `unsupported option "session_name=x" for role arn:aws:iam::111111111111:role/Hub`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			hops, err := parseAWSRoleChain(tc.objectReference)
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedHops, hops)
+		})
+	}
+}
+
+func TestAWSSTSAssumeRoleProvider_GetCredentialForRequest_SessionPolicy(t *testing.T) {
+	var form url.Values
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.Form
+		w.Write([]byte(fmt.Sprintf(`
+<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>keyid</AccessKeyId>
+      <SecretAccessKey>key</SecretAccessKey>
+      <SessionToken>sessiontoken</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>
+`, time.Now().UTC().Add(time.Hour).Format("2006-01-02T15:04:05Z"))))
+	}))
+	defer testServer.Close()
+
+	p, err := NewAWSSTSAssumeRoleProvider(context.Background(), AWSSTSAssumeRoleProviderOptions{
+		Endpoint:            testServer.URL,
+		CredentialsOverride: credentials.NewStaticCredentials("foo", "bar", "baz"),
+	})
+	require.NoError(t, err)
+
+	request := Request{
+		ObjectReference: "arn:aws:iam::123456789012:role/Shared",
+		Principal:       spiffeid.RequireFromString("spiffe://example.com/ns/team-a/sa/app"),
+		Credential: types.Credential{
+			Provider:        "AWSSTSAssumeRoleProvider",
+			ObjectReference: "arn:aws:iam::123456789012:role/Shared",
+			AWS: &types.AWSCredential{
+				SessionPolicy: `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:*","Resource":"arn:aws:s3:::data/{{ index .PathSegments 1 }}/*"}]}`,
+				PolicyARNs:    []string{"arn:aws:iam::123456789012:policy/{{ index .PathSegments 1 }}-base"},
+			},
+		},
+	}
+	assert.True(t, p.PerPrincipal(request))
+
+	_, err = p.GetCredentialForRequest(request)
+	require.NoError(t, err)
+	assert.Equal(t, `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:*","Resource":"arn:aws:s3:::data/team-a/*"}]}`, form.Get("Policy"))
+	assert.Equal(t, "arn:aws:iam::123456789012:policy/team-a-base", form.Get("PolicyArns.member.1.arn"))
+
+	// without templates the same credential is shared by every caller
+	request.Credential.AWS = &types.AWSCredential{PolicyARNs: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}}
+	assert.False(t, p.PerPrincipal(request))
+	_, err = p.GetCredentialForRequest(request)
+	require.NoError(t, err)
+	assert.Empty(t, form.Get("Policy"))
+	assert.Equal(t, "arn:aws:iam::aws:policy/ReadOnlyAccess", form.Get("PolicyArns.member.1.arn"))
+
+	request.Credential.AWS = &types.AWSCredential{SessionPolicy: `{"Resource": "{{ index .PathSegments 1 }}"`}
+	_, err = p.GetCredentialForRequest(request)
+	assert.EqualError(t, err, "session policy did not render a JSON document")
+}
+
+func TestAWSSTSAssumeRoleProvider_GetCredentialForRequest_Duration(t *testing.T) {
+	var form url.Values
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.Form
+		w.Write([]byte(fmt.Sprintf(`
+<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>keyid</AccessKeyId>
+      <SecretAccessKey>key</SecretAccessKey>
+      <SessionToken>sessiontoken</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>
+`, time.Now().UTC().Add(15*time.Minute).Format("2006-01-02T15:04:05Z"))))
+	}))
+	defer testServer.Close()
+
+	p, err := NewAWSSTSAssumeRoleProvider(context.Background(), AWSSTSAssumeRoleProviderOptions{
+		Endpoint:            testServer.URL,
+		CredentialsOverride: credentials.NewStaticCredentials("foo", "bar", "baz"),
+	})
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		options          map[string]string
+		expectedDuration string
+		expectedError    error
+	}{
+		"default duration": {
+			expectedDuration: "3600",
+		},
+		"duration option": {
+			options:          map[string]string{"duration": "15m"},
+			expectedDuration: "900",
+		},
+		"duration too short": {
+			options:       map[string]string{"duration": "5m"},
+			expectedError: errors.New(`duration "5m" must be between 15m and 12h`),
+		},
+		"unknown option": {
+			options:       map[string]string{"region": "eu-west-1"},
+			expectedError: errors.New(`unknown option "region"`),
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			form = nil
+			err := p.ValidateOptions(testCase.options)
+			_, requestErr := p.GetCredentialForRequest(Request{
+				ObjectReference: "arn:aws:iam::123456789012:role/Shared",
+				Credential:      types.Credential{Options: testCase.options},
+			})
+			if testCase.expectedError != nil {
+				assert.EqualError(t, err, testCase.expectedError.Error())
+				assert.EqualError(t, requestErr, testCase.expectedError.Error())
+				assert.Nil(t, form, "STS should not have been called")
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, requestErr)
+			assert.Equal(t, testCase.expectedDuration, form.Get("DurationSeconds"))
+		})
+	}
+}
+
+func TestAWSSTSAssumeRoleProvider_GetCredentialForRequest_PerPrincipal(t *testing.T) {
+	var form url.Values
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.Form
+		w.Write([]byte(fmt.Sprintf(`
+<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>keyid</AccessKeyId>
+      <SecretAccessKey>key</SecretAccessKey>
+      <SessionToken>sessiontoken</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>
+`, time.Now().UTC().Add(time.Hour).Format("2006-01-02T15:04:05Z"))))
+	}))
+	defer testServer.Close()
+
+	p, err := NewAWSSTSAssumeRoleProvider(context.Background(), AWSSTSAssumeRoleProviderOptions{
+		Endpoint:            testServer.URL,
+		CredentialsOverride: credentials.NewStaticCredentials("foo", "bar", "baz"),
+	})
+	require.NoError(t, err)
+
+	request := Request{
+		ObjectReference: "arn:aws:iam::123456789012:role/Shared",
+		Principal:       spiffeid.RequireFromString("spiffe://example.com/ns/team-a/sa/app"),
+		Credential:      types.Credential{Issuance: types.IssuancePerPrincipal},
+	}
+	assert.True(t, PerPrincipal(&p, request))
+	_, err = p.GetCredentialForRequest(request)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com-ns-team-a-sa-app", form.Get("RoleSessionName"))
+
+	request.Credential.Issuance = types.IssuanceShared
+	assert.False(t, PerPrincipal(&p, request))
+	_, err = p.GetCredentialForRequest(request)
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe-connector", form.Get("RoleSessionName"))
+}
+
+func TestAWSSessionName(t *testing.T) {
+	assert.Equal(t, "example.com-ns-team-a-sa-app", awsSessionName(spiffeid.RequireFromString("spiffe://example.com/ns/team-a/sa/app")))
+	assert.Equal(t, "example.com", awsSessionName(spiffeid.RequireFromString("spiffe://example.com")))
+
+	long := awsSessionName(spiffeid.RequireFromString("spiffe://example.com/ns/a-namespace-with-a-long-name/sa/a-service-account-with-a-long-name"))
+	other := awsSessionName(spiffeid.RequireFromString("spiffe://example.com/ns/a-namespace-with-a-long-name/sa/a-service-account-with-a-long-name-too"))
+	assert.Len(t, long, 64)
+	assert.Equal(t, "example.com-ns-a-namespace-with-a-long-name-sa-a-servic-", long[:56])
+	assert.NotEqual(t, long, other, "truncated names must still be distinct")
+}
+
+func TestAWSCredential(t *testing.T) {
+	stsCredentials := &sts.Credentials{
+		AccessKeyId:     aws.String("keyid"),
+		SecretAccessKey: aws.String("key"),
+		SessionToken:    aws.String("sessiontoken"),
+	}
+	keys := "aws_access_key_id = keyid\naws_secret_access_key = key\naws_session_token = sessiontoken\n"
+
+	testCases := map[string]struct {
+		options         *types.AWSCredential
+		expectedFiles   []*proto.File
+		expectedEnvVars map[string]string
+	}{
+		"no options": {
+			expectedFiles: []*proto.File{
+				{Path: "~/.aws/credentials", Mode: 0644, Contents: []byte("[default]\n" + keys)},
+			},
+		},
+		"named profile with region": {
+			options: &types.AWSCredential{Profile: "staging", Region: "eu-west-1"},
+			expectedFiles: []*proto.File{
+				{Path: "~/.aws/credentials", Mode: 0644, Contents: []byte("[staging]\n" + keys)},
+				{Path: "~/.aws/config", Mode: 0644, Contents: []byte("[profile staging]\nregion = eu-west-1\n")},
+			},
+		},
+		"config file": {
+			options: &types.AWSCredential{Output: types.AWSOutputConfigFile, Region: "eu-west-1"},
+			expectedFiles: []*proto.File{
+				{Path: "~/.aws/config", Mode: 0600, Contents: []byte("[default]\n" + keys + "region = eu-west-1\n")},
+			},
+		},
+		"env vars": {
+			options: &types.AWSCredential{Output: types.AWSOutputEnvVars, Region: "eu-west-1"},
+			expectedEnvVars: map[string]string{
+				"AWS_ACCESS_KEY_ID":     "keyid",
+				"AWS_SECRET_ACCESS_KEY": "key",
+				"AWS_SESSION_TOKEN":     "sessiontoken",
+				"AWS_REGION":            "eu-west-1",
+				"AWS_DEFAULT_REGION":    "eu-west-1",
+			},
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			notAfter := time.Now().Add(time.Hour)
+			cred := awsCredential(stsCredentials, notAfter, testCase.options)
+			assert.Equal(t, testCase.expectedFiles, cred.Files)
+			assert.Equal(t, testCase.expectedEnvVars, cred.EnvVars)
+			assert.True(t, notAfter.Equal(cred.NotAfter.AsTime()))
+		})
+	}
+}
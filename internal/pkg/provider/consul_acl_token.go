@@ -0,0 +1,335 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+// ConsulACLTokenProviderOptions are the options available to configure a ConsulACLTokenProvider
+type ConsulACLTokenProviderOptions struct {
+	// Address is the URL of the Consul HTTP API, defaults to http://127.0.0.1:8500
+	Address string
+
+	// Token is the ACL token used to create and delete tokens, it needs acl:write. If not set the token is loaded from
+	// TokenFile.
+	Token string
+
+	// TokenFile is the path to the ACL token, used when Token is not set
+	TokenFile string
+
+	// TTL is the expiration TTL of created tokens when the object reference does not set one, defaults to 1h
+	TTL time.Duration
+
+	// HTTPClient is used to call Consul, defaults to a client with a 10s timeout
+	HTTPClient *http.Client
+}
+
+// ConsulACLTokenProvider is a provider which creates expiring Consul ACL tokens linked to existing policies and roles
+type ConsulACLTokenProvider struct {
+	address string
+	token   string
+	ttl     time.Duration
+	client  *http.Client
+
+	// tokens holds the last token created for each object reference, and principal when issued per principal, so that
+	// it can be deleted once superseded. pending holds the deletions waiting for clients to stop using superseded
+	// tokens by accessor ID, they are stopped when the context is cancelled.
+	ctx     context.Context
+	mu      *sync.Mutex
+	tokens  map[string]consulIssuedToken
+	pending map[string]*time.Timer
+	grace   time.Duration
+}
+
+// consulSupersededGrace is how long a superseded token is kept after clients are told to renew it, so that they have
+// time to fetch its replacement
+const consulSupersededGrace = time.Minute
+
+// consulIssuedToken is a token created by the provider
+type consulIssuedToken struct {
+	accessorID string
+	secretID   string
+	notAfter   time.Time
+
+	// renewAfter is when clients are told to renew the token, zero until the server has reported it
+	renewAfter time.Time
+}
+
+// consulLink is how the Consul API refers to policies and roles attached to a token
+type consulLink struct {
+	Name string `json:"Name"`
+}
+
+type consulACLTokenRequest struct {
+	Description   string       `json:"Description"`
+	Policies      []consulLink `json:"Policies,omitempty"`
+	Roles         []consulLink `json:"Roles,omitempty"`
+	ExpirationTTL string       `json:"ExpirationTTL"`
+}
+
+type consulACLToken struct {
+	AccessorID     string     `json:"AccessorID"`
+	SecretID       string     `json:"SecretID"`
+	ExpirationTime *time.Time `json:"ExpirationTime"`
+}
+
+// NewConsulACLTokenProvider will configure a new ConsulACLTokenProvider using the supplied options. Superseded tokens are
+// deleted until the context is cancelled.
+func NewConsulACLTokenProvider(ctx context.Context, options ConsulACLTokenProviderOptions) (ConsulACLTokenProvider, error) {
+	address := "http://127.0.0.1:8500"
+	if options.Address != "" {
+		ep, err := url.Parse(options.Address)
+		if err != nil {
+			return ConsulACLTokenProvider{}, fmt.Errorf("failed to parse supplied address: %w", err)
+		}
+		if ep.Scheme != "https" && ep.Scheme != "http" {
+			return ConsulACLTokenProvider{}, fmt.Errorf("supplied address value should have http(s) scheme: %q", options.Address)
+		}
+		if ep.Host == "" {
+			return ConsulACLTokenProvider{}, fmt.Errorf("supplied address value should have host set")
+		}
+		address = strings.TrimSuffix(options.Address, "/")
+	}
+
+	token := options.Token
+	if token == "" {
+		if options.TokenFile == "" {
+			return ConsulACLTokenProvider{}, errors.New("one of token or token file must be set")
+		}
+		contents, err := os.ReadFile(options.TokenFile)
+		if err != nil {
+			return ConsulACLTokenProvider{}, fmt.Errorf("failed to read token file: %w", err)
+		}
+		token = strings.TrimSpace(string(contents))
+	}
+
+	p := ConsulACLTokenProvider{
+		address: address,
+		token:   token,
+		ttl:     time.Hour,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		ctx:     ctx,
+		mu:      &sync.Mutex{},
+		tokens:  make(map[string]consulIssuedToken),
+		pending: make(map[string]*time.Timer),
+		grace:   consulSupersededGrace,
+	}
+	if options.TTL > 0 {
+		p.ttl = options.TTL
+	}
+	if options.HTTPClient != nil {
+		p.client = options.HTTPClient
+	}
+
+	go func() {
+		<-ctx.Done()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for accessorID, t := range p.pending {
+			t.Stop()
+			delete(p.pending, accessorID)
+		}
+	}()
+
+	return p, nil
+}
+
+// Name returns the name of the provider
+func (p *ConsulACLTokenProvider) Name() string {
+	return "ConsulACLTokenProvider"
+}
+
+// Ping checks that the Consul cluster has a leader
+func (p *ConsulACLTokenProvider) Ping() error {
+	if _, err := p.do(http.MethodGet, "/v1/status/leader", nil); err != nil {
+		return fmt.Errorf("provider ping failed: %w", err)
+	}
+	return nil
+}
+
+// GetCredential creates a Consul ACL token. The objectReference is in URL query format and names the policies and roles
+// to link, optionally with a TTL, for example "policy=kv-read&role=catalog&ttl=30m". Any token previously created for
+// the same objectReference is deleted once clients stop using it.
+func (p *ConsulACLTokenProvider) GetCredential(objectReference string) (*proto.Credential, error) {
+	return p.GetCredentialForRequest(Request{ObjectReference: objectReference})
+}
+
+// PerPrincipal reports whether the ACL credential asks for a token for each principal. It decides both the description
+// of the token and which tokens supersede each other.
+func (p *ConsulACLTokenProvider) PerPrincipal(request Request) bool {
+	return request.Credential.Issuance == types.IssuancePerPrincipal
+}
+
+// GetCredentialForRequest is GetCredential, with the principal named in the description of tokens issued per principal
+// so that they can be told apart in Consul
+func (p *ConsulACLTokenProvider) GetCredentialForRequest(request Request) (*proto.Credential, error) {
+	objectReference := request.ObjectReference
+	values, err := url.ParseQuery(objectReference)
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to parse object reference: %w", err)
+	}
+
+	tokenRequest := consulACLTokenRequest{
+		Description: fmt.Sprintf("spiffe-connector: %s", objectReference),
+	}
+	if p.PerPrincipal(request) {
+		if request.Principal.IsZero() {
+			return &proto.Credential{}, errors.New("per-principal credentials can only be issued for a known principal")
+		}
+		tokenRequest.Description = fmt.Sprintf("spiffe-connector: %s for %s", objectReference, request.Principal)
+	}
+	ttl := p.ttl
+	for key, vs := range values {
+		switch key {
+		case "policy":
+			for _, v := range vs {
+				tokenRequest.Policies = append(tokenRequest.Policies, consulLink{Name: v})
+			}
+		case "role":
+			for _, v := range vs {
+				tokenRequest.Roles = append(tokenRequest.Roles, consulLink{Name: v})
+			}
+		case "ttl":
+			ttl, err = time.ParseDuration(vs[0])
+			if err != nil || ttl <= 0 {
+				return &proto.Credential{}, fmt.Errorf("invalid ttl %q in object reference", vs[0])
+			}
+		default:
+			return &proto.Credential{}, fmt.Errorf("unsupported key %q in object reference", key)
+		}
+	}
+	if len(tokenRequest.Policies) == 0 && len(tokenRequest.Roles) == 0 {
+		return &proto.Credential{}, errors.New("object reference must contain a policy or role")
+	}
+	tokenRequest.ExpirationTTL = ttl.String()
+
+	body, err := json.Marshal(tokenRequest)
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to marshal token request: %w", err)
+	}
+	requested := time.Now()
+	response, err := p.do(http.MethodPut, "/v1/acl/token", body)
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to create token: %w", err)
+	}
+	var token consulACLToken
+	if err := json.Unmarshal(response, &token); err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to decode created token: %w", err)
+	}
+	if token.SecretID == "" {
+		return &proto.Credential{}, errors.New("created token has no secret ID")
+	}
+
+	notAfter := requested.Add(ttl)
+	if token.ExpirationTime != nil {
+		notAfter = *token.ExpirationTime
+	}
+
+	p.supersede(p.supersedeKey(request), consulIssuedToken{accessorID: token.AccessorID, secretID: token.SecretID, notAfter: notAfter})
+
+	return &proto.Credential{
+		NotAfter: timestamppb.New(notAfter),
+		EnvVars: map[string]string{
+			"CONSUL_HTTP_TOKEN": token.SecretID,
+		},
+		Token: &token.SecretID,
+	}, nil
+}
+
+// Issued records when clients are told to renew a token, after which it is no longer in use once superseded
+func (p *ConsulACLTokenProvider) Issued(request Request, credential *proto.Credential) {
+	if credential.Token == nil || credential.RenewAfter == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := p.supersedeKey(request)
+	if token, ok := p.tokens[key]; ok && token.secretID == *credential.Token {
+		token.renewAfter = credential.RenewAfter.AsTime()
+		p.tokens[key] = token
+	}
+}
+
+// supersedeKey returns the key of the tokens which supersede each other, tokens issued per principal only supersede
+// those of the same principal
+func (p *ConsulACLTokenProvider) supersedeKey(request Request) string {
+	if p.PerPrincipal(request) {
+		return fmt.Sprintf("%s/%s", request.ObjectReference, request.Principal)
+	}
+	return request.ObjectReference
+}
+
+// supersede records token as the current token for key and schedules the deletion of the token it replaces. Clients
+// holding the previous token fetch its replacement when told to renew it, so it is deleted shortly after that. If the
+// server never reported when that is, the token is kept until it expires.
+func (p *ConsulACLTokenProvider) supersede(key string, token consulIssuedToken) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	previous, ok := p.tokens[key]
+	p.tokens[key] = token
+	if !ok || p.ctx.Err() != nil {
+		return
+	}
+
+	deleteAt := previous.notAfter
+	if !previous.renewAfter.IsZero() {
+		deleteAt = previous.renewAfter.Add(p.grace)
+	}
+	p.pending[previous.accessorID] = time.AfterFunc(time.Until(deleteAt), func() {
+		p.deleteToken(previous.accessorID)
+	})
+}
+
+// deleteToken deletes a superseded token. Failing to delete is not fatal, as the token will still expire.
+func (p *ConsulACLTokenProvider) deleteToken(accessorID string) {
+	p.mu.Lock()
+	delete(p.pending, accessorID)
+	p.mu.Unlock()
+
+	if _, err := p.do(http.MethodDelete, "/v1/acl/token/"+url.PathEscape(accessorID), nil); err != nil {
+		log.Printf("error while deleting superseded consul token %s (%s)", accessorID, err.Error())
+	}
+}
+
+// do calls the Consul API with the provider's token and returns the response body
+func (p *ConsulACLTokenProvider) do(method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, p.address+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Consul-Token", p.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	response, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(response))
+	}
+	return response, nil
+}
@@ -0,0 +1,279 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+// fakeConsul implements the parts of the Consul ACL API used by the ConsulACLTokenProvider
+type fakeConsul struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	created  []consulACLTokenRequest
+	tokens   map[string]bool
+	deleted  []string
+	failWith int
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("X-Consul-Token") != "management" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("ACL not found"))
+		return
+	}
+	if f.failWith != 0 {
+		w.WriteHeader(f.failWith)
+		w.Write([]byte("Permission denied\n"))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/status/leader":
+		w.Write([]byte(`"10.0.0.1:8300"`))
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/acl/token":
+		var req consulACLTokenRequest
+		require.NoError(f.t, json.NewDecoder(r.Body).Decode(&req))
+		ttl, err := time.ParseDuration(req.ExpirationTTL)
+		require.NoError(f.t, err)
+
+		f.created = append(f.created, req)
+		n := len(f.created)
+		accessorID := fmt.Sprintf("accessor-%d", n)
+		f.tokens[accessorID] = true
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"AccessorID":     accessorID,
+			"SecretID":       fmt.Sprintf("secret-%d", n),
+			"Policies":       req.Policies,
+			"Roles":          req.Roles,
+			"ExpirationTime": time.Now().Add(ttl).UTC().Truncate(time.Second),
+		})
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1/acl/token/"):
+		accessorID := strings.TrimPrefix(r.URL.Path, "/v1/acl/token/")
+		delete(f.tokens, accessorID)
+		f.deleted = append(f.deleted, accessorID)
+		w.Write([]byte("true"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestConsulACLTokenProvider_Ping(t *testing.T) {
+	testServer := httptest.NewServer(&fakeConsul{t: t, tokens: map[string]bool{}})
+
+	p, err := NewConsulACLTokenProvider(context.Background(), ConsulACLTokenProviderOptions{Address: testServer.URL, Token: "management"})
+	require.NoError(t, err)
+	assert.Equal(t, "ConsulACLTokenProvider", p.Name())
+	assert.NoError(t, p.Ping())
+
+	testServer.Close()
+	assert.ErrorContains(t, p.Ping(), "provider ping failed")
+}
+
+func TestConsulACLTokenProvider_GetCredential(t *testing.T) {
+	testCases := map[string]struct {
+		objectReference  string
+		principal        string
+		issuance         string
+		failWith         int
+		expectedRequest  consulACLTokenRequest
+		expectedLifetime time.Duration
+		expectedError    error
+	}{
+		"policies": {
+			objectReference: "policy=kv-read&policy=catalog-read",
+			expectedRequest: consulACLTokenRequest{
+				Description:   "spiffe-connector: policy=kv-read&policy=catalog-read",
+				Policies:      []consulLink{{Name: "kv-read"}, {Name: "catalog-read"}},
+				ExpirationTTL: "1h0m0s",
+			},
+			expectedLifetime: time.Hour,
+		},
+		"role with ttl": {
+			objectReference: "role=payments&ttl=30m",
+			expectedRequest: consulACLTokenRequest{
+				Description:   "spiffe-connector: role=payments&ttl=30m",
+				Roles:         []consulLink{{Name: "payments"}},
+				ExpirationTTL: "30m0s",
+			},
+			expectedLifetime: 30 * time.Minute,
+		},
+		"per-principal": {
+			objectReference: "policy=kv-read",
+			principal:       "spiffe://example.com/ns/team-a/sa/app",
+			issuance:        types.IssuancePerPrincipal,
+			expectedRequest: consulACLTokenRequest{
+				Description:   "spiffe-connector: policy=kv-read for spiffe://example.com/ns/team-a/sa/app",
+				Policies:      []consulLink{{Name: "kv-read"}},
+				ExpirationTTL: "1h0m0s",
+			},
+			expectedLifetime: time.Hour,
+		},
+		"per-principal without a principal": {
+			objectReference: "policy=kv-read",
+			issuance:        types.IssuancePerPrincipal,
+			expectedError:   errors.New("per-principal credentials can only be issued for a known principal"),
+		},
+		"no policy or role": {
+			objectReference: "ttl=30m",
+			expectedError:   errors.New("object reference must contain a policy or role"),
+		},
+		"unsupported key": {
+			objectReference: "policy=kv-read&namespace=team-a",
+			expectedError:   errors.New(`unsupported key "namespace" in object reference`),
+		},
+		"invalid ttl": {
+			objectReference: "policy=kv-read&ttl=soon",
+			expectedError:   errors.New(`invalid ttl "soon" in object reference`),
+		},
+		"consul refuses": {
+			objectReference: "policy=kv-read",
+			failWith:        http.StatusForbidden,
+			expectedError:   errors.New("failed to create token: unexpected status 403: Permission denied"),
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			consul := &fakeConsul{t: t, tokens: map[string]bool{}, failWith: testCase.failWith}
+			testServer := httptest.NewServer(consul)
+			defer testServer.Close()
+
+			p, err := NewConsulACLTokenProvider(context.Background(), ConsulACLTokenProviderOptions{Address: testServer.URL, Token: "management"})
+			require.NoError(t, err)
+
+			request := Request{
+				ObjectReference: testCase.objectReference,
+				Credential:      types.Credential{Issuance: testCase.issuance},
+			}
+			if testCase.principal != "" {
+				request.Principal = spiffeid.RequireFromString(testCase.principal)
+			}
+			assert.Equal(t, testCase.issuance == types.IssuancePerPrincipal, p.PerPrincipal(request))
+			cred, err := p.GetCredentialForRequest(request)
+			if testCase.expectedError != nil {
+				assert.EqualError(t, err, testCase.expectedError.Error())
+				return
+			}
+			require.NoError(t, err)
+
+			require.Len(t, consul.created, 1)
+			assert.Equal(t, testCase.expectedRequest, consul.created[0])
+
+			require.NotNil(t, cred.Token)
+			assert.Equal(t, "secret-1", *cred.Token)
+			assert.Equal(t, map[string]string{"CONSUL_HTTP_TOKEN": "secret-1"}, cred.EnvVars)
+			assert.WithinDuration(t, time.Now().Add(testCase.expectedLifetime), cred.NotAfter.AsTime(), 5*time.Second)
+		})
+	}
+}
+
+func TestConsulACLTokenProvider_Supersede(t *testing.T) {
+	consul := &fakeConsul{t: t, tokens: map[string]bool{}}
+	testServer := httptest.NewServer(consul)
+	defer testServer.Close()
+
+	p, err := NewConsulACLTokenProvider(context.Background(), ConsulACLTokenProviderOptions{Address: testServer.URL, Token: "management"})
+	require.NoError(t, err)
+	p.grace = 10 * time.Millisecond
+	// issue gets a token as the server does, telling the provider when clients are told to renew it
+	issue := func(request Request) *proto.Credential {
+		cred, err := p.GetCredentialForRequest(request)
+		require.NoError(t, err)
+		cred.RenewAfter = timestamppb.New(time.Now().Add(500 * time.Millisecond))
+		p.Issued(request, cred)
+		return cred
+	}
+	shared := Request{ObjectReference: "policy=kv-read"}
+	perPrincipal := func(principal string) Request {
+		return Request{
+			ObjectReference: "policy=kv-read",
+			Principal:       spiffeid.RequireFromString(principal),
+			Credential:      types.Credential{Issuance: types.IssuancePerPrincipal},
+		}
+	}
+	deleted := func() []string {
+		consul.mu.Lock()
+		defer consul.mu.Unlock()
+		return append([]string{}, consul.deleted...)
+	}
+
+	issue(shared)
+	issue(Request{ObjectReference: "role=payments"})
+	issue(perPrincipal("spiffe://example.com/a"))
+	issue(perPrincipal("spiffe://example.com/b"))
+	assert.Empty(t, deleted(), "tokens for different object references or principals are not superseded")
+
+	assert.Equal(t, "secret-5", *issue(shared).Token)
+	assert.Equal(t, "secret-6", *issue(perPrincipal("spiffe://example.com/a")).Token)
+
+	// superseded tokens may still be held by clients until they are told to renew, then are deleted long before they
+	// expire
+	assert.Empty(t, deleted(), "superseded tokens are deleted before clients renew them")
+	assert.Eventually(t, func() bool {
+		d := deleted()
+		sort.Strings(d)
+		return assert.ObjectsAreEqual([]string{"accessor-1", "accessor-3"}, d)
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestConsulACLTokenProvider_Supersede_Stopped(t *testing.T) {
+	consul := &fakeConsul{t: t, tokens: map[string]bool{}}
+	testServer := httptest.NewServer(consul)
+	defer testServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := NewConsulACLTokenProvider(ctx, ConsulACLTokenProviderOptions{Address: testServer.URL, Token: "management"})
+	require.NoError(t, err)
+	pending := func() int {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.pending)
+	}
+
+	_, err = p.GetCredential("policy=kv-read")
+	require.NoError(t, err)
+	_, err = p.GetCredential("policy=kv-read")
+	require.NoError(t, err)
+	assert.Equal(t, 1, pending(), "deletion of the superseded token is scheduled")
+
+	// pending deletions are stopped with the provider
+	cancel()
+	assert.Eventually(t, func() bool { return pending() == 0 }, 5*time.Second, 10*time.Millisecond)
+	consul.mu.Lock()
+	defer consul.mu.Unlock()
+	assert.Empty(t, consul.deleted)
+}
+
+func TestNewConsulACLTokenProvider(t *testing.T) {
+	_, err := NewConsulACLTokenProvider(context.Background(), ConsulACLTokenProviderOptions{})
+	assert.EqualError(t, err, "one of token or token file must be set")
+
+	_, err = NewConsulACLTokenProvider(context.Background(), ConsulACLTokenProviderOptions{Address: "consul:8500", Token: "management"})
+	assert.ErrorContains(t, err, "supplied address value should have http(s) scheme")
+
+	p, err := NewConsulACLTokenProvider(context.Background(), ConsulACLTokenProviderOptions{Token: "management"})
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:8500", p.address)
+}
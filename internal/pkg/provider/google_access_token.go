@@ -0,0 +1,371 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/google/downscope"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+// GoogleAccessTokenProviderOptions are the options available to configure a GoogleAccessTokenProvider
+type GoogleAccessTokenProviderOptions struct {
+	// Endpoint is passed to the IAM credentials client as withEndpoint but also used for the ping hostname
+	Endpoint string
+
+	// STSEndpoint is the token exchange endpoint used to apply Credential Access Boundaries, defaults to
+	// https://sts.googleapis.com/v1/token
+	STSEndpoint string
+
+	// Lifetime is how long access tokens are valid for, defaults to 1h. Longer lifetimes must be allowed by the
+	// organisation policy constraints/iam.allowServiceAccountCredentialLifetimeExtension.
+	Lifetime time.Duration
+
+	// Scopes are the OAuth scopes of access tokens, defaults to https://www.googleapis.com/auth/cloud-platform
+	Scopes []string
+
+	// ClientOptions are GCP service client options which are used to initialize the nested IAM credentials client
+	ClientOptions []option.ClientOption
+
+	// CredentialsOverride will configure the Google Cloud SDK with explicit credentials if set
+	CredentialsOverride *google.Credentials
+
+	// HTTPClient is used for the token exchange, defaults to a client with a 10s timeout
+	HTTPClient *http.Client
+}
+
+// GoogleAccessTokenProvider is a provider which issues short lived OAuth access tokens for service accounts,
+// optionally down-scoped with a Credential Access Boundary from the ACL
+type GoogleAccessTokenProvider struct {
+	iamCredentialsService *iamcredentials.Service
+	pingHost              string
+	stsEndpoint           string
+	lifetime              time.Duration
+	scopes                []string
+	client                *http.Client
+}
+
+// googleTokenExchangeResponse is the response from the STS token exchange, see
+// https://cloud.google.com/iam/docs/reference/sts/rest/v1/TopLevel/token
+type googleTokenExchangeResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// NewGoogleAccessTokenProvider will configure a new GoogleAccessTokenProvider using the supplied options
+func NewGoogleAccessTokenProvider(ctx context.Context, options GoogleAccessTokenProviderOptions) (GoogleAccessTokenProvider, error) {
+	pingHost := "iamcredentials.googleapis.com:https"
+
+	if options.Endpoint != "" {
+		ep, err := url.Parse(options.Endpoint)
+		if err != nil {
+			return GoogleAccessTokenProvider{}, fmt.Errorf("failed to parse supplied endpoint: %w", err)
+		}
+		if ep.Scheme != "https" && ep.Scheme != "http" {
+			return GoogleAccessTokenProvider{}, fmt.Errorf("supplied endpoint value should have http(s) scheme: %q", options.Endpoint)
+		}
+		if ep.Host == "" {
+			return GoogleAccessTokenProvider{}, fmt.Errorf("supplied endpoint value should have host set")
+		}
+
+		pingHost = ep.Host
+		if ep.Port() == "" {
+			pingHost = fmt.Sprintf("%s:%s", ep.Host, ep.Scheme)
+		}
+
+		options.ClientOptions = append(options.ClientOptions, option.WithEndpoint(options.Endpoint))
+	}
+
+	if options.CredentialsOverride != nil {
+		options.ClientOptions = append(options.ClientOptions, option.WithCredentials(options.CredentialsOverride))
+	}
+
+	service, err := iamcredentials.NewService(ctx, options.ClientOptions...)
+	if err != nil {
+		return GoogleAccessTokenProvider{}, fmt.Errorf("failed to create IAM credentials service: %w", err)
+	}
+
+	p := GoogleAccessTokenProvider{
+		iamCredentialsService: service,
+		pingHost:              pingHost,
+		stsEndpoint:           "https://sts.googleapis.com/v1/token",
+		lifetime:              time.Hour,
+		scopes:                []string{"https://www.googleapis.com/auth/cloud-platform"},
+		client:                &http.Client{Timeout: 10 * time.Second},
+	}
+	if options.STSEndpoint != "" {
+		p.stsEndpoint = options.STSEndpoint
+	}
+	if options.Lifetime > 0 {
+		p.lifetime = options.Lifetime
+	}
+	if len(options.Scopes) > 0 {
+		p.scopes = options.Scopes
+	}
+	if options.HTTPClient != nil {
+		p.client = options.HTTPClient
+	}
+
+	return p, nil
+}
+
+// Name returns the name of the provider
+func (p *GoogleAccessTokenProvider) Name() string {
+	return "GoogleAccessTokenProvider"
+}
+
+// Ping tests the IAM credentials endpoint is reachable
+// Note: this does not test GCP authn/authz
+func (p *GoogleAccessTokenProvider) Ping() error {
+	_, err := net.DialTimeout("tcp", p.pingHost, time.Second*3)
+
+	if err != nil {
+		return fmt.Errorf("provider ping failed: %w", err)
+	}
+
+	return nil
+}
+
+// GetCredential issues an access token for the service account email in objectReference, with the full permissions of
+// the service account
+func (p *GoogleAccessTokenProvider) GetCredential(objectReference string) (*proto.Credential, error) {
+	token, notAfter, err := p.generateAccessToken(objectReference, p.lifetime, p.scopes)
+	if err != nil {
+		return &proto.Credential{}, err
+	}
+	return accessTokenCredential(token, notAfter), nil
+}
+
+// PerPrincipal reports whether the access boundary of the request is templated, in which case it is rendered
+// differently for each caller
+func (p *GoogleAccessTokenProvider) PerPrincipal(request Request) bool {
+	if request.Credential.Google == nil {
+		return false
+	}
+	for _, rule := range request.Credential.Google.AccessBoundary {
+		if isTemplate(rule.AvailableResource) {
+			return true
+		}
+		for _, permission := range rule.AvailablePermissions {
+			if isTemplate(permission) {
+				return true
+			}
+		}
+		if rule.Condition != nil && (isTemplate(rule.Condition.Expression) || isTemplate(rule.Condition.Title) || isTemplate(rule.Condition.Description)) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCredentialForRequest is GetCredential, with the access boundary of the ACL credential applied by exchanging the
+// service account token for a down-scoped one. Only the down-scoped token is returned.
+func (p *GoogleAccessTokenProvider) GetCredentialForRequest(request Request) (*proto.Credential, error) {
+	lifetime, scopes, err := p.tokenOptions(request.Credential.Options)
+	if err != nil {
+		return &proto.Credential{}, err
+	}
+
+	if request.Credential.Google == nil || len(request.Credential.Google.AccessBoundary) == 0 {
+		token, notAfter, err := p.generateAccessToken(request.ObjectReference, lifetime, scopes)
+		if err != nil {
+			return &proto.Credential{}, err
+		}
+		return accessTokenCredential(token, notAfter), nil
+	}
+
+	rules, err := renderAccessBoundary(request.Credential.Google.AccessBoundary, request)
+	if err != nil {
+		return &proto.Credential{}, err
+	}
+
+	token, notAfter, err := p.generateAccessToken(request.ObjectReference, lifetime, scopes)
+	if err != nil {
+		return &proto.Credential{}, err
+	}
+
+	downscopedToken, expiresIn, err := p.exchangeToken(token, rules)
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to apply access boundary: %w", err)
+	}
+	// the down-scoped token cannot outlive the token it was exchanged for
+	if expiresIn > 0 {
+		if expiry := time.Now().Add(expiresIn); expiry.Before(notAfter) {
+			notAfter = expiry
+		}
+	}
+
+	return accessTokenCredential(downscopedToken, notAfter), nil
+}
+
+// ValidateOptions accepts a "lifetime" option, which overrides the lifetime of the access token, for example "15m", and
+// a "scopes" option, which is a comma separated list of OAuth scopes
+func (p *GoogleAccessTokenProvider) ValidateOptions(options map[string]string) error {
+	_, _, err := p.tokenOptions(options)
+	return err
+}
+
+// tokenOptions returns the lifetime and scopes from the options, or the defaults of the provider
+func (p *GoogleAccessTokenProvider) tokenOptions(options map[string]string) (time.Duration, []string, error) {
+	lifetime, scopes := p.lifetime, p.scopes
+	for key, value := range options {
+		switch key {
+		case "lifetime":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return 0, nil, fmt.Errorf("lifetime %q is invalid: %w", value, err)
+			}
+			// the IAM credentials API accepts lifetimes in whole seconds, up to 12h if the organisation allows it
+			if d < time.Second || d > 12*time.Hour {
+				return 0, nil, fmt.Errorf("lifetime %q must be between 1s and 12h", value)
+			}
+			lifetime = d
+		case "scopes":
+			scopes = nil
+			for _, scope := range strings.Split(value, ",") {
+				if scope = strings.TrimSpace(scope); scope != "" {
+					scopes = append(scopes, scope)
+				}
+			}
+			if len(scopes) == 0 {
+				return 0, nil, errors.New("scopes must contain at least one scope")
+			}
+		default:
+			return 0, nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return lifetime, scopes, nil
+}
+
+func (p *GoogleAccessTokenProvider) generateAccessToken(serviceAccount string, lifetime time.Duration, scopes []string) (string, time.Time, error) {
+	if serviceAccount == "" {
+		return "", time.Time{}, errors.New("object reference must be a service account email")
+	}
+
+	// - for the project will infer it from the service account
+	name := "projects/-/serviceAccounts/" + serviceAccount
+	response, err := p.iamCredentialsService.Projects.ServiceAccounts.GenerateAccessToken(name, &iamcredentials.GenerateAccessTokenRequest{
+		Lifetime: fmt.Sprintf("%ds", int64(lifetime.Seconds())),
+		Scope:    scopes,
+	}).Do()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate access token: %w", err)
+	}
+
+	notAfter, err := time.Parse(time.RFC3339, response.ExpireTime)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to parse access token expire time: %w", err)
+	}
+
+	return response.AccessToken, notAfter, nil
+}
+
+// exchangeToken exchanges token for one limited by the access boundary rules, using the same request as the
+// golang.org/x/oauth2/google/downscope package but against the configured endpoint
+func (p *GoogleAccessTokenProvider) exchangeToken(token string, rules []downscope.AccessBoundaryRule) (string, time.Duration, error) {
+	options, err := json.Marshal(map[string]interface{}{
+		"accessBoundary": map[string]interface{}{
+			"accessBoundaryRules": rules,
+		},
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to marshal access boundary: %w", err)
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	form.Set("subject_token_type", "urn:ietf:params:oauth:token-type:access_token")
+	form.Set("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
+	form.Set("subject_token", token)
+	form.Set("options", string(options))
+
+	resp, err := p.client.PostForm(p.stsEndpoint, form)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+
+	var response googleTokenExchangeResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if response.AccessToken == "" {
+		return "", 0, errors.New("response contained no access token")
+	}
+
+	return response.AccessToken, time.Duration(response.ExpiresIn) * time.Second, nil
+}
+
+// renderAccessBoundary renders any templates in the rules using details of the caller
+func renderAccessBoundary(rules []types.GoogleAccessBoundaryRule, request Request) ([]downscope.AccessBoundaryRule, error) {
+	var rendered []downscope.AccessBoundaryRule
+	for _, rule := range rules {
+		resource, err := renderTemplate("access boundary resource", rule.AvailableResource, request)
+		if err != nil {
+			return nil, err
+		}
+		renderedRule := downscope.AccessBoundaryRule{AvailableResource: resource}
+
+		for _, permission := range rule.AvailablePermissions {
+			renderedPermission, err := renderTemplate("access boundary permission", permission, request)
+			if err != nil {
+				return nil, err
+			}
+			renderedRule.AvailablePermissions = append(renderedRule.AvailablePermissions, renderedPermission)
+		}
+
+		if rule.Condition != nil {
+			renderedRule.Condition = &downscope.AvailabilityCondition{}
+			for _, field := range []struct {
+				text   string
+				target *string
+			}{
+				{rule.Condition.Expression, &renderedRule.Condition.Expression},
+				{rule.Condition.Title, &renderedRule.Condition.Title},
+				{rule.Condition.Description, &renderedRule.Condition.Description},
+			} {
+				*field.target, err = renderTemplate("access boundary condition", field.text, request)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		rendered = append(rendered, renderedRule)
+	}
+	return rendered, nil
+}
+
+// accessTokenCredential returns the token in the environment variables read by gcloud and the Terraform provider
+func accessTokenCredential(token string, notAfter time.Time) *proto.Credential {
+	return &proto.Credential{
+		NotAfter: timestamppb.New(notAfter),
+		EnvVars: map[string]string{
+			"CLOUDSDK_AUTH_ACCESS_TOKEN": token,
+			"GOOGLE_OAUTH_ACCESS_TOKEN":  token,
+		},
+		Token: &token,
+	}
+}
@@ -0,0 +1,188 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2/google"
+
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+func TestGoogleAccessTokenProvider_GetCredentialForRequest(t *testing.T) {
+	expireTime := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	boundary := &types.GoogleCredential{
+		AccessBoundary: []types.GoogleAccessBoundaryRule{
+			{
+				AvailableResource:    "//storage.googleapis.com/projects/_/buckets/data",
+				AvailablePermissions: []string{"inRole:roles/storage.objectViewer"},
+				Condition: &types.GoogleAvailabilityCondition{
+					Expression: `resource.name.startsWith("projects/_/buckets/data/objects/{{ index .PathSegments 1 }}/")`,
+					Title:      "{{ index .PathSegments 1 }} prefix",
+				},
+			},
+		},
+	}
+
+	renderedBoundary := `{"accessBoundary":{"accessBoundaryRules":[{"availableResource":"//storage.googleapis.com/projects/_/buckets/data","availablePermissions":["inRole:roles/storage.objectViewer"],"availabilityCondition":{"expression":"resource.name.startsWith(\"projects/_/buckets/data/objects/team-a/\")","title":"team-a prefix"}}]}}`
+
+	testCases := map[string]struct {
+		credential            types.Credential
+		objectReference       string
+		stsStatus             int
+		expectedToken         string
+		expectedOptions       string
+		expectedPerPrincipal  bool
+		expectedError         error
+		expectedExchangeCount int
+		expectedLifetime      string
+		expectedScopes        []interface{}
+	}{
+		"without an access boundary": {
+			objectReference: "reader@project.iam.gserviceaccount.com",
+			expectedToken:   "service-account-token",
+		},
+		"with a templated access boundary": {
+			objectReference:       "reader@project.iam.gserviceaccount.com",
+			credential:            types.Credential{Google: boundary},
+			expectedToken:         "downscoped-token",
+			expectedOptions:       renderedBoundary,
+			expectedPerPrincipal:  true,
+			expectedExchangeCount: 1,
+		},
+		"when the exchange is refused": {
+			objectReference:       "reader@project.iam.gserviceaccount.com",
+			credential:            types.Credential{Google: boundary},
+			stsStatus:             http.StatusBadRequest,
+			expectedOptions:       renderedBoundary,
+			expectedPerPrincipal:  true,
+			expectedError:         errors.New(`failed to apply access boundary: unexpected status 400: {"error": "invalid_request"}`),
+			expectedExchangeCount: 1,
+		},
+		"with lifetime and scopes options": {
+			objectReference: "reader@project.iam.gserviceaccount.com",
+			credential: types.Credential{Options: map[string]string{
+				"lifetime": "15m",
+				"scopes":   "https://www.googleapis.com/auth/devstorage.read_only, https://www.googleapis.com/auth/bigquery.readonly",
+			}},
+			expectedToken:    "service-account-token",
+			expectedLifetime: "900s",
+			expectedScopes:   []interface{}{"https://www.googleapis.com/auth/devstorage.read_only", "https://www.googleapis.com/auth/bigquery.readonly"},
+		},
+		"with an unknown option": {
+			objectReference: "reader@project.iam.gserviceaccount.com",
+			credential:      types.Credential{Options: map[string]string{"audience": "orders-api"}},
+			expectedError:   errors.New(`unknown option "audience"`),
+		},
+		"without a service account": {
+			credential:           types.Credential{Google: boundary},
+			expectedPerPrincipal: true,
+			expectedError:        errors.New("object reference must be a service account email"),
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			var exchangeCount int
+			testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case strings.HasSuffix(r.URL.Path, ":generateAccessToken"):
+					assert.Equal(t, "/v1/projects/-/serviceAccounts/"+testCase.objectReference+":generateAccessToken", r.URL.Path)
+					var request map[string]interface{}
+					require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+					expectedLifetime, expectedScopes := testCase.expectedLifetime, testCase.expectedScopes
+					if expectedLifetime == "" {
+						expectedLifetime = "1800s"
+					}
+					if expectedScopes == nil {
+						expectedScopes = []interface{}{"https://www.googleapis.com/auth/cloud-platform"}
+					}
+					assert.Equal(t, expectedLifetime, request["lifetime"])
+					assert.Equal(t, expectedScopes, request["scope"])
+					fmt.Fprintf(w, `{"accessToken": "service-account-token", "expireTime": %q}`, expireTime.Format(time.RFC3339))
+				case r.URL.Path == "/v1/token":
+					exchangeCount++
+					require.NoError(t, r.ParseForm())
+					assert.Equal(t, "urn:ietf:params:oauth:grant-type:token-exchange", r.Form.Get("grant_type"))
+					assert.Equal(t, "service-account-token", r.Form.Get("subject_token"))
+					assert.JSONEq(t, testCase.expectedOptions, r.Form.Get("options"))
+					if testCase.stsStatus != 0 {
+						w.WriteHeader(testCase.stsStatus)
+						w.Write([]byte(`{"error": "invalid_request"}`))
+						return
+					}
+					w.Write([]byte(`{"access_token": "downscoped-token", "issued_token_type": "urn:ietf:params:oauth:token-type:access_token", "token_type": "Bearer"}`))
+				default:
+					t.Fatalf("unexpected request to %s", r.URL.Path)
+				}
+			}))
+			defer testServer.Close()
+
+			p, err := NewGoogleAccessTokenProvider(context.Background(), GoogleAccessTokenProviderOptions{
+				Endpoint:    testServer.URL,
+				STSEndpoint: testServer.URL + "/v1/token",
+				Lifetime:    30 * time.Minute,
+				CredentialsOverride: &google.Credentials{
+					ProjectID:   "test",
+					TokenSource: testToken{},
+					JSON:        []byte(`{}`),
+				},
+			})
+			require.NoError(t, err)
+
+			request := Request{
+				ObjectReference: testCase.objectReference,
+				Principal:       spiffeid.RequireFromString("spiffe://example.com/ns/team-a/sa/app"),
+				Credential:      testCase.credential,
+			}
+			assert.Equal(t, testCase.expectedPerPrincipal, p.PerPrincipal(request))
+
+			cred, err := p.GetCredentialForRequest(request)
+			assert.Equal(t, testCase.expectedExchangeCount, exchangeCount)
+			if testCase.expectedError != nil {
+				assert.EqualError(t, err, testCase.expectedError.Error())
+				return
+			}
+			require.NoError(t, err)
+
+			require.NotNil(t, cred.Token)
+			assert.Equal(t, testCase.expectedToken, *cred.Token)
+			assert.Equal(t, map[string]string{
+				"CLOUDSDK_AUTH_ACCESS_TOKEN": testCase.expectedToken,
+				"GOOGLE_OAUTH_ACCESS_TOKEN":  testCase.expectedToken,
+			}, cred.EnvVars)
+			assert.Equal(t, expireTime, cred.NotAfter.AsTime())
+		})
+	}
+}
+
+func TestGoogleAccessTokenProvider_Ping(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler should not have been invoked during ping")
+	}))
+
+	p, err := NewGoogleAccessTokenProvider(context.Background(), GoogleAccessTokenProviderOptions{
+		Endpoint: testServer.URL,
+		CredentialsOverride: &google.Credentials{
+			ProjectID:   "test",
+			TokenSource: testToken{},
+			JSON:        []byte(`{}`),
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "GoogleAccessTokenProvider", p.Name())
+	assert.NoError(t, p.Ping())
+
+	testServer.Close()
+	assert.ErrorContains(t, p.Ping(), "provider ping failed")
+}
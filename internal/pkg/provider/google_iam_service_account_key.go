@@ -85,6 +85,12 @@ func (p *GoogleIAMServiceAccountKeyProvider) Name() string {
 	return "GoogleIAMServiceAccountKeyProvider"
 }
 
+func (p *GoogleIAMServiceAccountKeyProvider) FileOutputs() []FileOutput {
+	return []FileOutput{
+		{Name: "application_default_credentials", Path: "~/.config/gcloud/application_default_credentials.json"},
+	}
+}
+
 func (p *GoogleIAMServiceAccountKeyProvider) Ping() error {
 	_, err := net.DialTimeout("tcp", p.pingHost, time.Second*3)
 
@@ -0,0 +1,252 @@
+package provider
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+)
+
+// defaultJWTClaimsTemplate is used when no claims template is configured, the caller's SPIFFE ID becomes the subject
+const defaultJWTClaimsTemplate = `{"sub": "{{ .SpiffeID }}"}`
+
+// JWTSignerProviderOptions are the options available to configure a JWTSignerProvider
+type JWTSignerProviderOptions struct {
+	// Algorithm is the signing algorithm, HS256 and RS256 are supported
+	Algorithm string
+
+	// Key is the signing key, for HS256 this is the shared secret and for RS256 a PEM encoded RSA private key. If not
+	// set the key is loaded from KeyFile.
+	Key []byte
+
+	// KeyFile is the path to the signing key, used when Key is not set. Surrounding whitespace is trimmed from shared
+	// secrets.
+	KeyFile string
+
+	// KeyID is optional and is set as the kid header of minted tokens
+	KeyID string
+
+	// Issuer is optional and is set as the iss claim of minted tokens
+	Issuer string
+
+	// ClaimsTemplate is a text/template which must render to a JSON object of additional claims. The exp, iat, nbf
+	// and aud claims are always set by the provider. Defaults to setting sub to the caller's SPIFFE ID.
+	ClaimsTemplate string
+
+	// TTL is how long tokens are valid for when the object reference does not set one, defaults to 15m
+	TTL time.Duration
+}
+
+// JWTSignerProvider is a provider which mints JWTs signed with a configured key, for services which validate bearer
+// tokens but cannot speak SPIFFE
+type JWTSignerProvider struct {
+	signer         jose.Signer
+	issuer         string
+	claimsTemplate string
+	ttl            time.Duration
+}
+
+// NewJWTSignerProvider will configure a new JWTSignerProvider using the supplied options
+func NewJWTSignerProvider(options JWTSignerProviderOptions) (JWTSignerProvider, error) {
+	key := options.Key
+	if key == nil {
+		if options.KeyFile == "" {
+			return JWTSignerProvider{}, errors.New("one of key or key file must be set")
+		}
+		var err error
+		key, err = os.ReadFile(options.KeyFile)
+		if err != nil {
+			return JWTSignerProvider{}, fmt.Errorf("failed to read key file: %w", err)
+		}
+	}
+
+	var signingKey jose.SigningKey
+	switch jose.SignatureAlgorithm(options.Algorithm) {
+	case jose.HS256:
+		secret := bytes.TrimSpace(key)
+		// RFC 7518 requires a key at least as long as the hash output
+		if len(secret) < 32 {
+			return JWTSignerProvider{}, errors.New("HS256 key must be at least 32 bytes")
+		}
+		signingKey = jose.SigningKey{Algorithm: jose.HS256, Key: secret}
+	case jose.RS256:
+		block, _ := pem.Decode(key)
+		if block == nil {
+			return JWTSignerProvider{}, errors.New("RS256 key must be PEM encoded")
+		}
+		rsaKey, err := parseRSAPrivateKey(block.Bytes)
+		if err != nil {
+			return JWTSignerProvider{}, fmt.Errorf("failed to parse RS256 key: %w", err)
+		}
+		signingKey = jose.SigningKey{Algorithm: jose.RS256, Key: rsaKey}
+	default:
+		return JWTSignerProvider{}, fmt.Errorf("unsupported algorithm %q", options.Algorithm)
+	}
+
+	signerOptions := (&jose.SignerOptions{}).WithType("JWT")
+	if options.KeyID != "" {
+		signerOptions = signerOptions.WithHeader("kid", options.KeyID)
+	}
+	signer, err := jose.NewSigner(signingKey, signerOptions)
+	if err != nil {
+		return JWTSignerProvider{}, fmt.Errorf("failed to create signer: %w", err)
+	}
+
+	claimsTemplate := defaultJWTClaimsTemplate
+	if options.ClaimsTemplate != "" {
+		claimsTemplate = options.ClaimsTemplate
+	}
+
+	ttl := 15 * time.Minute
+	if options.TTL > 0 {
+		ttl = options.TTL
+	}
+
+	return JWTSignerProvider{
+		signer:         signer,
+		issuer:         options.Issuer,
+		claimsTemplate: claimsTemplate,
+		ttl:            ttl,
+	}, nil
+}
+
+// Name returns the name of the provider
+func (p *JWTSignerProvider) Name() string {
+	return "JWTSignerProvider"
+}
+
+// FileOutputs describes the token file, which is named after the first audience of the token
+func (p *JWTSignerProvider) FileOutputs() []FileOutput {
+	return []FileOutput{
+		{Name: "token", Path: "~/.config/spiffe-connector/tokens/*.jwt"},
+	}
+}
+
+// Ping always succeeds as tokens are signed locally
+func (p *JWTSignerProvider) Ping() error {
+	return nil
+}
+
+// GetCredential is not supported, since claims are rendered using details of the caller
+func (p *JWTSignerProvider) GetCredential(objectReference string) (*proto.Credential, error) {
+	return &proto.Credential{}, errors.New("JWTs can only be minted for a known principal")
+}
+
+// PerPrincipal is always true, since claims are rendered using details of the caller
+func (p *JWTSignerProvider) PerPrincipal(request Request) bool {
+	return true
+}
+
+// GetCredentialForRequest mints a signed JWT. The objectReference is in URL query format and contains the audience and
+// optionally a TTL, for example "aud=orders-api&ttl=5m". More than one aud may be given.
+func (p *JWTSignerProvider) GetCredentialForRequest(request Request) (*proto.Credential, error) {
+	if request.Principal.IsZero() {
+		return &proto.Credential{}, errors.New("JWTs can only be minted for a known principal")
+	}
+
+	values, err := url.ParseQuery(request.ObjectReference)
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to parse object reference: %w", err)
+	}
+	audience := values["aud"]
+	if len(audience) == 0 {
+		return &proto.Credential{}, errors.New("object reference must contain an aud")
+	}
+	ttl := p.ttl
+	for key, vs := range values {
+		switch key {
+		case "aud":
+		case "ttl":
+			ttl, err = time.ParseDuration(vs[0])
+			if err != nil || ttl <= 0 {
+				return &proto.Credential{}, fmt.Errorf("invalid ttl %q in object reference", vs[0])
+			}
+		default:
+			return &proto.Credential{}, fmt.Errorf("unsupported key %q in object reference", key)
+		}
+	}
+
+	// JWT timestamps have second precision, so truncate now to keep the credential expiry in line with the token
+	now := time.Now().Truncate(time.Second)
+	notAfter := now.Add(ttl)
+
+	renderedClaims, err := executeTemplate("claims", p.claimsTemplate, newTemplateData(request, now))
+	if err != nil {
+		return &proto.Credential{}, err
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(renderedClaims), &claims); err != nil {
+		return &proto.Credential{}, fmt.Errorf("claims template did not render a JSON object: %w", err)
+	}
+
+	var jti [16]byte
+	if _, err := rand.Read(jti[:]); err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to generate token ID: %w", err)
+	}
+	registeredClaims := jwt.Claims{
+		ID:        hex.EncodeToString(jti[:]),
+		Audience:  jwt.Audience(audience),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(notAfter),
+	}
+	if p.issuer != "" {
+		registeredClaims.Issuer = p.issuer
+	}
+
+	// registered claims are applied after the templated ones so that they always take precedence
+	token, err := jwt.Signed(p.signer).Claims(claims).Claims(registeredClaims).CompactSerialize()
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to sign token: %w", err)
+	}
+
+	return &proto.Credential{
+		NotAfter: timestamppb.New(notAfter),
+		Token:    &token,
+		Files: []*proto.File{
+			{
+				Path:     fmt.Sprintf("~/.config/spiffe-connector/tokens/%s.jwt", jwtFileName(audience[0])),
+				Mode:     0600,
+				Contents: []byte(token),
+			},
+		},
+	}, nil
+}
+
+// parseRSAPrivateKey parses an RSA key in either PKCS #1 or PKCS #8 form
+func parseRSAPrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+var unsafeFileNameCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// jwtFileName turns an audience, which is often a URL, into something safe to use as a file name
+func jwtFileName(audience string) string {
+	return unsafeFileNameCharacters.ReplaceAllString(audience, "_")
+}
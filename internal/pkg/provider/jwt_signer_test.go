@@ -0,0 +1,139 @@
+package provider
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestNewJWTSignerProvider(t *testing.T) {
+	p, err := NewJWTSignerProvider(JWTSignerProviderOptions{Algorithm: "HS256", Key: []byte("0123456789abcdef0123456789abcdef\n")})
+	require.NoError(t, err)
+	assert.Equal(t, "JWTSignerProvider", p.Name())
+	assert.NoError(t, p.Ping())
+
+	_, err = NewJWTSignerProvider(JWTSignerProviderOptions{Algorithm: "HS256", Key: []byte("short")})
+	assert.EqualError(t, err, "HS256 key must be at least 32 bytes")
+
+	_, err = NewJWTSignerProvider(JWTSignerProviderOptions{Algorithm: "none", Key: []byte("0123456789abcdef0123456789abcdef")})
+	assert.EqualError(t, err, `unsupported algorithm "none"`)
+
+	_, err = NewJWTSignerProvider(JWTSignerProviderOptions{Algorithm: "RS256", Key: []byte("not pem")})
+	assert.EqualError(t, err, "RS256 key must be PEM encoded")
+
+	_, err = NewJWTSignerProvider(JWTSignerProviderOptions{Algorithm: "HS256"})
+	assert.EqualError(t, err, "one of key or key file must be set")
+}
+
+func TestJWTSignerProvider_GetCredentialForRequest(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	request := Request{
+		Principal:      spiffeid.RequireFromString("spiffe://example.com/ns/orders/sa/api"),
+		MatchPrincipal: "spiffe://example.com/ns/orders/*",
+	}
+
+	testCases := map[string]struct {
+		options          JWTSignerProviderOptions
+		objectReference  string
+		verificationKey  interface{}
+		expectedError    error
+		expectedClaims   map[string]interface{}
+		expectedAudience jwt.Audience
+		expectedTTL      time.Duration
+	}{
+		"HS256 with default claims": {
+			options:          JWTSignerProviderOptions{Algorithm: "HS256", Key: secret},
+			objectReference:  "aud=orders-api",
+			verificationKey:  secret,
+			expectedClaims:   map[string]interface{}{"sub": "spiffe://example.com/ns/orders/sa/api"},
+			expectedAudience: jwt.Audience{"orders-api"},
+			expectedTTL:      15 * time.Minute,
+		},
+		"RS256 with claims template, issuer and ttl": {
+			options: JWTSignerProviderOptions{
+				Algorithm:      "RS256",
+				Key:            rsaKeyPEM,
+				Issuer:         "spiffe-connector",
+				ClaimsTemplate: `{"sub": "{{ index .PathSegments 3 }}", "acl": "{{ .ACL }}", "minted": {{ .Now.Unix }}, "exp": 1}`,
+			},
+			objectReference:  "aud=https://legacy.example.com/&aud=other&ttl=5m",
+			verificationKey:  &rsaKey.PublicKey,
+			expectedClaims:   map[string]interface{}{"sub": "api", "acl": "spiffe://example.com/ns/orders/*", "iss": "spiffe-connector"},
+			expectedAudience: jwt.Audience{"https://legacy.example.com/", "other"},
+			expectedTTL:      5 * time.Minute,
+		},
+		"missing audience": {
+			options:         JWTSignerProviderOptions{Algorithm: "HS256", Key: secret},
+			objectReference: "ttl=5m",
+			expectedError:   errors.New("object reference must contain an aud"),
+		},
+		"invalid ttl": {
+			options:         JWTSignerProviderOptions{Algorithm: "HS256", Key: secret},
+			objectReference: "aud=foo&ttl=-5m",
+			expectedError:   errors.New(`invalid ttl "-5m" in object reference`),
+		},
+		"claims template does not render JSON": {
+			options:         JWTSignerProviderOptions{Algorithm: "HS256", Key: secret, ClaimsTemplate: `sub={{ .SpiffeID }}`},
+			objectReference: "aud=foo",
+			expectedError:   errors.New("claims template did not render a JSON object: invalid character 's' looking for beginning of value"),
+		},
+	}
+
+	for testName, testCase := range testCases {
+		p, err := NewJWTSignerProvider(testCase.options)
+		require.NoError(t, err)
+
+		t.Run(testName, func(t *testing.T) {
+			request := request
+			request.ObjectReference = testCase.objectReference
+			assert.True(t, p.PerPrincipal(request))
+
+			cred, err := p.GetCredentialForRequest(request)
+			if testCase.expectedError != nil {
+				assert.EqualError(t, err, testCase.expectedError.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, cred.Token)
+			require.Len(t, cred.Files, 1)
+			assert.Equal(t, *cred.Token, string(cred.Files[0].Contents))
+
+			token, err := jwt.ParseSigned(*cred.Token)
+			require.NoError(t, err)
+			registered := jwt.Claims{}
+			custom := map[string]interface{}{}
+			require.NoError(t, token.Claims(testCase.verificationKey, &registered, &custom))
+
+			assert.NoError(t, registered.Validate(jwt.Expected{Time: time.Now(), Audience: testCase.expectedAudience}))
+			assert.Equal(t, testCase.expectedAudience, registered.Audience)
+			assert.Equal(t, cred.NotAfter.AsTime(), registered.Expiry.Time().UTC())
+			assert.Equal(t, testCase.expectedTTL, registered.Expiry.Time().Sub(registered.IssuedAt.Time()))
+			assert.NotEmpty(t, registered.ID)
+			for k, v := range testCase.expectedClaims {
+				assert.Equal(t, v, custom[k], "unexpected value for claim %q", k)
+			}
+		})
+	}
+
+	p, err := NewJWTSignerProvider(JWTSignerProviderOptions{Algorithm: "HS256", Key: secret})
+	require.NoError(t, err)
+	_, err = p.GetCredential("aud=foo")
+	assert.EqualError(t, err, "JWTs can only be minted for a known principal")
+
+	cred, err := p.GetCredentialForRequest(Request{ObjectReference: "aud=https://legacy.example.com/", Principal: request.Principal})
+	require.NoError(t, err)
+	assert.Equal(t, "~/.config/spiffe-connector/tokens/https_legacy.example.com_.jwt", cred.Files[0].Path)
+}
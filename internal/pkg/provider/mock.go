@@ -0,0 +1,169 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+// MockProviderOptions are the options available to configure a MockProvider
+type MockProviderOptions struct {
+	// Name is returned by Name, defaults to MockProvider. Setting it to the name of another provider allows the mock to
+	// stand in for it.
+	Name string
+
+	// Lifetime is how long returned credentials are valid for, defaults to 1h
+	Lifetime time.Duration
+
+	// Latency is added to every call to GetCredential
+	Latency time.Duration
+
+	// ErrorRate is the fraction of calls to GetCredential, between 0 and 1, which fail
+	ErrorRate float64
+
+	// Errors maps object references to an error message which is always returned for them
+	Errors map[string]string
+
+	// PingError is returned from Ping if set
+	PingError string
+
+	// Seed seeds the random source used for ErrorRate, so that failures can be reproduced. Defaults to the current time.
+	Seed int64
+}
+
+// MockProvider is a provider which returns fake credentials without calling any external system, for local development
+// and integration tests. Credentials are derived from the provider name and object reference, and the principal when
+// issued per principal, so are the same on every call and across restarts.
+type MockProvider struct {
+	name      string
+	lifetime  time.Duration
+	latency   time.Duration
+	errorRate float64
+	errors    map[string]string
+	pingError string
+
+	mu   *sync.Mutex
+	rand *rand.Rand
+}
+
+// NewMockProvider will configure a new MockProvider using the supplied options
+func NewMockProvider(options MockProviderOptions) (MockProvider, error) {
+	if options.ErrorRate < 0 || options.ErrorRate > 1 {
+		return MockProvider{}, fmt.Errorf("error rate must be between 0 and 1, got %v", options.ErrorRate)
+	}
+	if options.Latency < 0 {
+		return MockProvider{}, errors.New("latency cannot be negative")
+	}
+
+	seed := options.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	p := MockProvider{
+		name:      "MockProvider",
+		lifetime:  time.Hour,
+		latency:   options.Latency,
+		errorRate: options.ErrorRate,
+		errors:    options.Errors,
+		pingError: options.PingError,
+		mu:        &sync.Mutex{},
+		rand:      rand.New(rand.NewSource(seed)),
+	}
+	if options.Name != "" {
+		p.name = options.Name
+	}
+	if options.Lifetime > 0 {
+		p.lifetime = options.Lifetime
+	}
+
+	return p, nil
+}
+
+// Name returns the configured name of the provider
+func (p *MockProvider) Name() string {
+	return p.name
+}
+
+// Ping succeeds unless a ping error is configured
+func (p *MockProvider) Ping() error {
+	if p.pingError != "" {
+		return fmt.Errorf("provider ping failed: %s", p.pingError)
+	}
+	return nil
+}
+
+// ValidateOptions accepts any options, since the mock may stand in for any provider
+func (p *MockProvider) ValidateOptions(options map[string]string) error {
+	return nil
+}
+
+// GetCredential returns a fake credential for the objectReference, containing a token, an env var and a file holding
+// the token. Failures are injected as configured.
+func (p *MockProvider) GetCredential(objectReference string) (*proto.Credential, error) {
+	return p.GetCredentialForRequest(Request{ObjectReference: objectReference})
+}
+
+// PerPrincipal is false, credentials are only issued for each principal when the ACL credential asks for it
+func (p *MockProvider) PerPrincipal(request Request) bool {
+	return false
+}
+
+// GetCredentialForRequest is GetCredential, with the principal also deriving the token of credentials issued per
+// principal so that each principal is handed a different one
+func (p *MockProvider) GetCredentialForRequest(request Request) (*proto.Credential, error) {
+	objectReference := request.ObjectReference
+	if p.latency > 0 {
+		time.Sleep(p.latency)
+	}
+
+	if message, ok := p.errors[objectReference]; ok {
+		return &proto.Credential{}, errors.New(message)
+	}
+	if p.errorRate > 0 {
+		p.mu.Lock()
+		fail := p.rand.Float64() < p.errorRate
+		p.mu.Unlock()
+		if fail {
+			return &proto.Credential{}, fmt.Errorf("injected failure for %q", objectReference)
+		}
+	}
+
+	seed := p.name + "/" + objectReference
+	if request.Credential.Issuance == types.IssuancePerPrincipal {
+		if request.Principal.IsZero() {
+			return &proto.Credential{}, errors.New("per-principal credentials can only be issued for a known principal")
+		}
+		seed += "/" + request.Principal.String()
+	}
+	sum := sha256.Sum256([]byte(seed))
+	token := "mock-" + hex.EncodeToString(sum[:16])
+	envVar := strings.ToUpper(unsafeFileNameCharacters.ReplaceAllString(p.name, "_")) + "_TOKEN"
+
+	return &proto.Credential{
+		NotAfter: timestamppb.New(time.Now().Add(p.lifetime)),
+		Files: []*proto.File{
+			{
+				Path: fmt.Sprintf("~/.config/spiffe-connector/mock/%s/%s",
+					unsafeFileNameCharacters.ReplaceAllString(p.name, "_"),
+					unsafeFileNameCharacters.ReplaceAllString(objectReference, "_")),
+				Mode:     0600,
+				Contents: []byte(token),
+			},
+		},
+		EnvVars: map[string]string{
+			envVar: token,
+		},
+		Token: &token,
+	}, nil
+}
@@ -0,0 +1,139 @@
+package provider
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+func TestMockProvider_GetCredential(t *testing.T) {
+	testCases := map[string]struct {
+		options         MockProviderOptions
+		objectReference string
+		expectedEnvVar  string
+		expectedPath    string
+		expectedError   error
+	}{
+		"default name": {
+			objectReference: "arn:aws:iam::123456789012:role/reader",
+			expectedEnvVar:  "MOCKPROVIDER_TOKEN",
+			expectedPath:    "~/.config/spiffe-connector/mock/MockProvider/arn_aws_iam_123456789012_role_reader",
+		},
+		"standing in for another provider": {
+			options:         MockProviderOptions{Name: "AWSSTSAssumeRoleProvider"},
+			objectReference: "arn:aws:iam::123456789012:role/reader",
+			expectedEnvVar:  "AWSSTSASSUMEROLEPROVIDER_TOKEN",
+			expectedPath:    "~/.config/spiffe-connector/mock/AWSSTSAssumeRoleProvider/arn_aws_iam_123456789012_role_reader",
+		},
+		"specific error": {
+			options:         MockProviderOptions{Errors: map[string]string{"denied": "AccessDenied: not authorized"}},
+			objectReference: "denied",
+			expectedError:   errors.New("AccessDenied: not authorized"),
+		},
+		"always failing": {
+			options:         MockProviderOptions{ErrorRate: 1},
+			objectReference: "anything",
+			expectedError:   errors.New(`injected failure for "anything"`),
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			p, err := NewMockProvider(testCase.options)
+			require.NoError(t, err)
+
+			cred, err := p.GetCredential(testCase.objectReference)
+			if testCase.expectedError != nil {
+				assert.EqualError(t, err, testCase.expectedError.Error())
+				return
+			}
+			require.NoError(t, err)
+
+			require.NotNil(t, cred.Token)
+			assert.Equal(t, map[string]string{testCase.expectedEnvVar: *cred.Token}, cred.EnvVars)
+			require.Len(t, cred.Files, 1)
+			assert.Equal(t, testCase.expectedPath, cred.Files[0].Path)
+			assert.Equal(t, *cred.Token, string(cred.Files[0].Contents))
+			assert.WithinDuration(t, time.Now().Add(time.Hour), cred.NotAfter.AsTime(), 5*time.Second)
+
+			// credentials are deterministic
+			again, err := p.GetCredential(testCase.objectReference)
+			require.NoError(t, err)
+			assert.Equal(t, *cred.Token, *again.Token)
+		})
+	}
+}
+
+func TestMockProvider_GetCredentialForRequest_PerPrincipal(t *testing.T) {
+	p, err := NewMockProvider(MockProviderOptions{})
+	require.NoError(t, err)
+
+	request := Request{
+		ObjectReference: "reader",
+		Principal:       spiffeid.RequireFromString("spiffe://example.com/a"),
+		Credential:      types.Credential{Issuance: types.IssuancePerPrincipal},
+	}
+	assert.False(t, p.PerPrincipal(request))
+	first, err := p.GetCredentialForRequest(request)
+	require.NoError(t, err)
+	again, err := p.GetCredentialForRequest(request)
+	require.NoError(t, err)
+	assert.Equal(t, *first.Token, *again.Token, "credentials are deterministic for each principal")
+
+	request.Principal = spiffeid.RequireFromString("spiffe://example.com/b")
+	other, err := p.GetCredentialForRequest(request)
+	require.NoError(t, err)
+	assert.NotEqual(t, *first.Token, *other.Token, "principals are issued different credentials")
+
+	shared, err := p.GetCredential("reader")
+	require.NoError(t, err)
+	assert.NotEqual(t, *first.Token, *shared.Token, "per-principal credentials differ from shared ones")
+
+	request.Principal = spiffeid.ID{}
+	_, err = p.GetCredentialForRequest(request)
+	assert.EqualError(t, err, "per-principal credentials can only be issued for a known principal")
+}
+
+func TestMockProvider_ErrorRate(t *testing.T) {
+	p, err := NewMockProvider(MockProviderOptions{ErrorRate: 0.5, Seed: 1})
+	require.NoError(t, err)
+
+	var failures int
+	for i := 0; i < 1000; i++ {
+		if _, err := p.GetCredential("reference"); err != nil {
+			failures++
+		}
+	}
+	assert.InDelta(t, 500, failures, 75)
+}
+
+func TestMockProvider_Latency(t *testing.T) {
+	p, err := NewMockProvider(MockProviderOptions{Latency: 50 * time.Millisecond, Lifetime: time.Minute})
+	require.NoError(t, err)
+
+	start := time.Now()
+	cred, err := p.GetCredential("reference")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), cred.NotAfter.AsTime(), 5*time.Second)
+}
+
+func TestMockProvider_Ping(t *testing.T) {
+	p, err := NewMockProvider(MockProviderOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "MockProvider", p.Name())
+	assert.NoError(t, p.Ping())
+
+	p, err = NewMockProvider(MockProviderOptions{PingError: "connection refused"})
+	require.NoError(t, err)
+	assert.EqualError(t, p.Ping(), "provider ping failed: connection refused")
+
+	_, err = NewMockProvider(MockProviderOptions{ErrorRate: 1.5})
+	assert.EqualError(t, err, "error rate must be between 0 and 1, got 1.5")
+}
@@ -0,0 +1,247 @@
+package provider
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	goproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+)
+
+// PostgresRoleProviderOptions are the options available to configure a PostgresRoleProvider
+type PostgresRoleProviderOptions struct {
+	// DSN is the connection string of a user permitted to create and drop roles
+	DSN string
+
+	// DB will be used instead of opening a new connection to DSN if set
+	DB *sql.DB
+
+	// Host and Port are written to the .pgpass file returned to clients, both default to * which matches any server
+	Host string
+	Port string
+
+	// Duration is how long roles are valid for, defaults to 1hr
+	Duration time.Duration
+
+	// RolePrefix is prepended to the name of every role created, and is used by the sweeper to find expired roles.
+	// Defaults to spiffe_connector_
+	RolePrefix string
+}
+
+// PostgresRoleProvider is a provider which creates short lived PostgreSQL login roles
+type PostgresRoleProvider struct {
+	db         *sql.DB
+	host       string
+	port       string
+	duration   time.Duration
+	rolePrefix string
+}
+
+// NewPostgresRoleProvider will configure a new PostgresRoleProvider using the supplied options
+func NewPostgresRoleProvider(options PostgresRoleProviderOptions) (PostgresRoleProvider, error) {
+	db := options.DB
+	if db == nil {
+		if options.DSN == "" {
+			return PostgresRoleProvider{}, errors.New("DSN must be set")
+		}
+		var err error
+		db, err = sql.Open("postgres", options.DSN)
+		if err != nil {
+			return PostgresRoleProvider{}, fmt.Errorf("failed to open database: %w", err)
+		}
+	}
+
+	p := PostgresRoleProvider{
+		db:         db,
+		host:       "*",
+		port:       "*",
+		duration:   time.Hour,
+		rolePrefix: "spiffe_connector_",
+	}
+	if options.Host != "" {
+		p.host = options.Host
+	}
+	if options.Port != "" {
+		p.port = options.Port
+	}
+	if options.Duration > 0 {
+		p.duration = options.Duration
+	}
+	if options.RolePrefix != "" {
+		p.rolePrefix = options.RolePrefix
+	}
+
+	return p, nil
+}
+
+// Name returns the name of the provider
+func (p *PostgresRoleProvider) Name() string {
+	return "PostgresRoleProvider"
+}
+
+// FileOutputs describes the password file
+func (p *PostgresRoleProvider) FileOutputs() []FileOutput {
+	return []FileOutput{
+		{Name: "pgpass", Path: "~/.pgpass"},
+	}
+}
+
+// Ping tests the database is reachable and the connection credentials are valid
+func (p *PostgresRoleProvider) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	if err := p.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("provider ping failed: %w", err)
+	}
+
+	return nil
+}
+
+// GetCredential creates a new login role which is a member of the group role named by objectReference and expires
+// after the configured duration
+func (p *PostgresRoleProvider) GetCredential(objectReference string) (*proto.Credential, error) {
+	if objectReference == "" {
+		return &proto.Credential{}, errors.New("object reference must name a group role")
+	}
+
+	username, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to generate username: %w", err)
+	}
+	username = p.rolePrefix + username
+	password, err := randomString(24, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to generate password: %w", err)
+	}
+	validUntil := time.Now().Add(p.duration).UTC().Truncate(time.Second)
+
+	// DDL statements do not accept bind parameters, so all values are quoted
+	statement := fmt.Sprintf("CREATE ROLE %s WITH LOGIN PASSWORD %s VALID UNTIL %s IN ROLE %s",
+		pq.QuoteIdentifier(username),
+		pq.QuoteLiteral(password),
+		pq.QuoteLiteral(validUntil.Format(time.RFC3339)),
+		pq.QuoteIdentifier(objectReference),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if _, err := p.db.ExecContext(ctx, statement); err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to create role in %q: %w", objectReference, err)
+	}
+
+	return &proto.Credential{
+		NotAfter: timestamppb.New(validUntil),
+		Username: &username,
+		Password: &password,
+		Files: []*proto.File{
+			{
+				Path:     "~/.pgpass",
+				Mode:     0600,
+				Contents: []byte(fmt.Sprintf("%s:%s:*:%s:%s\n", p.host, p.port, pgpassEscape(username), pgpassEscape(password))),
+			},
+		},
+	}, nil
+}
+
+// Renew extends the expiry of the role in the credential by the configured duration, keeping its password
+func (p *PostgresRoleProvider) Renew(request Request, credential *proto.Credential) (*proto.Credential, error) {
+	if credential.Username == nil || !strings.HasPrefix(*credential.Username, p.rolePrefix) {
+		return nil, errors.New("credential does not contain a role created by the provider")
+	}
+	validUntil := time.Now().Add(p.duration).UTC().Truncate(time.Second)
+
+	statement := fmt.Sprintf("ALTER ROLE %s VALID UNTIL %s",
+		pq.QuoteIdentifier(*credential.Username),
+		pq.QuoteLiteral(validUntil.Format(time.RFC3339)),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if _, err := p.db.ExecContext(ctx, statement); err != nil {
+		return nil, fmt.Errorf("failed to renew role %q: %w", *credential.Username, err)
+	}
+
+	renewed := goproto.Clone(credential).(*proto.Credential)
+	renewed.NotAfter = timestamppb.New(validUntil)
+	renewed.RenewAfter = nil
+	return renewed, nil
+}
+
+// Sweep drops roles created by the provider which have expired
+func (p *PostgresRoleProvider) Sweep(ctx context.Context) error {
+	// _ is a wildcard in LIKE patterns, so it must be escaped in the prefix
+	pattern := strings.ReplaceAll(p.rolePrefix, "_", `\_`) + "%"
+	rows, err := p.db.QueryContext(ctx, "SELECT rolname FROM pg_roles WHERE rolname LIKE $1 AND rolvaliduntil < now()", pattern)
+	if err != nil {
+		return fmt.Errorf("failed to list expired roles: %w", err)
+	}
+	var expired []string
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to list expired roles: %w", err)
+		}
+		expired = append(expired, role)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list expired roles: %w", err)
+	}
+
+	var messages []string
+	for _, role := range expired {
+		if _, err := p.db.ExecContext(ctx, fmt.Sprintf("DROP ROLE IF EXISTS %s", pq.QuoteIdentifier(role))); err != nil {
+			messages = append(messages, fmt.Sprintf("%s: %s", role, err))
+		}
+	}
+	if len(messages) > 0 {
+		return fmt.Errorf("failed to drop expired roles: %s", strings.Join(messages, ", "))
+	}
+
+	return nil
+}
+
+// StartSweeper runs Sweep every interval until the context is cancelled
+func (p *PostgresRoleProvider) StartSweeper(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := p.Sweep(ctx); err != nil {
+					log.Printf("error while sweeping expired postgres roles (%s)", err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// randomString encodes n random bytes with the given encoding
+func randomString(n int, encode func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
+
+// pgpassEscape escapes the characters which are special in a .pgpass file
+func pgpassEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`).Replace(s)
+}
@@ -0,0 +1,165 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+)
+
+func TestPostgresRoleProvider_Ping(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	require.NoError(t, err)
+	defer db.Close()
+
+	p, err := NewPostgresRoleProvider(PostgresRoleProviderOptions{DB: db})
+	require.NoError(t, err)
+	assert.Equal(t, "PostgresRoleProvider", p.Name())
+
+	mock.ExpectPing()
+	assert.NoError(t, p.Ping())
+
+	mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	assert.EqualError(t, p.Ping(), "provider ping failed: connection refused")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresRoleProvider_GetCredential(t *testing.T) {
+	createRole := regexp.MustCompile(`^CREATE ROLE "(app_[0-9a-f]{16})" WITH LOGIN PASSWORD '([A-Za-z0-9_-]{32})' VALID UNTIL '([^']+)' IN ROLE "readers"$`)
+
+	testCases := map[string]struct {
+		objectReference string
+		execError       error
+		expectedError   error
+	}{
+		"successful example": {
+			objectReference: "readers",
+		},
+		"group role does not exist": {
+			objectReference: "readers",
+			execError:       errors.New(`pq: role "readers" does not exist`),
+			expectedError:   errors.New(`failed to create role in "readers": pq: role "readers" does not exist`),
+		},
+		"missing group role": {
+			objectReference: "",
+			expectedError:   errors.New("object reference must name a group role"),
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherFunc(func(expected, actual string) error {
+				if !createRole.MatchString(actual) {
+					return fmt.Errorf("unexpected statement %q", actual)
+				}
+				return nil
+			})))
+			require.NoError(t, err)
+			defer db.Close()
+
+			p, err := NewPostgresRoleProvider(PostgresRoleProviderOptions{
+				DB:         db,
+				Host:       "db.example.com",
+				Port:       "5432",
+				Duration:   30 * time.Minute,
+				RolePrefix: "app_",
+			})
+			require.NoError(t, err)
+
+			if testCase.objectReference != "" {
+				expectation := mock.ExpectExec("CREATE ROLE")
+				if testCase.execError != nil {
+					expectation.WillReturnError(testCase.execError)
+				} else {
+					expectation.WillReturnResult(sqlmock.NewResult(0, 0))
+				}
+			}
+
+			cred, err := p.GetCredential(testCase.objectReference)
+			require.NoError(t, mock.ExpectationsWereMet())
+			if testCase.expectedError != nil {
+				assert.EqualError(t, err, testCase.expectedError.Error())
+				return
+			}
+			require.NoError(t, err)
+
+			require.NotNil(t, cred.Username)
+			require.NotNil(t, cred.Password)
+			assert.True(t, strings.HasPrefix(*cred.Username, "app_"))
+			assert.WithinDuration(t, time.Now().Add(30*time.Minute), cred.NotAfter.AsTime(), 5*time.Second)
+
+			require.Len(t, cred.Files, 1)
+			assert.Equal(t, "~/.pgpass", cred.Files[0].Path)
+			assert.Equal(t, uint32(0600), cred.Files[0].Mode)
+			assert.Equal(t, fmt.Sprintf("db.example.com:5432:*:%s:%s\n", *cred.Username, *cred.Password), string(cred.Files[0].Contents))
+		})
+	}
+}
+
+func TestPostgresRoleProvider_Sweep(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	defer db.Close()
+
+	p, err := NewPostgresRoleProvider(PostgresRoleProviderOptions{DB: db})
+	require.NoError(t, err)
+
+	mock.ExpectQuery("SELECT rolname FROM pg_roles WHERE rolname LIKE $1 AND rolvaliduntil < now()").
+		WithArgs(`spiffe\_connector\_%`).
+		WillReturnRows(sqlmock.NewRows([]string{"rolname"}).AddRow("spiffe_connector_aaaa").AddRow("spiffe_connector_bbbb"))
+	mock.ExpectExec(`DROP ROLE IF EXISTS "spiffe_connector_aaaa"`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DROP ROLE IF EXISTS "spiffe_connector_bbbb"`).WillReturnError(errors.New("role owns objects"))
+
+	err = p.Sweep(context.Background())
+	assert.EqualError(t, err, "failed to drop expired roles: spiffe_connector_bbbb: role owns objects")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresRoleProvider_Renew(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	require.NoError(t, err)
+	defer db.Close()
+
+	p, err := NewPostgresRoleProvider(PostgresRoleProviderOptions{DB: db, Duration: 30 * time.Minute})
+	require.NoError(t, err)
+
+	username, password := "spiffe_connector_aaaa", "secret"
+	cred := &proto.Credential{
+		NotAfter:   timestamppb.New(time.Now().Add(time.Minute)),
+		RenewAfter: timestamppb.New(time.Now()),
+		Username:   &username,
+		Password:   &password,
+	}
+
+	mock.ExpectExec(`^ALTER ROLE "spiffe_connector_aaaa" VALID UNTIL '[0-9TZ:-]+'$`).WillReturnResult(sqlmock.NewResult(0, 0))
+	renewed, err := p.Renew(Request{ObjectReference: "readers"}, cred)
+	require.NoError(t, err)
+	assert.Equal(t, password, *renewed.Password)
+	assert.Nil(t, renewed.RenewAfter)
+	assert.WithinDuration(t, time.Now().Add(30*time.Minute), renewed.NotAfter.AsTime(), 5*time.Second)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), cred.NotAfter.AsTime(), 5*time.Second, "the renewed credential must be a copy")
+
+	mock.ExpectExec(`^ALTER ROLE "spiffe_connector_aaaa"`).WillReturnError(errors.New(`role "spiffe_connector_aaaa" does not exist`))
+	_, err = p.Renew(Request{ObjectReference: "readers"}, cred)
+	assert.EqualError(t, err, `failed to renew role "spiffe_connector_aaaa": role "spiffe_connector_aaaa" does not exist`)
+
+	other := "admin"
+	_, err = p.Renew(Request{ObjectReference: "readers"}, &proto.Credential{Username: &other})
+	assert.EqualError(t, err, "credential does not contain a role created by the provider")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPgpassEscape(t *testing.T) {
+	assert.Equal(t, `a\:b\\c`, pgpassEscape(`a:b\c`))
+}
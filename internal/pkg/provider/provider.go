@@ -2,7 +2,15 @@
 package provider
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+
 	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
 )
 
 type Provider interface {
@@ -10,3 +18,168 @@ type Provider interface {
 	Ping() error
 	GetCredential(objectReference string) (*proto.Credential, error)
 }
+
+// Request contains the details of a single credential request made by a client of the server
+type Request struct {
+	// ObjectReference is the provider specific reference taken from the matching ACL credential
+	ObjectReference string
+
+	// Principal is the SPIFFE ID of the client the credential is being issued to
+	Principal spiffeid.ID
+
+	// MatchPrincipal is the match_principal of the ACL which granted the credential
+	MatchPrincipal string
+
+	// Credential is the ACL credential being requested, including any provider specific options
+	Credential types.Credential
+}
+
+// RequestProvider is implemented by providers which need more than the object reference to issue a credential, for
+// example when the identity of the caller is embedded in the credential
+type RequestProvider interface {
+	Provider
+
+	// GetCredentialForRequest issues a credential for the given request
+	GetCredentialForRequest(request Request) (*proto.Credential, error)
+
+	// PerPrincipal reports whether the credential issued for the request is specific to the calling principal, if so
+	// it must not be shared with other clients matching the same ACL
+	PerPrincipal(request Request) bool
+}
+
+// ContextProvider is implemented by providers which make calls that should be abandoned when the client of the server
+// goes away, or the server stops
+type ContextProvider interface {
+	RequestProvider
+
+	// GetCredentialWithContext issues a credential for the given request, giving up once the context is done
+	GetCredentialWithContext(ctx context.Context, request Request) (*proto.Credential, error)
+}
+
+// FileMerger is implemented by providers whose files can be combined when more than one of their credentials is
+// written to the same path, rather than the last one written replacing the others
+type FileMerger interface {
+	// MergeFiles returns a single file containing the contents of both files
+	MergeFiles(existing, additional *proto.File) (*proto.File, error)
+}
+
+// Renewer is implemented by providers which can extend the lifetime of a credential they issued more cheaply than
+// issuing a new one
+type Renewer interface {
+	// Renew returns the credential with its lifetime extended. The credential must not be changed, as it may be held
+	// by the server. If renewal fails, the server issues a new credential instead.
+	Renew(request Request, credential *proto.Credential) (*proto.Credential, error)
+}
+
+// IssueObserver is implemented by providers which need to know when clients stop using a credential they issued, for
+// example to revoke it once it has been superseded. Clients are told when to renew a credential by the server, after
+// the provider has returned it.
+type IssueObserver interface {
+	// Issued is called with each credential issued or renewed by the provider, once the server has set its RenewAfter
+	Issued(request Request, credential *proto.Credential)
+}
+
+// OptionsValidator is implemented by providers which accept options on ACL credentials
+type OptionsValidator interface {
+	// ValidateOptions returns an error if the options are not understood by the provider
+	ValidateOptions(options map[string]string) error
+}
+
+// GetCredential issues a credential for the request, passing the context to providers which implement
+// ContextProvider, the full request to those which implement RequestProvider and only the object reference to the rest
+func GetCredential(ctx context.Context, p Provider, request Request) (*proto.Credential, error) {
+	if cp, ok := p.(ContextProvider); ok {
+		return cp.GetCredentialWithContext(ctx, request)
+	}
+	if rp, ok := p.(RequestProvider); ok {
+		return rp.GetCredentialForRequest(request)
+	}
+	return p.GetCredential(request.ObjectReference)
+}
+
+// PerPrincipal reports whether the credential issued by p for the request must be kept separate for each principal,
+// either because the ACL credential asks for per-principal issuance or because the provider requires it
+func PerPrincipal(p Provider, request Request) bool {
+	if request.Credential.Issuance == types.IssuancePerPrincipal {
+		return true
+	}
+	if rp, ok := p.(RequestProvider); ok {
+		return rp.PerPrincipal(request)
+	}
+	return false
+}
+
+// ValidateOptions checks the options of every ACL credential are accepted by its provider. Credentials for providers
+// which are not configured are skipped, as they are reported when requested.
+func ValidateOptions(acls []types.ACL, providers map[string]Provider) error {
+	var errs []string
+	for _, acl := range acls {
+		for _, credential := range acl.Credentials {
+			p, ok := providers[credential.Provider]
+			if !ok || len(credential.Options) == 0 {
+				continue
+			}
+			var err error
+			if ov, ok := p.(OptionsValidator); ok {
+				err = ov.ValidateOptions(credential.Options)
+			} else {
+				err = errors.New("provider does not accept options")
+			}
+			if err != nil {
+				name := fmt.Sprintf("%s/%s", credential.Provider, credential.ObjectReference)
+				errs = append(errs, fmt.Sprintf("principal %q credential %q: %s", acl.MatchPrincipal, name, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid credential options: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// ValidateIssuance checks that every ACL credential asking for per-principal issuance is for a provider which is told
+// the principal, so that it can issue a credential specific to it. Credentials for providers which are not configured
+// are skipped, as they are reported when requested.
+func ValidateIssuance(acls []types.ACL, providers map[string]Provider) error {
+	var errs []string
+	for _, acl := range acls {
+		for _, credential := range acl.Credentials {
+			p, ok := providers[credential.Provider]
+			if !ok || credential.Issuance != types.IssuancePerPrincipal {
+				continue
+			}
+			if _, ok := p.(RequestProvider); !ok {
+				name := fmt.Sprintf("%s/%s", credential.Provider, credential.ObjectReference)
+				errs = append(errs, fmt.Sprintf("principal %q credential %q: provider cannot issue per-principal credentials", acl.MatchPrincipal, name))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid credential issuance: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// FileOutput describes a file a provider writes, so that ACL credentials can refer to it by name when overriding
+// where it is written
+type FileOutput struct {
+	// Name is a short name for the file, such as "credentials"
+	Name string
+
+	// Path is the default path of the file, which may be a path.Match pattern when the path depends on the request
+	Path string
+}
+
+// OutputDescriber is implemented by providers which describe the files they write
+type OutputDescriber interface {
+	// FileOutputs lists the files the provider may write
+	FileOutputs() []FileOutput
+}
+
+// FileOutputs returns the files p describes, or nil if it does not implement OutputDescriber
+func FileOutputs(p Provider) []FileOutput {
+	if od, ok := p.(OutputDescriber); ok {
+		return od.FileOutputs()
+	}
+	return nil
+}
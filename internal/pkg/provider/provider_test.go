@@ -0,0 +1,89 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+func TestValidateOptions(t *testing.T) {
+	awsProvider, err := NewAWSSTSAssumeRoleProvider(context.Background(), AWSSTSAssumeRoleProviderOptions{
+		CredentialsOverride: credentials.NewStaticCredentials("foo", "bar", "baz"),
+	})
+	require.NoError(t, err)
+	providers := map[string]Provider{
+		awsProvider.Name():     &awsProvider,
+		"StaticSecretProvider": optionlessProvider{},
+	}
+
+	acls := []types.ACL{
+		{
+			MatchPrincipal: "spiffe://example.com/short",
+			Credentials: []types.Credential{
+				{Provider: "AWSSTSAssumeRoleProvider", ObjectReference: "role", Options: map[string]string{"duration": "15m"}},
+				{Provider: "StaticSecretProvider", ObjectReference: "secret"},
+				{Provider: "UnconfiguredProvider", ObjectReference: "ref", Options: map[string]string{"any": "thing"}},
+			},
+		},
+	}
+	assert.NoError(t, ValidateOptions(acls, providers))
+
+	acls = append(acls, types.ACL{
+		MatchPrincipal: "spiffe://example.com/invalid",
+		Credentials: []types.Credential{
+			{Provider: "AWSSTSAssumeRoleProvider", ObjectReference: "role", Options: map[string]string{"duration": "forever"}},
+			{Provider: "StaticSecretProvider", ObjectReference: "secret", Options: map[string]string{"mode": "0600"}},
+		},
+	})
+	assert.EqualError(t, ValidateOptions(acls, providers), `invalid credential options: `+
+		`principal "spiffe://example.com/invalid" credential "AWSSTSAssumeRoleProvider/role": duration "forever" is invalid: time: invalid duration "forever", `+
+		`principal "spiffe://example.com/invalid" credential "StaticSecretProvider/secret": provider does not accept options`)
+}
+
+func TestValidateIssuance(t *testing.T) {
+	mockProvider, err := NewMockProvider(MockProviderOptions{})
+	require.NoError(t, err)
+	providers := map[string]Provider{
+		mockProvider.Name():    &mockProvider,
+		"StaticSecretProvider": optionlessProvider{},
+	}
+
+	acls := []types.ACL{
+		{
+			MatchPrincipal: "spiffe://example.com/*",
+			Credentials: []types.Credential{
+				{Provider: "MockProvider", ObjectReference: "token", Issuance: types.IssuancePerPrincipal},
+				{Provider: "StaticSecretProvider", ObjectReference: "secret", Issuance: types.IssuanceShared},
+				{Provider: "UnconfiguredProvider", ObjectReference: "ref", Issuance: types.IssuancePerPrincipal},
+			},
+		},
+	}
+	assert.NoError(t, ValidateIssuance(acls, providers))
+
+	// providers which are only given the object reference would hand every principal an equivalent credential
+	acls = append(acls, types.ACL{
+		MatchPrincipal: "spiffe://example.com/invalid",
+		Credentials: []types.Credential{
+			{Provider: "StaticSecretProvider", ObjectReference: "secret", Issuance: types.IssuancePerPrincipal},
+		},
+	})
+	assert.EqualError(t, ValidateIssuance(acls, providers), `invalid credential issuance: `+
+		`principal "spiffe://example.com/invalid" credential "StaticSecretProvider/secret": provider cannot issue per-principal credentials`)
+}
+
+// optionlessProvider is a provider which does not implement OptionsValidator
+type optionlessProvider struct{}
+
+func (optionlessProvider) Name() string { return "StaticSecretProvider" }
+
+func (optionlessProvider) Ping() error { return nil }
+
+func (optionlessProvider) GetCredential(string) (*proto.Credential, error) {
+	return &proto.Credential{}, nil
+}
@@ -0,0 +1,199 @@
+package provider
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+)
+
+// SSHUserCertificateProviderOptions are the options available to configure a SSHUserCertificateProvider
+type SSHUserCertificateProviderOptions struct {
+	// CAKey is the signer used to sign user certificates, if not set the CA key is loaded from CAKeyFile
+	CAKey ssh.Signer
+
+	// CAKeyFile is the path to an unencrypted private key in a format understood by ssh-keygen, used when CAKey is
+	// not set. RSA keys sign certificates with rsa-sha2-512.
+	CAKeyFile string
+
+	// Duration is how long issued certificates will be valid for, defaults to 1hr
+	Duration time.Duration
+}
+
+// SSHUserCertificateProvider is a provider which issues short lived OpenSSH user certificates signed by a local CA
+type SSHUserCertificateProvider struct {
+	caKey    ssh.Signer
+	duration time.Duration
+}
+
+// NewSSHUserCertificateProvider will configure a new SSHUserCertificateProvider using the supplied options
+func NewSSHUserCertificateProvider(options SSHUserCertificateProviderOptions) (SSHUserCertificateProvider, error) {
+	caKey := options.CAKey
+	if caKey == nil {
+		if options.CAKeyFile == "" {
+			return SSHUserCertificateProvider{}, errors.New("one of CA key or CA key file must be set")
+		}
+		pemBytes, err := os.ReadFile(options.CAKeyFile)
+		if err != nil {
+			return SSHUserCertificateProvider{}, fmt.Errorf("failed to read CA key file: %w", err)
+		}
+		caKey, err = ssh.ParsePrivateKey(pemBytes)
+		if err != nil {
+			return SSHUserCertificateProvider{}, fmt.Errorf("failed to parse CA key file: %w", err)
+		}
+	}
+
+	// RSA keys sign with SHA-1 by default, which OpenSSH 8.2 and later refuse for certificates
+	if caKey.PublicKey().Type() == ssh.KeyAlgoRSA {
+		algorithmSigner, ok := caKey.(ssh.AlgorithmSigner)
+		if !ok {
+			return SSHUserCertificateProvider{}, errors.New("RSA CA key must support rsa-sha2 signatures")
+		}
+		caKey = rsaSHA2Signer{algorithmSigner}
+	}
+
+	duration := time.Hour
+	if options.Duration > 0 {
+		duration = options.Duration
+	}
+
+	return SSHUserCertificateProvider{
+		caKey:    caKey,
+		duration: duration,
+	}, nil
+}
+
+// rsaSHA2Signer signs with rsa-sha2-512, as ssh-keygen does, rather than ssh-rsa
+type rsaSHA2Signer struct {
+	ssh.AlgorithmSigner
+}
+
+func (s rsaSHA2Signer) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, ssh.SigAlgoRSASHA2512)
+}
+
+// Name returns the name of the provider
+func (p *SSHUserCertificateProvider) Name() string {
+	return "SSHUserCertificateProvider"
+}
+
+// FileOutputs describes the key pair and certificate files
+func (p *SSHUserCertificateProvider) FileOutputs() []FileOutput {
+	return []FileOutput{
+		{Name: "private_key", Path: "~/.ssh/id_ecdsa"},
+		{Name: "public_key", Path: "~/.ssh/id_ecdsa.pub"},
+		{Name: "certificate", Path: "~/.ssh/id_ecdsa-cert.pub"},
+	}
+}
+
+// Ping always succeeds as certificates are signed locally
+func (p *SSHUserCertificateProvider) Ping() error {
+	return nil
+}
+
+// GetCredential is not supported, since the key ID of each certificate is the SPIFFE ID of the caller
+func (p *SSHUserCertificateProvider) GetCredential(objectReference string) (*proto.Credential, error) {
+	return &proto.Credential{}, errors.New("SSH user certificates can only be issued for a known principal")
+}
+
+// PerPrincipal is always true, each certificate names the principal it was issued to
+func (p *SSHUserCertificateProvider) PerPrincipal(request Request) bool {
+	return true
+}
+
+// GetCredentialForRequest generates a new keypair and signs a user certificate for it. The objectReference is a comma
+// separated list of the principals (usernames) the certificate is valid for and the key ID is the caller's SPIFFE ID.
+func (p *SSHUserCertificateProvider) GetCredentialForRequest(request Request) (*proto.Credential, error) {
+	if request.Principal.IsZero() {
+		return &proto.Credential{}, errors.New("SSH user certificates can only be issued for a known principal")
+	}
+
+	var principals []string
+	for _, principal := range strings.Split(request.ObjectReference, ",") {
+		if principal = strings.TrimSpace(principal); principal != "" {
+			principals = append(principals, principal)
+		}
+	}
+	if len(principals) == 0 {
+		return &proto.Credential{}, errors.New("object reference must contain at least one SSH principal")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to create SSH public key: %w", err)
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to generate serial: %w", err)
+	}
+
+	// backdate the start of the validity period slightly to allow for clock skew between hosts
+	now := time.Now()
+	notAfter := now.Add(p.duration)
+	certificate := &ssh.Certificate{
+		Key:             publicKey,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           request.Principal.String(),
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(notAfter.Unix()),
+		Permissions: ssh.Permissions{
+			// these match the defaults used by ssh-keygen when signing user certificates
+			Extensions: map[string]string{
+				"permit-X11-forwarding":   "",
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-pty":              "",
+				"permit-user-rc":          "",
+			},
+		},
+	}
+	if err := certificate.SignCert(rand.Reader, p.caKey); err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+
+	return &proto.Credential{
+		NotAfter: timestamppb.New(time.Unix(int64(certificate.ValidBefore), 0)),
+		Files: []*proto.File{
+			{
+				Path:     "~/.ssh/id_ecdsa",
+				Mode:     0600,
+				Contents: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}),
+			},
+			{
+				Path:     "~/.ssh/id_ecdsa.pub",
+				Mode:     0644,
+				Contents: ssh.MarshalAuthorizedKey(publicKey),
+			},
+			{
+				Path:     "~/.ssh/id_ecdsa-cert.pub",
+				Mode:     0644,
+				Contents: ssh.MarshalAuthorizedKey(certificate),
+			},
+		},
+	}, nil
+}
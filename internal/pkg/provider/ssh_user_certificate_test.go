@@ -0,0 +1,140 @@
+package provider
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSSHCA(t *testing.T, rsaKey bool) ssh.Signer {
+	var caKey interface{}
+	var err error
+	if rsaKey {
+		caKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		_, caKey, err = ed25519.GenerateKey(rand.Reader)
+	}
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+	return signer
+}
+
+func TestNewSSHUserCertificateProvider(t *testing.T) {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	caKeyBytes, err := x509.MarshalPKCS8PrivateKey(caKey)
+	require.NoError(t, err)
+
+	caKeyFile := filepath.Join(t.TempDir(), "ca")
+	require.NoError(t, os.WriteFile(caKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: caKeyBytes}), 0600))
+
+	p, err := NewSSHUserCertificateProvider(SSHUserCertificateProviderOptions{CAKeyFile: caKeyFile})
+	require.NoError(t, err)
+	assert.Equal(t, "SSHUserCertificateProvider", p.Name())
+	assert.NoError(t, p.Ping())
+
+	_, err = NewSSHUserCertificateProvider(SSHUserCertificateProviderOptions{})
+	assert.EqualError(t, err, "one of CA key or CA key file must be set")
+
+	_, err = NewSSHUserCertificateProvider(SSHUserCertificateProviderOptions{CAKeyFile: filepath.Join(t.TempDir(), "missing")})
+	assert.ErrorContains(t, err, "failed to read CA key file")
+}
+
+func TestSSHUserCertificateProvider_GetCredentialForRequest(t *testing.T) {
+	ca := newTestSSHCA(t, false)
+	rsaCA := newTestSSHCA(t, true)
+	principal := spiffeid.RequireFromString("spiffe://example.com/ci/deployer")
+
+	testCases := map[string]struct {
+		rsaCA              bool
+		request            Request
+		expectedError      error
+		expectedPrincipals []string
+	}{
+		"single principal": {
+			request:            Request{ObjectReference: "deploy", Principal: principal},
+			expectedPrincipals: []string{"deploy"},
+		},
+		"multiple principals": {
+			request:            Request{ObjectReference: "deploy, backup", Principal: principal},
+			expectedPrincipals: []string{"deploy", "backup"},
+		},
+		"RSA CA": {
+			rsaCA:              true,
+			request:            Request{ObjectReference: "deploy", Principal: principal},
+			expectedPrincipals: []string{"deploy"},
+		},
+		"no principals": {
+			request:       Request{ObjectReference: " , ", Principal: principal},
+			expectedError: errors.New("object reference must contain at least one SSH principal"),
+		},
+		"no caller": {
+			request:       Request{ObjectReference: "deploy"},
+			expectedError: errors.New("SSH user certificates can only be issued for a known principal"),
+		},
+	}
+
+	for testName, testCase := range testCases {
+		ca := ca
+		expectedSignature := ssh.KeyAlgoED25519
+		if testCase.rsaCA {
+			// OpenSSH 8.2 and later refuse ssh-rsa signatures on certificates
+			ca, expectedSignature = rsaCA, ssh.SigAlgoRSASHA2512
+		}
+		p, err := NewSSHUserCertificateProvider(SSHUserCertificateProviderOptions{CAKey: ca, Duration: 10 * time.Minute})
+		require.NoError(t, err)
+
+		t.Run(testName, func(t *testing.T) {
+			cred, err := p.GetCredentialForRequest(testCase.request)
+			if testCase.expectedError != nil {
+				assert.EqualError(t, err, testCase.expectedError.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, cred.Files, 3)
+
+			assert.Equal(t, "~/.ssh/id_ecdsa", cred.Files[0].Path)
+			assert.Equal(t, uint32(0600), cred.Files[0].Mode)
+			key, err := ssh.ParsePrivateKey(cred.Files[0].Contents)
+			require.NoError(t, err)
+
+			assert.Equal(t, "~/.ssh/id_ecdsa-cert.pub", cred.Files[2].Path)
+			parsed, _, _, _, err := ssh.ParseAuthorizedKey(cred.Files[2].Contents)
+			require.NoError(t, err)
+			cert, ok := parsed.(*ssh.Certificate)
+			require.True(t, ok, "expected an SSH certificate")
+
+			assert.Equal(t, key.PublicKey().Marshal(), cert.Key.Marshal())
+			assert.Equal(t, uint32(ssh.UserCert), cert.CertType)
+			assert.Equal(t, expectedSignature, cert.Signature.Format)
+			assert.Equal(t, principal.String(), cert.KeyId)
+			assert.Equal(t, testCase.expectedPrincipals, cert.ValidPrincipals)
+			assert.Equal(t, int64(cert.ValidBefore), cred.NotAfter.AsTime().Unix())
+			assert.WithinDuration(t, time.Now().Add(10*time.Minute), cred.NotAfter.AsTime(), 5*time.Second)
+
+			// the certificate must be accepted by a host trusting the CA for each of the requested principals
+			checker := ssh.CertChecker{
+				IsUserAuthority: func(auth ssh.PublicKey) bool {
+					return string(auth.Marshal()) == string(ca.PublicKey().Marshal())
+				},
+			}
+			for _, p := range testCase.expectedPrincipals {
+				assert.NoError(t, checker.CheckCert(p, cert))
+			}
+			assert.Error(t, checker.CheckCert("root", cert))
+		})
+	}
+}
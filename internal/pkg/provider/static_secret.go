@@ -0,0 +1,311 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/config"
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+)
+
+// StaticSecretProviderOptions are the options available to configure a StaticSecretProvider
+type StaticSecretProviderOptions struct {
+	// Root is the directory secrets are served from, object references are relative to it
+	Root string
+
+	// TargetDir is the directory on the client secret files are written to, defaults to
+	// ~/.config/spiffe-connector/secrets
+	TargetDir string
+
+	// RefreshInterval is used as the lifetime of returned credentials, so that clients fetch them again and pick up
+	// any changes. Defaults to 5m.
+	RefreshInterval time.Duration
+}
+
+// StaticSecretProvider is a provider which hands out the contents of files on the server's filesystem, for secrets
+// that have no dynamic issuer such as API keys and license files
+type StaticSecretProvider struct {
+	root            string
+	targetDir       string
+	refreshInterval time.Duration
+
+	watches *staticSecretWatches
+
+	// generation is incremented each time the cache is cleared, so that secrets read from disk before then are not
+	// stored afterwards
+	mu         *sync.RWMutex
+	generation *uint64
+	cache      map[string][]*proto.File
+}
+
+// NewStaticSecretProvider will configure a new StaticSecretProvider using the supplied options. The root directory is
+// watched for changes until the context is cancelled.
+func NewStaticSecretProvider(ctx context.Context, options StaticSecretProviderOptions) (StaticSecretProvider, error) {
+	if options.Root == "" {
+		return StaticSecretProvider{}, errors.New("root must be set")
+	}
+	// symlinks are resolved so that the traversal check compares real paths, Kubernetes secret volumes are made of them
+	root, err := filepath.EvalSymlinks(options.Root)
+	if err != nil {
+		return StaticSecretProvider{}, fmt.Errorf("failed to resolve root: %w", err)
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return StaticSecretProvider{}, fmt.Errorf("failed to resolve root: %w", err)
+	}
+
+	p := StaticSecretProvider{
+		root:            root,
+		targetDir:       "~/.config/spiffe-connector/secrets",
+		refreshInterval: 5 * time.Minute,
+		watches:         &staticSecretWatches{ctx: ctx, dirs: make(map[string]*config.Watcher)},
+		mu:              &sync.RWMutex{},
+		generation:      new(uint64),
+		cache:           make(map[string][]*proto.File),
+	}
+	if options.TargetDir != "" {
+		p.targetDir = options.TargetDir
+	}
+	if options.RefreshInterval > 0 {
+		p.refreshInterval = options.RefreshInterval
+	}
+
+	if err := p.watchDirs(); err != nil {
+		return StaticSecretProvider{}, fmt.Errorf("failed to watch root: %w", err)
+	}
+
+	return p, nil
+}
+
+// Name returns the name of the provider
+func (p *StaticSecretProvider) Name() string {
+	return "StaticSecretProvider"
+}
+
+// Ping checks the root directory is still readable
+func (p *StaticSecretProvider) Ping() error {
+	if _, err := os.ReadDir(p.root); err != nil {
+		return fmt.Errorf("provider ping failed: %w", err)
+	}
+	return nil
+}
+
+// GetCredential returns the file, or every file in the directory, at objectReference relative to the root. Files are
+// written to the target directory on the client, keeping their path relative to the referenced directory.
+func (p *StaticSecretProvider) GetCredential(objectReference string) (*proto.Credential, error) {
+	p.mu.RLock()
+	files, ok := p.cache[objectReference]
+	generation := *p.generation
+	p.mu.RUnlock()
+
+	if !ok {
+		var err error
+		files, err = p.readSecret(objectReference)
+		if err != nil {
+			return &proto.Credential{}, err
+		}
+		p.mu.Lock()
+		// the secret may have changed while it was read, in which case it is read again on the next request
+		if *p.generation == generation {
+			p.cache[objectReference] = files
+		}
+		p.mu.Unlock()
+	}
+
+	return &proto.Credential{
+		NotAfter: timestamppb.New(time.Now().Add(p.refreshInterval)),
+		Files:    files,
+	}, nil
+}
+
+// staticSecretWatches holds the watcher of each directory under the root, shared by the copies of the provider
+type staticSecretWatches struct {
+	ctx context.Context
+
+	mu   sync.Mutex
+	dirs map[string]*config.Watcher
+}
+
+// watchDirs watches every directory under the root which is not watched yet. fsnotify does not watch recursively, so
+// each directory gets a watcher, and directories created later are found when the watcher on their parent runs. Hidden
+// Kubernetes secret volume directories are replaced rather than changed, which is seen by the watcher on their parent.
+// The watcher of a directory stops when it is removed, and is forgotten so that the directory is watched again if it
+// is created again.
+func (p *StaticSecretProvider) watchDirs() error {
+	p.watches.mu.Lock()
+	defer p.watches.mu.Unlock()
+
+	return filepath.WalkDir(p.root, func(dir string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), "..") {
+			return filepath.SkipDir
+		}
+		if _, ok := p.watches.dirs[dir]; ok {
+			return nil
+		}
+		w, err := config.NewDirectoryWatcher(p.watches.ctx, dir, p.reload)
+		if err != nil {
+			return err
+		}
+		p.watches.dirs[dir] = w
+		go p.forget(dir, w)
+		return nil
+	})
+}
+
+// forget waits for the watcher of dir to stop, then drops it. If the directory was removed rather than the provider
+// stopped, the root is walked again in case it has already been created again.
+func (p *StaticSecretProvider) forget(dir string, w *config.Watcher) {
+	<-w.Done()
+
+	p.watches.mu.Lock()
+	if p.watches.dirs[dir] == w {
+		delete(p.watches.dirs, dir)
+	}
+	p.watches.mu.Unlock()
+
+	if p.watches.ctx.Err() != nil {
+		return
+	}
+	if err := p.reload(); err != nil {
+		log.Printf("error while reloading static secrets after %s was removed (%s)", dir, err.Error())
+	}
+}
+
+// reload is run when a watched directory changes. The cached secrets are cleared, and any new directories watched.
+func (p *StaticSecretProvider) reload() error {
+	if err := p.invalidate(); err != nil {
+		return err
+	}
+	if err := p.watchDirs(); err != nil {
+		return fmt.Errorf("failed to watch new directories: %w", err)
+	}
+	return nil
+}
+
+// invalidate clears the cached secrets so they are read from disk again on the next request
+func (p *StaticSecretProvider) invalidate() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// entries are deleted rather than replacing the map, as the provider is returned by value from its constructor
+	*p.generation++
+	for objectReference := range p.cache {
+		delete(p.cache, objectReference)
+	}
+	return nil
+}
+
+func (p *StaticSecretProvider) readSecret(objectReference string) ([]*proto.File, error) {
+	secretPath, err := p.resolve(objectReference)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(secretPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret %q: %w", objectReference, err)
+	}
+	if !info.IsDir() {
+		contents, err := os.ReadFile(secretPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret %q: %w", objectReference, err)
+		}
+		return []*proto.File{{
+			Path:     path.Join(p.targetDir, filepath.Base(secretPath)),
+			Mode:     0600,
+			Contents: contents,
+		}}, nil
+	}
+
+	var files []*proto.File
+	err = filepath.WalkDir(secretPath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Kubernetes keeps the real contents of secret volumes in hidden ..data directories, which the visible files
+		// are symlinks into
+		if strings.HasPrefix(d.Name(), "..") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		resolved, err := p.resolve(filepath.Join(objectReference, strings.TrimPrefix(filePath, secretPath)))
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(resolved)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		contents, err := os.ReadFile(resolved)
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(secretPath, filePath)
+		if err != nil {
+			return err
+		}
+		files = append(files, &proto.File{
+			Path:     path.Join(p.targetDir, filepath.ToSlash(relative)),
+			Mode:     0600,
+			Contents: contents,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret %q: %w", objectReference, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("secret %q contains no files", objectReference)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	return files, nil
+}
+
+// resolve returns the real path of objectReference, refusing any reference which would leave the root
+func (p *StaticSecretProvider) resolve(objectReference string) (string, error) {
+	if objectReference == "" || filepath.IsAbs(objectReference) {
+		return "", fmt.Errorf("secret %q must be a relative path", objectReference)
+	}
+	for _, segment := range strings.Split(filepath.ToSlash(objectReference), "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("secret %q must not contain path traversal", objectReference)
+		}
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(p.root, objectReference))
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %q: %w", objectReference, err)
+	}
+	if resolved != p.root && !strings.HasPrefix(resolved, p.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("secret %q resolves outside of the root", objectReference)
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,216 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/config"
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+)
+
+// stopWatching cancels the watchers of the provider and waits for them to stop before the temporary directories they
+// watch are removed
+func stopWatching(cancel context.CancelFunc, p *StaticSecretProvider) {
+	cancel()
+	p.watches.mu.Lock()
+	watchers := make([]*config.Watcher, 0, len(p.watches.dirs))
+	for _, w := range p.watches.dirs {
+		watchers = append(watchers, w)
+	}
+	p.watches.mu.Unlock()
+	for _, w := range watchers {
+		<-w.Done()
+	}
+}
+
+// watcher returns the watcher of dir, nil if it is not watched
+func (w *staticSecretWatches) watcher(dir string) *config.Watcher {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dirs[dir]
+}
+
+func TestStaticSecretProvider_GetCredential(t *testing.T) {
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "shadow"), []byte("outside"), 0600))
+
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "license.key"), []byte("license"), 0600))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "payments", "nested"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "payments", "api-key"), []byte("api key"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "payments", "nested", "token"), []byte("token"), 0600))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "shadow"), filepath.Join(root, "escape")))
+
+	// mimic the layout of a Kubernetes secret volume
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "mounted", "..2022_04_20"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "mounted", "..2022_04_20", "password"), []byte("hunter2"), 0600))
+	require.NoError(t, os.Symlink("..2022_04_20", filepath.Join(root, "mounted", "..data")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "password"), filepath.Join(root, "mounted", "password")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err := NewStaticSecretProvider(ctx, StaticSecretProviderOptions{Root: root, RefreshInterval: time.Minute})
+	require.NoError(t, err)
+	t.Cleanup(func() { stopWatching(cancel, &p) })
+	assert.Equal(t, "StaticSecretProvider", p.Name())
+	assert.NoError(t, p.Ping())
+
+	testCases := map[string]struct {
+		objectReference string
+		expectedFiles   []*proto.File
+		expectedError   error
+	}{
+		"single file": {
+			objectReference: "license.key",
+			expectedFiles: []*proto.File{
+				{Path: "~/.config/spiffe-connector/secrets/license.key", Mode: 0600, Contents: []byte("license")},
+			},
+		},
+		"directory": {
+			objectReference: "payments",
+			expectedFiles: []*proto.File{
+				{Path: "~/.config/spiffe-connector/secrets/api-key", Mode: 0600, Contents: []byte("api key")},
+				{Path: "~/.config/spiffe-connector/secrets/nested/token", Mode: 0600, Contents: []byte("token")},
+			},
+		},
+		"kubernetes secret volume": {
+			objectReference: "mounted",
+			expectedFiles: []*proto.File{
+				{Path: "~/.config/spiffe-connector/secrets/password", Mode: 0600, Contents: []byte("hunter2")},
+			},
+		},
+		"parent traversal": {
+			objectReference: "payments/../../etc/passwd",
+			expectedError:   errors.New(`secret "payments/../../etc/passwd" must not contain path traversal`),
+		},
+		"absolute path": {
+			objectReference: "/etc/passwd",
+			expectedError:   errors.New(`secret "/etc/passwd" must be a relative path`),
+		},
+		"symlink out of root": {
+			objectReference: "escape",
+			expectedError:   errors.New(`secret "escape" resolves outside of the root`),
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			cred, err := p.GetCredential(testCase.objectReference)
+			if testCase.expectedError != nil {
+				assert.EqualError(t, err, testCase.expectedError.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectedFiles, cred.Files)
+			assert.WithinDuration(t, time.Now().Add(time.Minute), cred.NotAfter.AsTime(), 5*time.Second)
+		})
+	}
+}
+
+func TestStaticSecretProvider_Reload(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "api-key"), []byte("v1"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err := NewStaticSecretProvider(ctx, StaticSecretProviderOptions{Root: root})
+	require.NoError(t, err)
+	t.Cleanup(func() { stopWatching(cancel, &p) })
+
+	cred, err := p.GetCredential("api-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v1"), cred.Files[0].Contents)
+
+	// until the watcher runs, the cached contents are served
+	require.NoError(t, os.WriteFile(filepath.Join(root, "api-key"), []byte("v2"), 0600))
+	cred, err = p.GetCredential("api-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v1"), cred.Files[0].Contents)
+
+	p.watches.watcher(p.root).Notify()
+	assert.Eventually(t, func() bool {
+		cred, err := p.GetCredential("api-key")
+		return err == nil && string(cred.Files[0].Contents) == "v2"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestStaticSecretProvider_NewDirectory(t *testing.T) {
+	root := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err := NewStaticSecretProvider(ctx, StaticSecretProviderOptions{Root: root})
+	require.NoError(t, err)
+	t.Cleanup(func() { stopWatching(cancel, &p) })
+
+	// a directory created after the provider started is watched once the watcher of its parent runs
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "payments"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "payments", "api-key"), []byte("v1"), 0600))
+	p.watches.watcher(p.root).Notify()
+	require.Eventually(t, func() bool {
+		return p.watches.watcher(filepath.Join(p.root, "payments")) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cred, err := p.GetCredential("payments")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v1"), cred.Files[0].Contents)
+
+	// changes in it are then picked up without waiting for the refresh interval
+	require.NoError(t, os.WriteFile(filepath.Join(root, "payments", "api-key"), []byte("v2"), 0600))
+	assert.Eventually(t, func() bool {
+		cred, err := p.GetCredential("payments")
+		return err == nil && string(cred.Files[0].Contents) == "v2"
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+func TestStaticSecretProvider_RemovedDirectory(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "payments"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "payments", "api-key"), []byte("v1"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err := NewStaticSecretProvider(ctx, StaticSecretProviderOptions{Root: root})
+	require.NoError(t, err)
+	t.Cleanup(func() { stopWatching(cancel, &p) })
+
+	dir := filepath.Join(p.root, "payments")
+	w := p.watches.watcher(dir)
+	require.NotNil(t, w)
+	cred, err := p.GetCredential("payments")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v1"), cred.Files[0].Contents)
+
+	// removing a watched directory stops its watcher, rather than the server
+	require.NoError(t, os.RemoveAll(dir))
+	select {
+	case <-w.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher of removed directory did not stop")
+	}
+	require.Eventually(t, func() bool {
+		return p.watches.watcher(dir) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = p.GetCredential("payments")
+	assert.Error(t, err)
+
+	// a directory created again is watched again
+	require.NoError(t, os.MkdirAll(dir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "api-key"), []byte("v2"), 0600))
+	p.watches.watcher(p.root).Notify()
+	require.Eventually(t, func() bool {
+		return p.watches.watcher(dir) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	cred, err = p.GetCredential("payments")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v2"), cred.Files[0].Contents)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "api-key"), []byte("v3"), 0600))
+	assert.Eventually(t, func() bool {
+		cred, err := p.GetCredential("payments")
+		return err == nil && string(cred.Files[0].Contents) == "v3"
+	}, 10*time.Second, 50*time.Millisecond)
+}
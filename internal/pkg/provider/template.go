@@ -0,0 +1,70 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateData is the data available to templates rendered for a request, such as certificate subjects
+type templateData struct {
+	// SpiffeID is the full SPIFFE ID of the caller
+	SpiffeID string
+	// TrustDomain is the trust domain of the caller
+	TrustDomain string
+	// Path is the path component of the caller's SPIFFE ID, including the leading slash
+	Path string
+	// PathSegments are the individual segments of Path, so that {{ index .PathSegments 0 }} is the first segment
+	PathSegments []string
+	// ACL is the match_principal of the ACL the request matched
+	ACL string
+	// Now is the time the credential is being issued
+	Now time.Time
+}
+
+func newTemplateData(request Request, now time.Time) templateData {
+	data := templateData{
+		ACL: request.MatchPrincipal,
+		Now: now,
+	}
+	if request.Principal.IsZero() {
+		return data
+	}
+
+	data.SpiffeID = request.Principal.String()
+	data.TrustDomain = request.Principal.TrustDomain().String()
+	data.Path = request.Principal.Path()
+	if trimmed := strings.TrimPrefix(data.Path, "/"); trimmed != "" {
+		data.PathSegments = strings.Split(trimmed, "/")
+	}
+
+	return data
+}
+
+// isTemplate reports whether the text contains template actions, and so may render differently for each caller
+func isTemplate(text string) bool {
+	return strings.Contains(text, "{{")
+}
+
+// renderTemplate renders text as a text/template using details of the caller from the request
+func renderTemplate(name, text string, request Request) (string, error) {
+	if !isTemplate(text) {
+		return text, nil
+	}
+	return executeTemplate(name, text, newTemplateData(request, time.Now()))
+}
+
+func executeTemplate(name, text string, data templateData) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s template: %w", name, err)
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("failed to render %s template: %w", name, err)
+	}
+
+	return rendered.String(), nil
+}
@@ -0,0 +1,383 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/config"
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+)
+
+// WebhookSignatureHeader is the header containing a JWS with detached payload, signed by the connector's SVID key,
+// over the body of each webhook request
+const WebhookSignatureHeader = "X-Spiffe-Connector-Signature"
+
+// WebhookIdempotencyKeyHeader is the header containing a random key which is the same on each attempt at a request, so
+// that the webhook can avoid issuing more than one credential when a request it handled is retried
+const WebhookIdempotencyKeyHeader = "Idempotency-Key"
+
+// WebhookRequest is the JSON body POSTed to the webhook
+type WebhookRequest struct {
+	// ObjectReference is the object reference from the ACL credential
+	ObjectReference string `json:"object_reference"`
+	// Principal is the SPIFFE ID of the workload the credential is for
+	Principal string `json:"principal"`
+	// MatchPrincipal is the match_principal of the ACL which granted the credential
+	MatchPrincipal string `json:"match_principal"`
+	// Timestamp is when the request was made, to allow the webhook to reject replayed requests
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// WebhookResponse is the JSON body the webhook must respond with. At least one of the credential fields must be set.
+type WebhookResponse struct {
+	Files    []WebhookFile     `json:"files,omitempty"`
+	EnvVars  map[string]string `json:"env_vars,omitempty"`
+	Username string            `json:"username,omitempty"`
+	Password string            `json:"password,omitempty"`
+	Token    string            `json:"token,omitempty"`
+	// NotAfter is when the credential expires, in RFC 3339 format. Credentials without an expiry are fetched again on
+	// every request.
+	NotAfter *time.Time `json:"not_after,omitempty"`
+}
+
+// WebhookFile is a file to be written by the client
+type WebhookFile struct {
+	Path string `json:"path"`
+	Mode uint32 `json:"mode"`
+	// Contents is base64 encoded
+	Contents []byte `json:"contents"`
+}
+
+// WebhookProviderOptions are the options available to configure a WebhookProvider
+type WebhookProviderOptions struct {
+	// URL is the https endpoint requests are POSTed to
+	URL string
+
+	// ServerSPIFFEID is the SPIFFE ID the webhook must present, if empty any SVID trusted by the connector is accepted
+	ServerSPIFFEID string
+
+	// SVIDSource and BundleSource are used to establish mTLS with the webhook, they default to the connector's current
+	// SPIFFE source
+	SVIDSource   x509svid.Source
+	BundleSource x509bundle.Source
+
+	// Timeout is the limit for each attempt, defaults to 10s
+	Timeout time.Duration
+
+	// Retries is how many times a failed request is retried, defaults to 2 if nil. Only connection errors, 429 and 503
+	// responses are retried, as the webhook may have issued a credential before failing in other ways.
+	Retries *int
+
+	// RetryBackoff is the delay before the first retry, it is doubled on each following attempt. Defaults to 500ms.
+	RetryBackoff time.Duration
+}
+
+// WebhookProvider is a provider which obtains credentials from a bespoke issuer over HTTP
+type WebhookProvider struct {
+	url          string
+	pingHost     string
+	client       *http.Client
+	svidSource   x509svid.Source
+	retries      int
+	retryBackoff time.Duration
+}
+
+// NewWebhookProvider will configure a new WebhookProvider using the supplied options
+func NewWebhookProvider(options WebhookProviderOptions) (WebhookProvider, error) {
+	ep, err := url.Parse(options.URL)
+	if err != nil {
+		return WebhookProvider{}, fmt.Errorf("failed to parse supplied URL: %w", err)
+	}
+	if ep.Scheme != "https" {
+		return WebhookProvider{}, fmt.Errorf("supplied URL value should have https scheme: %q", options.URL)
+	}
+	if ep.Host == "" {
+		return WebhookProvider{}, fmt.Errorf("supplied URL value should have host set")
+	}
+	pingHost := ep.Host
+	if ep.Port() == "" {
+		pingHost = fmt.Sprintf("%s:https", ep.Host)
+	}
+
+	authorizer := tlsconfig.AuthorizeAny()
+	if options.ServerSPIFFEID != "" {
+		id, err := spiffeid.FromString(options.ServerSPIFFEID)
+		if err != nil {
+			return WebhookProvider{}, fmt.Errorf("provided server SPIFFE ID is invalid: %w", err)
+		}
+		authorizer = tlsconfig.AuthorizeID(id)
+	}
+
+	var svidSource x509svid.Source = config.CurrentSource
+	if options.SVIDSource != nil {
+		svidSource = options.SVIDSource
+	}
+	var bundleSource x509bundle.Source = config.CurrentSource
+	if options.BundleSource != nil {
+		bundleSource = options.BundleSource
+	}
+
+	p := WebhookProvider{
+		url:      options.URL,
+		pingHost: pingHost,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: tlsconfig.MTLSClientConfig(svidSource, bundleSource, authorizer),
+			},
+		},
+		svidSource:   svidSource,
+		retries:      2,
+		retryBackoff: 500 * time.Millisecond,
+	}
+	if options.Timeout > 0 {
+		p.client.Timeout = options.Timeout
+	}
+	if options.Retries != nil {
+		if *options.Retries < 0 {
+			return WebhookProvider{}, errors.New("retries cannot be negative")
+		}
+		p.retries = *options.Retries
+	}
+	if options.RetryBackoff > 0 {
+		p.retryBackoff = options.RetryBackoff
+	}
+
+	return p, nil
+}
+
+// Name returns the name of the provider
+func (p *WebhookProvider) Name() string {
+	return "WebhookProvider"
+}
+
+// Ping tests the webhook is reachable
+// Note: this does not test mTLS or authz
+func (p *WebhookProvider) Ping() error {
+	_, err := net.DialTimeout("tcp", p.pingHost, time.Second*3)
+
+	if err != nil {
+		return fmt.Errorf("provider ping failed: %w", err)
+	}
+
+	return nil
+}
+
+// GetCredential is not supported, the webhook is always told who the credential is for
+func (p *WebhookProvider) GetCredential(objectReference string) (*proto.Credential, error) {
+	return &proto.Credential{}, errors.New("webhook credentials can only be requested for a known principal")
+}
+
+// PerPrincipal is always true, as the webhook may issue a different credential for each caller
+func (p *WebhookProvider) PerPrincipal(request Request) bool {
+	return true
+}
+
+// GetCredentialForRequest is GetCredentialWithContext, without a deadline beyond the timeout of each attempt
+func (p *WebhookProvider) GetCredentialForRequest(request Request) (*proto.Credential, error) {
+	return p.GetCredentialWithContext(context.Background(), request)
+}
+
+// GetCredentialWithContext POSTs a signed WebhookRequest to the webhook and converts the WebhookResponse to a
+// credential. Attempts and the backoff between them are abandoned once the context is done.
+func (p *WebhookProvider) GetCredentialWithContext(ctx context.Context, request Request) (*proto.Credential, error) {
+	if request.Principal.IsZero() {
+		return &proto.Credential{}, errors.New("webhook credentials can only be requested for a known principal")
+	}
+
+	body, err := json.Marshal(WebhookRequest{
+		ObjectReference: request.ObjectReference,
+		Principal:       request.Principal.String(),
+		MatchPrincipal:  request.MatchPrincipal,
+		Timestamp:       time.Now().UTC(),
+	})
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to marshal webhook request: %w", err)
+	}
+	signature, err := p.sign(body)
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to sign webhook request: %w", err)
+	}
+	idempotencyKey, err := newIdempotencyKey()
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to generate idempotency key: %w", err)
+	}
+
+	var response *WebhookResponse
+	backoff := p.retryBackoff
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		response, retryable, err = p.post(ctx, body, signature, idempotencyKey)
+		if err == nil || !retryable || attempt >= p.retries {
+			break
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return &proto.Credential{}, fmt.Errorf("failed to get credential from webhook: %s: %w", err, ctx.Err())
+		case <-t.C:
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to get credential from webhook: %w", err)
+	}
+
+	if err := response.validate(); err != nil {
+		return &proto.Credential{}, fmt.Errorf("webhook response is invalid: %w", err)
+	}
+
+	return response.credential(), nil
+}
+
+// post makes a single attempt at the webhook request, reporting whether any error is worth retrying
+func (p *WebhookProvider) post(ctx context.Context, body []byte, signature, idempotencyKey string) (*WebhookResponse, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, signature)
+	req.Header.Set(WebhookIdempotencyKeyHeader, idempotencyKey)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// include the start of the body, webhooks often explain the failure there
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		// other errors may come from a webhook which has already issued the credential
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+		return nil, retryable, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+
+	var response WebhookResponse
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&response); err != nil {
+		return nil, false, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &response, false, nil
+}
+
+// newIdempotencyKey returns a random key identifying a single webhook request across its attempts
+func newIdempotencyKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// sign returns a JWS over the body with a detached payload, signed with the connector's current SVID key
+func (p *WebhookProvider) sign(body []byte) (string, error) {
+	svid, err := p.svidSource.GetX509SVID()
+	if err != nil {
+		return "", err
+	}
+
+	var key jose.SigningKey
+	switch k := svid.PrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			key = jose.SigningKey{Algorithm: jose.ES256, Key: k}
+		case elliptic.P384():
+			key = jose.SigningKey{Algorithm: jose.ES384, Key: k}
+		default:
+			return "", fmt.Errorf("unsupported SVID key curve %s", k.Curve.Params().Name)
+		}
+	case *rsa.PrivateKey:
+		key = jose.SigningKey{Algorithm: jose.RS256, Key: k}
+	default:
+		return "", fmt.Errorf("unsupported SVID key type %T", svid.PrivateKey)
+	}
+
+	signer, err := jose.NewSigner(key, (&jose.SignerOptions{}).WithHeader("kid", svid.ID.String()))
+	if err != nil {
+		return "", err
+	}
+	jws, err := signer.Sign(body)
+	if err != nil {
+		return "", err
+	}
+	return jws.DetachedCompactSerialize()
+}
+
+func (r *WebhookResponse) validate() error {
+	if len(r.Files) == 0 && len(r.EnvVars) == 0 && r.Username == "" && r.Password == "" && r.Token == "" {
+		return errors.New("no credential fields were set")
+	}
+	for i, f := range r.Files {
+		if f.Path == "" {
+			return fmt.Errorf("file %d has no path", i)
+		}
+		if f.Mode > 0777 {
+			return fmt.Errorf("file %q has invalid mode %o", f.Path, f.Mode)
+		}
+	}
+	for k := range r.EnvVars {
+		if k == "" {
+			return errors.New("env var with empty name")
+		}
+	}
+	if r.NotAfter != nil && !r.NotAfter.After(time.Now()) {
+		return fmt.Errorf("credential expired at %s", r.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (r *WebhookResponse) credential() *proto.Credential {
+	credential := &proto.Credential{
+		EnvVars: r.EnvVars,
+	}
+	for _, f := range r.Files {
+		mode := f.Mode
+		if mode == 0 {
+			mode = 0600
+		}
+		credential.Files = append(credential.Files, &proto.File{
+			Path:     f.Path,
+			Mode:     mode,
+			Contents: f.Contents,
+		})
+	}
+	if r.Username != "" {
+		credential.Username = &r.Username
+	}
+	if r.Password != "" {
+		credential.Password = &r.Password
+	}
+	if r.Token != "" {
+		credential.Token = &r.Token
+	}
+	if r.NotAfter != nil {
+		credential.NotAfter = timestamppb.New(*r.NotAfter)
+	}
+	return credential
+}
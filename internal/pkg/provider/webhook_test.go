@@ -0,0 +1,288 @@
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/cryptoutil"
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+)
+
+// newTestSVIDs returns an SVID for each of the supplied SPIFFE IDs and a bundle which trusts them all
+func newTestSVIDs(t *testing.T, spiffeIDs ...string) ([]*x509svid.SVID, *x509bundle.Bundle) {
+	certs, err := cryptoutil.GenerateTestCerts(spiffeIDs...)
+	require.NoError(t, err)
+
+	var svids []*x509svid.SVID
+	for _, c := range certs {
+		key, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+		require.NoError(t, err)
+		svid, err := x509svid.ParseRaw(c.Certificate[0], key)
+		require.NoError(t, err)
+		svids = append(svids, svid)
+	}
+
+	ca, err := x509.ParseCertificate(certs[0].Certificate[1])
+	require.NoError(t, err)
+	bundle := x509bundle.FromX509Authorities(svids[0].ID.TrustDomain(), []*x509.Certificate{ca})
+
+	return svids, bundle
+}
+
+func TestWebhookProvider_GetCredentialForRequest(t *testing.T) {
+	svids, bundle := newTestSVIDs(t, "spiffe://example.com/webhook", "spiffe://example.com/connector")
+	webhookSVID, connectorSVID := svids[0], svids[1]
+
+	notAfter := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	validResponse := `{
+		"files": [{"path": "~/.issuer/credential", "mode": 384, "contents": "c2VjcmV0"}],
+		"env_vars": {"ISSUER_TOKEN": "abc"},
+		"token": "abc",
+		"not_after": "` + notAfter.Format(time.RFC3339) + `"
+	}`
+
+	request := Request{
+		ObjectReference: "team-a/reader",
+		Principal:       spiffeid.RequireFromString("spiffe://example.com/ns/team-a/sa/app"),
+		MatchPrincipal:  "spiffe://example.com/ns/team-a/*",
+	}
+
+	testCases := map[string]struct {
+		serverSPIFFEID       string
+		retries              *int
+		responses            []func(w http.ResponseWriter)
+		expectedError        error
+		expectedCredential   *proto.Credential
+		expectedRequestCount int
+	}{
+		"successful example": {
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.Write([]byte(validResponse)) },
+			},
+			expectedCredential: &proto.Credential{
+				NotAfter: timestamppb.New(notAfter),
+				Files:    []*proto.File{{Path: "~/.issuer/credential", Mode: 0600, Contents: []byte("secret")}},
+				EnvVars:  map[string]string{"ISSUER_TOKEN": "abc"},
+				Token:    stringPtr("abc"),
+			},
+			expectedRequestCount: 1,
+		},
+		"server errors are retried": {
+			serverSPIFFEID: "spiffe://example.com/webhook",
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) },
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusTooManyRequests) },
+				func(w http.ResponseWriter) { w.Write([]byte(`{"username": "user", "password": "pass"}`)) },
+			},
+			expectedCredential: &proto.Credential{
+				Username: stringPtr("user"),
+				Password: stringPtr("pass"),
+			},
+			expectedRequestCount: 3,
+		},
+		"retries are limited": {
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) },
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) },
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) },
+			},
+			expectedError:        errors.New("failed to get credential from webhook: unexpected status 503: "),
+			expectedRequestCount: 3,
+		},
+		"retries can be disabled": {
+			retries: new(int),
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) },
+			},
+			expectedError:        errors.New("failed to get credential from webhook: unexpected status 503: "),
+			expectedRequestCount: 1,
+		},
+		"other server errors are not retried": {
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) },
+			},
+			expectedError:        errors.New("failed to get credential from webhook: unexpected status 502: "),
+			expectedRequestCount: 1,
+		},
+		"client errors are not retried": {
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) {
+					w.WriteHeader(http.StatusForbidden)
+					w.Write([]byte("team-a may not read this\n"))
+				},
+			},
+			expectedError:        errors.New("failed to get credential from webhook: unexpected status 403: team-a may not read this"),
+			expectedRequestCount: 1,
+		},
+		"unknown response fields": {
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.Write([]byte(`{"token": "abc", "expires": 3600}`)) },
+			},
+			expectedError:        errors.New(`failed to get credential from webhook: failed to decode response: json: unknown field "expires"`),
+			expectedRequestCount: 1,
+		},
+		"empty response": {
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.Write([]byte(`{}`)) },
+			},
+			expectedError:        errors.New("webhook response is invalid: no credential fields were set"),
+			expectedRequestCount: 1,
+		},
+		"file without a path": {
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.Write([]byte(`{"files": [{"contents": "c2VjcmV0"}]}`)) },
+			},
+			expectedError:        errors.New("webhook response is invalid: file 0 has no path"),
+			expectedRequestCount: 1,
+		},
+		"webhook presents unexpected SPIFFE ID": {
+			serverSPIFFEID: "spiffe://example.com/other",
+			responses: []func(w http.ResponseWriter){
+				func(w http.ResponseWriter) { w.Write([]byte(validResponse)) },
+			},
+			expectedError: errors.New(`unexpected ID "spiffe://example.com/webhook"`),
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			var count int
+			var idempotencyKey string
+			testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				count++
+
+				// the request must come from the connector and be signed with its SVID
+				require.Len(t, r.TLS.PeerCertificates, 1)
+				assert.Equal(t, connectorSVID.Certificates[0].Raw, r.TLS.PeerCertificates[0].Raw)
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				jws, err := jose.ParseDetached(r.Header.Get(WebhookSignatureHeader), body)
+				require.NoError(t, err)
+				assert.NoError(t, jws.DetachedVerify(body, r.TLS.PeerCertificates[0].PublicKey))
+
+				var webhookRequest WebhookRequest
+				require.NoError(t, json.Unmarshal(body, &webhookRequest))
+				assert.Equal(t, request.ObjectReference, webhookRequest.ObjectReference)
+				assert.Equal(t, request.Principal.String(), webhookRequest.Principal)
+				assert.Equal(t, request.MatchPrincipal, webhookRequest.MatchPrincipal)
+
+				// every attempt carries the same idempotency key
+				if count == 1 {
+					idempotencyKey = r.Header.Get(WebhookIdempotencyKeyHeader)
+					assert.Len(t, idempotencyKey, 32)
+				}
+				assert.Equal(t, idempotencyKey, r.Header.Get(WebhookIdempotencyKeyHeader))
+
+				testCase.responses[count-1](w)
+			}))
+			testServer.TLS = tlsconfig.MTLSServerConfig(webhookSVID, bundle, tlsconfig.AuthorizeAny())
+			// httptest would otherwise serve its own certificate, since no SNI is sent when dialing an IP
+			testServer.TLS.Certificates = []tls.Certificate{{
+				Certificate: [][]byte{webhookSVID.Certificates[0].Raw},
+				PrivateKey:  webhookSVID.PrivateKey,
+			}}
+			testServer.StartTLS()
+			defer testServer.Close()
+
+			p, err := NewWebhookProvider(WebhookProviderOptions{
+				URL:            testServer.URL,
+				ServerSPIFFEID: testCase.serverSPIFFEID,
+				SVIDSource:     connectorSVID,
+				BundleSource:   bundle,
+				Retries:        testCase.retries,
+				RetryBackoff:   time.Millisecond,
+			})
+			require.NoError(t, err)
+			assert.True(t, p.PerPrincipal(request))
+
+			cred, err := p.GetCredentialForRequest(request)
+			if testCase.expectedError != nil {
+				assert.ErrorContains(t, err, testCase.expectedError.Error())
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, testCase.expectedCredential.String(), cred.String())
+			}
+			assert.Equal(t, testCase.expectedRequestCount, count, "unexpected number of requests made to webhook")
+		})
+	}
+}
+
+func TestWebhookProvider_GetCredentialWithContext_Cancelled(t *testing.T) {
+	svids, bundle := newTestSVIDs(t, "spiffe://example.com/webhook", "spiffe://example.com/connector")
+	webhookSVID, connectorSVID := svids[0], svids[1]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	requested := make(chan struct{}, 1)
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	testServer.TLS = tlsconfig.MTLSServerConfig(webhookSVID, bundle, tlsconfig.AuthorizeAny())
+	testServer.TLS.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{webhookSVID.Certificates[0].Raw},
+		PrivateKey:  webhookSVID.PrivateKey,
+	}}
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	p, err := NewWebhookProvider(WebhookProviderOptions{
+		URL:          testServer.URL,
+		SVIDSource:   connectorSVID,
+		BundleSource: bundle,
+		RetryBackoff: time.Hour,
+	})
+	require.NoError(t, err)
+
+	// the client goes away during the first attempt, or while the provider is backing off after it
+	go func() {
+		<-requested
+		cancel()
+	}()
+	start := time.Now()
+	_, err = p.GetCredentialWithContext(ctx, Request{
+		ObjectReference: "team-a/reader",
+		Principal:       spiffeid.RequireFromString("spiffe://example.com/ns/team-a/sa/app"),
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 10*time.Second, "backoff was not interrupted")
+	assert.Len(t, requested, 0, "request was retried after the context was cancelled")
+}
+
+func TestNewWebhookProvider(t *testing.T) {
+	_, err := NewWebhookProvider(WebhookProviderOptions{URL: "http://issuer.example.com"})
+	assert.EqualError(t, err, `supplied URL value should have https scheme: "http://issuer.example.com"`)
+
+	_, err = NewWebhookProvider(WebhookProviderOptions{URL: "https://issuer.example.com", ServerSPIFFEID: "issuer"})
+	assert.ErrorContains(t, err, "provided server SPIFFE ID is invalid")
+
+	retries := -1
+	_, err = NewWebhookProvider(WebhookProviderOptions{URL: "https://issuer.example.com", Retries: &retries})
+	assert.EqualError(t, err, "retries cannot be negative")
+
+	p, err := NewWebhookProvider(WebhookProviderOptions{URL: "https://issuer.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "WebhookProvider", p.Name())
+	assert.Equal(t, "issuer.example.com:https", p.pingHost)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
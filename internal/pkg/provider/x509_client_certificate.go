@@ -0,0 +1,212 @@
+package provider
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/cryptoutil"
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+)
+
+// X509ClientCertificateProviderOptions are the options available to configure a X509ClientCertificateProvider
+type X509ClientCertificateProviderOptions struct {
+	// CACertFile is the path to the PEM encoded CA certificate, it may be followed by any intermediates which will be
+	// returned as part of the CA chain
+	CACertFile string
+
+	// CAKeyFile is the path to the PEM encoded private key of the CA
+	CAKeyFile string
+
+	// Lifetime is how long certificates will be valid for when the object reference does not set one, defaults to 24hr
+	Lifetime time.Duration
+}
+
+// X509ClientCertificateProvider is a provider which issues X.509 client certificates with a configurable subject from
+// a local CA, for use with services which identify clients by CN or OU rather than by SPIFFE ID
+type X509ClientCertificateProvider struct {
+	caCert   *x509.Certificate
+	caKey    crypto.Signer
+	caChain  []byte
+	lifetime time.Duration
+}
+
+// NewX509ClientCertificateProvider will configure a new X509ClientCertificateProvider using the supplied options
+func NewX509ClientCertificateProvider(options X509ClientCertificateProviderOptions) (X509ClientCertificateProvider, error) {
+	if options.CACertFile == "" || options.CAKeyFile == "" {
+		return X509ClientCertificateProvider{}, errors.New("both CA cert file and CA key file must be set")
+	}
+
+	caChain, err := os.ReadFile(options.CACertFile)
+	if err != nil {
+		return X509ClientCertificateProvider{}, fmt.Errorf("failed to read CA cert file: %w", err)
+	}
+	caKeyPEM, err := os.ReadFile(options.CAKeyFile)
+	if err != nil {
+		return X509ClientCertificateProvider{}, fmt.Errorf("failed to read CA key file: %w", err)
+	}
+
+	// tls.X509KeyPair checks the key matches the first certificate in the chain
+	keyPair, err := tls.X509KeyPair(caChain, caKeyPEM)
+	if err != nil {
+		return X509ClientCertificateProvider{}, fmt.Errorf("failed to load CA: %w", err)
+	}
+	caCert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return X509ClientCertificateProvider{}, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	if !caCert.IsCA {
+		return X509ClientCertificateProvider{}, errors.New("CA certificate is not a CA")
+	}
+	caKey, ok := keyPair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return X509ClientCertificateProvider{}, errors.New("CA key cannot be used for signing")
+	}
+
+	lifetime := 24 * time.Hour
+	if options.Lifetime > 0 {
+		lifetime = options.Lifetime
+	}
+
+	return X509ClientCertificateProvider{
+		caCert:   caCert,
+		caKey:    caKey,
+		caChain:  caChain,
+		lifetime: lifetime,
+	}, nil
+}
+
+// Name returns the name of the provider
+func (p *X509ClientCertificateProvider) Name() string {
+	return "X509ClientCertificateProvider"
+}
+
+// FileOutputs describes the certificate, key and CA files
+func (p *X509ClientCertificateProvider) FileOutputs() []FileOutput {
+	return []FileOutput{
+		{Name: "certificate", Path: "~/.config/spiffe-connector/tls/tls.crt"},
+		{Name: "private_key", Path: "~/.config/spiffe-connector/tls/tls.key"},
+		{Name: "ca", Path: "~/.config/spiffe-connector/tls/ca.crt"},
+	}
+}
+
+// Ping checks the CA certificate is still valid, as certificates are signed locally
+func (p *X509ClientCertificateProvider) Ping() error {
+	if time.Now().After(p.caCert.NotAfter) {
+		return fmt.Errorf("provider ping failed: CA certificate expired at %s", p.caCert.NotAfter)
+	}
+	return nil
+}
+
+// GetCredential issues a client certificate for an object reference which does not depend on the caller
+func (p *X509ClientCertificateProvider) GetCredential(objectReference string) (*proto.Credential, error) {
+	return p.GetCredentialForRequest(Request{ObjectReference: objectReference})
+}
+
+// PerPrincipal is true when the subject in the object reference is a template, since each caller may then be given a
+// different subject
+func (p *X509ClientCertificateProvider) PerPrincipal(request Request) bool {
+	return isTemplate(request.ObjectReference)
+}
+
+// GetCredentialForRequest issues a client certificate. The objectReference is in URL query format and contains the
+// subject attributes (cn, o, ou, c, l, st) and optionally a lifetime, for example
+// "cn={{ index .PathSegments 1 }}&ou=payments&lifetime=8h". Subject attributes are templates which may use the
+// caller's SPIFFE ID.
+func (p *X509ClientCertificateProvider) GetCredentialForRequest(request Request) (*proto.Credential, error) {
+	subject, lifetime, err := p.parseObjectReference(request)
+	if err != nil {
+		return &proto.Credential{}, err
+	}
+
+	cert, key, err := cryptoutil.GenerateClientCertificate(subject, lifetime, p.caCert, p.caKey)
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to generate client certificate: %w", err)
+	}
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return &proto.Credential{}, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+
+	return &proto.Credential{
+		NotAfter: timestamppb.New(cert.NotAfter),
+		Files: []*proto.File{
+			{
+				Path:     "~/.config/spiffe-connector/tls/tls.crt",
+				Mode:     0644,
+				Contents: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+			},
+			{
+				Path:     "~/.config/spiffe-connector/tls/tls.key",
+				Mode:     0600,
+				Contents: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}),
+			},
+			{
+				Path:     "~/.config/spiffe-connector/tls/ca.crt",
+				Mode:     0644,
+				Contents: p.caChain,
+			},
+		},
+	}, nil
+}
+
+func (p *X509ClientCertificateProvider) parseObjectReference(request Request) (pkix.Name, time.Duration, error) {
+	values, err := url.ParseQuery(request.ObjectReference)
+	if err != nil {
+		return pkix.Name{}, 0, fmt.Errorf("failed to parse object reference: %w", err)
+	}
+
+	var subject pkix.Name
+	lifetime := p.lifetime
+	for key, vs := range values {
+		var rendered []string
+		for _, v := range vs {
+			r, err := renderTemplate(key, v, request)
+			if err != nil {
+				return pkix.Name{}, 0, err
+			}
+			rendered = append(rendered, r)
+		}
+
+		switch key {
+		case "cn":
+			if len(rendered) > 1 {
+				return pkix.Name{}, 0, errors.New("object reference may only contain one cn")
+			}
+			subject.CommonName = rendered[0]
+		case "o":
+			subject.Organization = rendered
+		case "ou":
+			subject.OrganizationalUnit = rendered
+		case "c":
+			subject.Country = rendered
+		case "l":
+			subject.Locality = rendered
+		case "st":
+			subject.Province = rendered
+		case "lifetime":
+			lifetime, err = time.ParseDuration(rendered[0])
+			if err != nil || lifetime <= 0 {
+				return pkix.Name{}, 0, fmt.Errorf("invalid lifetime %q in object reference", rendered[0])
+			}
+		default:
+			return pkix.Name{}, 0, fmt.Errorf("unsupported key %q in object reference", key)
+		}
+	}
+
+	if subject.CommonName == "" {
+		return pkix.Name{}, 0, errors.New("object reference must contain a cn")
+	}
+
+	return subject, lifetime, nil
+}
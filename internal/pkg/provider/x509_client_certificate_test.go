@@ -0,0 +1,157 @@
+package provider
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCA generates a CA valid for the given lifetime and writes the PEM encoded certificate and key to a temporary
+// directory, returning the paths of the certificate and key files
+func writeTestCA(t *testing.T, lifetime time.Duration) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		BasicConstraintsValid: true,
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(lifetime),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600))
+
+	return certFile, keyFile
+}
+
+func TestNewX509ClientCertificateProvider(t *testing.T) {
+	certFile, keyFile := writeTestCA(t, time.Hour)
+	otherCertFile, _ := writeTestCA(t, time.Hour)
+
+	p, err := NewX509ClientCertificateProvider(X509ClientCertificateProviderOptions{CACertFile: certFile, CAKeyFile: keyFile})
+	require.NoError(t, err)
+	assert.Equal(t, "X509ClientCertificateProvider", p.Name())
+	assert.NoError(t, p.Ping())
+
+	_, err = NewX509ClientCertificateProvider(X509ClientCertificateProviderOptions{CACertFile: certFile})
+	assert.EqualError(t, err, "both CA cert file and CA key file must be set")
+
+	_, err = NewX509ClientCertificateProvider(X509ClientCertificateProviderOptions{CACertFile: otherCertFile, CAKeyFile: keyFile})
+	assert.ErrorContains(t, err, "failed to load CA")
+}
+
+func TestX509ClientCertificateProvider_GetCredentialForRequest(t *testing.T) {
+	certFile, keyFile := writeTestCA(t, 48*time.Hour)
+	caPEM, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(caPEM))
+
+	principal := spiffeid.RequireFromString("spiffe://example.com/ns/payments/sa/ledger")
+
+	testCases := map[string]struct {
+		objectReference  string
+		expectedError    error
+		expectedSubject  pkix.Name
+		expectedLifetime time.Duration
+		perPrincipal     bool
+	}{
+		"static subject with default lifetime": {
+			objectReference:  "cn=kafka-client&ou=payments&ou=kafka&o=Example",
+			expectedSubject:  pkix.Name{CommonName: "kafka-client", OrganizationalUnit: []string{"payments", "kafka"}, Organization: []string{"Example"}},
+			expectedLifetime: 24 * time.Hour,
+		},
+		"templated subject with lifetime": {
+			objectReference:  "cn={{ index .PathSegments 3 }}&ou={{ index .PathSegments 1 }}&lifetime=1h",
+			expectedSubject:  pkix.Name{CommonName: "ledger", OrganizationalUnit: []string{"payments"}},
+			expectedLifetime: time.Hour,
+			perPrincipal:     true,
+		},
+		"lifetime is capped to the CA": {
+			objectReference:  "cn=long&lifetime=1000h",
+			expectedSubject:  pkix.Name{CommonName: "long"},
+			expectedLifetime: 48 * time.Hour,
+		},
+		"missing cn": {
+			objectReference: "ou=payments",
+			expectedError:   errors.New("object reference must contain a cn"),
+		},
+		"unsupported key": {
+			objectReference: "cn=foo&dns=foo.example.com",
+			expectedError:   errors.New(`unsupported key "dns" in object reference`),
+		},
+		"invalid lifetime": {
+			objectReference: "cn=foo&lifetime=forever",
+			expectedError:   errors.New(`invalid lifetime "forever" in object reference`),
+		},
+		"invalid template": {
+			objectReference: "cn={{ .Missing }}",
+			expectedError:   errors.New(`failed to render cn template: template: cn:1:3: executing "cn" at <.Missing>: can't evaluate field Missing in type provider.templateData`),
+			perPrincipal:    true,
+		},
+	}
+
+	for testName, testCase := range testCases {
+		p, err := NewX509ClientCertificateProvider(X509ClientCertificateProviderOptions{CACertFile: certFile, CAKeyFile: keyFile})
+		require.NoError(t, err)
+
+		t.Run(testName, func(t *testing.T) {
+			request := Request{ObjectReference: testCase.objectReference, Principal: principal}
+			assert.Equal(t, testCase.perPrincipal, p.PerPrincipal(request))
+
+			cred, err := p.GetCredentialForRequest(request)
+			if testCase.expectedError != nil {
+				assert.EqualError(t, err, testCase.expectedError.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, cred.Files, 3)
+			assert.Equal(t, caPEM, cred.Files[2].Contents)
+			assert.Equal(t, uint32(0600), cred.Files[1].Mode)
+
+			block, _ := pem.Decode(cred.Files[0].Contents)
+			require.NotNil(t, block)
+			cert, err := x509.ParseCertificate(block.Bytes)
+			require.NoError(t, err)
+
+			assert.Equal(t, testCase.expectedSubject.CommonName, cert.Subject.CommonName)
+			assert.Equal(t, testCase.expectedSubject.Organization, cert.Subject.Organization)
+			assert.ElementsMatch(t, testCase.expectedSubject.OrganizationalUnit, cert.Subject.OrganizationalUnit)
+			assert.Empty(t, cert.URIs, "client certificates should not contain a SPIFFE ID")
+			assert.WithinDuration(t, time.Now().Add(testCase.expectedLifetime), cert.NotAfter, time.Minute)
+			assert.Equal(t, cert.NotAfter, cred.NotAfter.AsTime())
+
+			_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+			assert.NoError(t, err)
+
+			keyBlock, _ := pem.Decode(cred.Files[1].Contents)
+			require.NotNil(t, keyBlock)
+			key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+			require.NoError(t, err)
+			assert.Equal(t, cert.PublicKey, key.(*ecdsa.PrivateKey).Public())
+		})
+	}
+}
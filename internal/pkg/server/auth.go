@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/config"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+// authorizationMetadata is the gRPC metadata key a JWT-SVID is sent in, as "Bearer <token>"
+const authorizationMetadata = "authorization"
+
+// trustDomainAcceptor reports whether workloads in a trust domain may connect, it is implemented by
+// config.DynamicSource so that changes to the accepted trust domains apply when the config is reloaded
+type trustDomainAcceptor interface {
+	AcceptsTrustDomain(trustDomain spiffeid.TrustDomain) bool
+}
+
+// authorizeTrustDomains returns a TLS authorizer which turns away clients from trust domains which are not accepted,
+// before any ACLs are matched
+func authorizeTrustDomains(acceptor trustDomainAcceptor) tlsconfig.Authorizer {
+	return tlsconfig.AdaptMatcher(func(id spiffeid.ID) error {
+		if !acceptor.AcceptsTrustDomain(id.TrustDomain()) {
+			return fmt.Errorf("trust domain %q is not accepted", id.TrustDomain())
+		}
+		return nil
+	})
+}
+
+// transportCredentials returns the TLS credentials of the gRPC server
+func (s *Server) transportCredentials() credentials.TransportCredentials {
+	return credentials.NewTLS(s.tlsConfig())
+}
+
+// tlsConfig returns the TLS config of the server, shared by the gRPC server and the HTTP/JSON API. A client certificate
+// is required when only mTLS is accepted, requested when JWT-SVIDs are accepted too, and not requested when only
+// JWT-SVIDs are.
+func (s *Server) tlsConfig() *tls.Config {
+	if !s.Auth.Accepts(types.AuthMethodX509) {
+		return tlsconfig.TLSServerConfig(config.CurrentSource)
+	}
+
+	tlsConfig := tlsconfig.MTLSServerConfig(config.CurrentSource, config.CurrentSource, authorizeTrustDomains(config.CurrentSource))
+	if s.Auth.Accepts(types.AuthMethodJWT) {
+		// clients without a certificate must then authenticate with a JWT-SVID, those with one are still verified
+		verify := tlsConfig.VerifyPeerCertificate
+		tlsConfig.ClientAuth = tls.RequestClientCert
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return nil
+			}
+			return verify(rawCerts, verifiedChains)
+		}
+	}
+	return tlsConfig
+}
+
+// authenticate returns the SPIFFE ID of the client and the method it authenticated with. The X.509-SVID of the client
+// is used if it presented one, otherwise a JWT-SVID in the authorization metadata, as far as the methods are accepted.
+func (s *Server) authenticate(ctx context.Context) (spiffeid.ID, string, error) {
+	if s.Auth.Accepts(types.AuthMethodX509) {
+		if id, ok := peerIDFromContext(ctx); ok {
+			return id, types.AuthMethodX509, nil
+		}
+	}
+
+	if s.Auth.Accepts(types.AuthMethodJWT) {
+		if token, ok := bearerTokenFromContext(ctx); ok {
+			svid, err := s.validateJWTSVID(token)
+			if err != nil {
+				return spiffeid.ID{}, "", fmt.Errorf("invalid JWT-SVID: %w", err)
+			}
+			// the TLS authorizer only sees client certificates, so trust domains are checked here for tokens
+			if !config.CurrentSource.AcceptsTrustDomain(svid.ID.TrustDomain()) {
+				return spiffeid.ID{}, "", fmt.Errorf("trust domain %q is not accepted", svid.ID.TrustDomain())
+			}
+			return svid.ID, types.AuthMethodJWT, nil
+		}
+	}
+
+	return spiffeid.ID{}, "", errors.New("no SVID provided")
+}
+
+// validateJWTSVID validates the token against each accepted audience in turn, returning the first JWT-SVID which is
+// valid. go-spiffe requires a token to have every audience it is given, where a token needs only one of them here.
+func (s *Server) validateJWTSVID(token string) (*jwtsvid.SVID, error) {
+	var err error
+	for _, audience := range s.Auth.JWTAudience {
+		var svid *jwtsvid.SVID
+		svid, err = jwtsvid.ParseAndValidate(token, config.CurrentSource, []string{audience})
+		if err == nil {
+			return svid, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no audiences are accepted")
+	}
+	return nil, err
+}
+
+// peerIDFromContext returns the SPIFFE ID of the X.509-SVID the client presented, which has been verified in the TLS
+// handshake
+func peerIDFromContext(ctx context.Context) (spiffeid.ID, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return spiffeid.ID{}, false
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return spiffeid.ID{}, false
+	}
+	id, err := x509svid.IDFromCert(tlsInfo.State.PeerCertificates[0])
+	if err != nil {
+		return spiffeid.ID{}, false
+	}
+	return id, true
+}
+
+// bearerTokenFromContext returns the token sent in the authorization metadata
+func bearerTokenFromContext(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	for _, value := range md.Get(authorizationMetadata) {
+		if len(value) > len("bearer ") && strings.EqualFold(value[:len("bearer ")], "bearer ") {
+			return strings.TrimSpace(value[len("bearer "):]), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffegrpc/grpccredentials"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/config"
+	"github.com/jetstack/spiffe-connector/internal/pkg/cryptoutil"
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+// inMemorySVID encodes a test certificate and its CA as the config of an in memory SVID source
+func inMemorySVID(t *testing.T, cert tls.Certificate) *types.InMemory {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	return &types.InMemory{
+		TrustDomainCA: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[1]}),
+		SVIDCert:      pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}),
+		SVIDKey:       pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}),
+	}
+}
+
+// jwtSigner issues test JWT-SVIDs, signed with a key published in the JWT bundle of its trust domain
+type jwtSigner struct {
+	key    *ecdsa.PrivateKey
+	keyID  string
+	bundle []byte
+}
+
+func newJWTSigner(t *testing.T, trustDomain string) *jwtSigner {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	bundle, err := jwtbundle.FromJWTAuthorities(spiffeid.RequireTrustDomainFromString(trustDomain), map[string]crypto.PublicKey{
+		"test-key": key.Public(),
+	}).Marshal()
+	require.NoError(t, err)
+	return &jwtSigner{key: key, keyID: "test-key", bundle: bundle}
+}
+
+func (j *jwtSigner) sign(t *testing.T, subject string, audience []string, expiry time.Time) string {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.ES256,
+		Key:       jose.JSONWebKey{Key: j.key, KeyID: j.keyID},
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	require.NoError(t, err)
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Subject:  subject,
+		Audience: audience,
+		Expiry:   jwt.NewNumericDate(expiry),
+	}).CompactSerialize()
+	require.NoError(t, err)
+	return token
+}
+
+func TestServer_Authenticate(t *testing.T) {
+	serverCerts, err := cryptoutil.GenerateTestCerts("spiffe://example.com/server")
+	require.NoError(t, err)
+	clientCerts, err := cryptoutil.GenerateTestCerts("spiffe://example.com/mtls-client")
+	require.NoError(t, err)
+	clientCert, err := x509.ParseCertificate(clientCerts[0].Certificate[0])
+	require.NoError(t, err)
+
+	signer := newJWTSigner(t, "example.com")
+	otherSigner := newJWTSigner(t, "example.com")
+	partnerSigner := newJWTSigner(t, "partner.example")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source, err := config.ConstructSpiffeConnectorSource(ctx, cancel, &types.SpiffeConfig{
+		SVIDSources:  types.SVIDSources{InMemory: inMemorySVID(t, serverCerts[0])},
+		TrustDomains: []types.TrustDomainConfig{{Name: "example.com", JWTBundle: signer.bundle}},
+	})
+	require.NoError(t, err)
+	config.StoreCurrentSource(source)
+
+	jwtAuth := &types.AuthConfig{
+		Methods:     []string{types.AuthMethodX509, types.AuthMethodJWT},
+		JWTAudience: []string{"spiffe-connector"},
+	}
+	audience := []string{"spiffe-connector"}
+	expiry := time.Now().Add(time.Hour)
+
+	testCases := map[string]struct {
+		auth           *types.AuthConfig
+		token          string
+		withCert       bool
+		expectedID     string
+		expectedMethod string
+		expectError    bool
+	}{
+		"no credentials": {
+			auth:        jwtAuth,
+			expectError: true,
+		},
+		"client certificate": {
+			withCert:       true,
+			expectedID:     "spiffe://example.com/mtls-client",
+			expectedMethod: types.AuthMethodX509,
+		},
+		"tokens are ignored unless the jwt method is accepted": {
+			token:       signer.sign(t, "spiffe://example.com/jwt-client", audience, expiry),
+			expectError: true,
+		},
+		"client certificates are ignored unless the x509 method is accepted": {
+			auth:        &types.AuthConfig{Methods: []string{types.AuthMethodJWT}, JWTAudience: audience},
+			withCert:    true,
+			expectError: true,
+		},
+		"valid token": {
+			auth:           jwtAuth,
+			token:          signer.sign(t, "spiffe://example.com/jwt-client", audience, expiry),
+			expectedID:     "spiffe://example.com/jwt-client",
+			expectedMethod: types.AuthMethodJWT,
+		},
+		"client certificate takes precedence over a token": {
+			auth:           jwtAuth,
+			token:          signer.sign(t, "spiffe://example.com/jwt-client", audience, expiry),
+			withCert:       true,
+			expectedID:     "spiffe://example.com/mtls-client",
+			expectedMethod: types.AuthMethodX509,
+		},
+		"token with one of several accepted audiences": {
+			auth:           &types.AuthConfig{Methods: []string{types.AuthMethodJWT}, JWTAudience: []string{"other", "spiffe-connector"}},
+			token:          signer.sign(t, "spiffe://example.com/jwt-client", audience, expiry),
+			expectedID:     "spiffe://example.com/jwt-client",
+			expectedMethod: types.AuthMethodJWT,
+		},
+		"token for another audience": {
+			auth:        jwtAuth,
+			token:       signer.sign(t, "spiffe://example.com/jwt-client", []string{"other"}, expiry),
+			expectError: true,
+		},
+		"expired token": {
+			auth:        jwtAuth,
+			token:       signer.sign(t, "spiffe://example.com/jwt-client", audience, time.Now().Add(-time.Hour)),
+			expectError: true,
+		},
+		"token signed by an unknown key": {
+			auth:        jwtAuth,
+			token:       otherSigner.sign(t, "spiffe://example.com/jwt-client", audience, expiry),
+			expectError: true,
+		},
+		"token from a trust domain which is not accepted": {
+			auth:        jwtAuth,
+			token:       partnerSigner.sign(t, "spiffe://partner.example/jwt-client", audience, expiry),
+			expectError: true,
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			ctx := context.Background()
+			if testCase.withCert {
+				ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{
+					State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{clientCert}},
+				}})
+			}
+			if testCase.token != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+testCase.token))
+			}
+
+			s := &Server{Auth: testCase.auth}
+			id, method, err := s.authenticate(ctx)
+			if testCase.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectedID, id.String())
+			assert.Equal(t, testCase.expectedMethod, method)
+		})
+	}
+}
+
+func TestServer_Start_JWTAuth(t *testing.T) {
+	serverCerts, err := cryptoutil.GenerateTestCerts("spiffe://example.com/server")
+	require.NoError(t, err)
+	serverSVID := inMemorySVID(t, serverCerts[0])
+	signer := newJWTSigner(t, "example.com")
+
+	testCases := map[string]struct {
+		token        string
+		expectedCode codes.Code
+	}{
+		"clients without a certificate authenticate with a token": {
+			token:        signer.sign(t, "spiffe://example.com/behind-proxy", []string{"spiffe-connector"}, time.Now().Add(time.Hour)),
+			expectedCode: codes.OK,
+		},
+		"clients without a certificate or token are unauthenticated": {
+			expectedCode: codes.Unauthenticated,
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			serverSource, err := config.ConstructSpiffeConnectorSource(ctx, cancel, &types.SpiffeConfig{
+				SVIDSources:  types.SVIDSources{InMemory: serverSVID},
+				TrustDomains: []types.TrustDomainConfig{{Name: "example.com", JWTBundle: signer.bundle}},
+			})
+			require.NoError(t, err)
+			config.StoreCurrentSource(serverSource)
+
+			socket := filepath.Join(t.TempDir(), "server.sock")
+			s := &Server{
+				Listen: &ListenOptions{Network: NetworkUnix, Address: socket},
+				Auth: &types.AuthConfig{
+					Methods:     []string{types.AuthMethodX509, types.AuthMethodJWT},
+					JWTAudience: []string{"spiffe-connector"},
+				},
+			}
+			serverErr := make(chan error)
+			go func() {
+				serverErr <- s.Start(ctx)
+			}()
+			defer func() {
+				cancel()
+				assert.NoError(t, <-serverErr)
+			}()
+			waitForSocket(t, socket)
+
+			// the client only verifies the server, as a proxy terminating TLS would
+			bundle, err := x509bundle.Parse(spiffeid.RequireTrustDomainFromString("example.com"), serverSVID.TrustDomainCA)
+			require.NoError(t, err)
+			conn, err := grpc.Dial("unix://"+socket, grpc.WithTransportCredentials(credentials.NewTLS(tlsconfig.TLSClientConfig(bundle, tlsconfig.AuthorizeAny()))))
+			require.NoError(t, err)
+			defer conn.Close()
+
+			requestCtx := context.Background()
+			if testCase.token != "" {
+				requestCtx = metadata.AppendToOutgoingContext(requestCtx, "authorization", "Bearer "+testCase.token)
+			}
+			_, err = proto.NewSpiffeConnectorClient(conn).GetCredentials(requestCtx, &emptypb.Empty{})
+			assert.Equal(t, testCase.expectedCode, status.Code(err))
+		})
+	}
+}
+
+func TestServer_Start_TrustDomains(t *testing.T) {
+	serverCerts, err := cryptoutil.GenerateTestCerts("spiffe://example.com/server")
+	require.NoError(t, err)
+	partnerCerts, err := cryptoutil.GenerateTestCerts("spiffe://partner.example/client")
+	require.NoError(t, err)
+	serverSVID := inMemorySVID(t, serverCerts[0])
+	partnerSVID := inMemorySVID(t, partnerCerts[0])
+
+	testCases := map[string]struct {
+		trustDomains []types.TrustDomainConfig
+		expectError  bool
+	}{
+		"clients from other trust domains are turned away": {
+			// the partner bundle is known, but the trust domain is not accepted
+			trustDomains: []types.TrustDomainConfig{{Name: "example.com"}},
+			expectError:  true,
+		},
+		"clients from federated trust domains are accepted": {
+			trustDomains: []types.TrustDomainConfig{
+				{Name: "example.com"},
+				{Name: "partner.example", Bundle: partnerSVID.TrustDomainCA},
+			},
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			serverSource, err := config.ConstructSpiffeConnectorSource(ctx, cancel, &types.SpiffeConfig{
+				SVIDSources:  types.SVIDSources{InMemory: serverSVID},
+				TrustDomains: testCase.trustDomains,
+			})
+			require.NoError(t, err)
+			config.StoreCurrentSource(serverSource)
+
+			// the partner workload federates with the server's trust domain to verify it
+			clientSource, err := config.ConstructSpiffeConnectorSource(ctx, cancel, &types.SpiffeConfig{
+				SVIDSources: types.SVIDSources{InMemory: partnerSVID},
+				TrustDomains: []types.TrustDomainConfig{
+					{Name: "partner.example"},
+					{Name: "example.com", Bundle: serverSVID.TrustDomainCA},
+				},
+			})
+			require.NoError(t, err)
+
+			socket := filepath.Join(t.TempDir(), "server.sock")
+			s := &Server{Listen: &ListenOptions{Network: NetworkUnix, Address: socket}}
+			serverErr := make(chan error)
+			go func() {
+				serverErr <- s.Start(ctx)
+			}()
+			defer func() {
+				cancel()
+				assert.NoError(t, <-serverErr)
+			}()
+			waitForSocket(t, socket)
+
+			conn, err := grpc.Dial("unix://"+socket, grpc.WithTransportCredentials(grpccredentials.MTLSClientCredentials(clientSource, clientSource, tlsconfig.AuthorizeAny())))
+			require.NoError(t, err)
+			defer conn.Close()
+
+			_, err = proto.NewSpiffeConnectorClient(conn).GetCredentials(context.Background(), &emptypb.Empty{})
+			if testCase.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"time"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/cache"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+// defaultRenewBefore is how long before a stored credential expires that it is renewed or replaced, unless configured
+const defaultRenewBefore = 5 * time.Minute
+
+// freshness is a types.FreshnessPolicy resolved for a single ACL credential
+type freshness struct {
+	// renewBefore and renewBeforeFraction are the remaining lifetime below which a credential is not handed out, only
+	// one is set
+	renewBefore         time.Duration
+	renewBeforeFraction float64
+
+	// reuseWithoutExpiry is whether credentials without a NotAfter are handed out again, for up to maxAge if set
+	reuseWithoutExpiry bool
+	maxAge             time.Duration
+}
+
+// freshnessFor resolves the freshness of an ACL credential from its own policy, then that of its provider, then that
+// of the server. Policies are validated with the config, so parse errors are not expected here and fall back to the
+// defaults.
+func (s *Server) freshnessFor(credential types.Credential) freshness {
+	f := freshness{renewBefore: defaultRenewBefore}
+
+	var policies []*types.FreshnessPolicy
+	if s.Freshness != nil {
+		policies = append(policies, s.Freshness)
+	}
+	if policy, ok := s.ProviderFreshness[credential.Provider]; ok {
+		policies = append(policies, &policy)
+	}
+	if credential.Freshness != nil {
+		policies = append(policies, credential.Freshness)
+	}
+
+	// later policies are more specific, and override only the fields they set
+	for _, policy := range policies {
+		if policy.RenewBefore != "" {
+			if d, fraction, err := policy.ParseRenewBefore(); err == nil {
+				f.renewBefore, f.renewBeforeFraction = d, fraction
+			}
+		}
+		if policy.WithoutExpiry != "" {
+			if reuse, maxAge, err := policy.ParseWithoutExpiry(); err == nil {
+				f.reuseWithoutExpiry, f.maxAge = reuse, maxAge
+			}
+		}
+	}
+
+	return f
+}
+
+// staleAt returns when the credential in the entry stops being handed out, zero if it never does and now if it must
+// not be handed out again at all
+func (f freshness) staleAt(entry *cache.Entry) time.Time {
+	if entry.Credential.NotAfter == nil {
+		switch {
+		case !f.reuseWithoutExpiry:
+			return entry.IssuedAt
+		case f.maxAge > 0:
+			return entry.IssuedAt.Add(f.maxAge)
+		default:
+			return time.Time{}
+		}
+	}
+
+	notAfter := entry.Credential.NotAfter.AsTime()
+	if f.renewBeforeFraction > 0 {
+		lifetime := notAfter.Sub(entry.IssuedAt)
+		return notAfter.Add(-time.Duration(float64(lifetime) * f.renewBeforeFraction))
+	}
+	return notAfter.Add(-f.renewBefore)
+}
+
+// fresh reports whether the credential in the entry can still be handed out
+func (f freshness) fresh(entry *cache.Entry, now time.Time) bool {
+	staleAt := f.staleAt(entry)
+	return staleAt.IsZero() || now.Before(staleAt)
+}
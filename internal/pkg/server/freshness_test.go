@@ -0,0 +1,121 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/cache"
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+func TestServer_FreshnessFor(t *testing.T) {
+	s := &Server{
+		Freshness: &types.FreshnessPolicy{RenewBefore: "10m", WithoutExpiry: "reuse"},
+		ProviderFreshness: map[string]types.FreshnessPolicy{
+			"GoogleIAMServiceAccountKeyProvider": {RenewBefore: "10%"},
+		},
+	}
+
+	testCases := map[string]struct {
+		server   *Server
+		cred     types.Credential
+		expected freshness
+	}{
+		"defaults": {
+			server:   &Server{},
+			cred:     types.Credential{Provider: "AWSSTSAssumeRoleProvider"},
+			expected: freshness{renewBefore: 5 * time.Minute},
+		},
+		"server policy": {
+			server:   s,
+			cred:     types.Credential{Provider: "AWSSTSAssumeRoleProvider"},
+			expected: freshness{renewBefore: 10 * time.Minute, reuseWithoutExpiry: true},
+		},
+		"provider policy overrides the fields it sets": {
+			server:   s,
+			cred:     types.Credential{Provider: "GoogleIAMServiceAccountKeyProvider"},
+			expected: freshness{renewBeforeFraction: 0.1, reuseWithoutExpiry: true},
+		},
+		"credential policy overrides both": {
+			server: s,
+			cred: types.Credential{
+				Provider:  "GoogleIAMServiceAccountKeyProvider",
+				Freshness: &types.FreshnessPolicy{WithoutExpiry: "1h"},
+			},
+			expected: freshness{renewBeforeFraction: 0.1, reuseWithoutExpiry: true, maxAge: time.Hour},
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, testCase.server.freshnessFor(testCase.cred))
+		})
+	}
+}
+
+func TestFreshness_Fresh(t *testing.T) {
+	issuedAt := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	expiring := &cache.Entry{IssuedAt: issuedAt, Credential: &proto.Credential{NotAfter: timestamppb.New(issuedAt.Add(time.Hour))}}
+	eternal := &cache.Entry{IssuedAt: issuedAt, Credential: &proto.Credential{}}
+
+	testCases := map[string]struct {
+		freshness freshness
+		entry     *cache.Entry
+		at        time.Duration
+		expected  bool
+	}{
+		"before an absolute threshold": {
+			freshness: freshness{renewBefore: 15 * time.Minute},
+			entry:     expiring,
+			at:        44 * time.Minute,
+			expected:  true,
+		},
+		"after an absolute threshold": {
+			freshness: freshness{renewBefore: 15 * time.Minute},
+			entry:     expiring,
+			at:        46 * time.Minute,
+		},
+		"before a fractional threshold": {
+			freshness: freshness{renewBeforeFraction: 0.5},
+			entry:     expiring,
+			at:        29 * time.Minute,
+			expected:  true,
+		},
+		"after a fractional threshold": {
+			freshness: freshness{renewBeforeFraction: 0.5},
+			entry:     expiring,
+			at:        31 * time.Minute,
+		},
+		"without expiry, reissued": {
+			freshness: freshness{renewBefore: 5 * time.Minute},
+			entry:     eternal,
+		},
+		"without expiry, reused": {
+			freshness: freshness{reuseWithoutExpiry: true},
+			entry:     eternal,
+			at:        24 * 365 * time.Hour,
+			expected:  true,
+		},
+		"without expiry, reused within max age": {
+			freshness: freshness{reuseWithoutExpiry: true, maxAge: time.Hour},
+			entry:     eternal,
+			at:        59 * time.Minute,
+			expected:  true,
+		},
+		"without expiry, reused beyond max age": {
+			freshness: freshness{reuseWithoutExpiry: true, maxAge: time.Hour},
+			entry:     eternal,
+			at:        61 * time.Minute,
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, testCase.freshness.fresh(testCase.entry, issuedAt.Add(testCase.at)))
+		})
+	}
+}
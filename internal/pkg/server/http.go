@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	goproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	// defaultHTTPAddress is where the HTTP/JSON API listens on tcp if no address is given
+	defaultHTTPAddress = "[::]:9443"
+
+	// httpShutdownTimeout bounds how long requests to the HTTP/JSON API are waited for when the server stops
+	httpShutdownTimeout = 10 * time.Second
+)
+
+// httpListenOptions returns where the HTTP/JSON API listens, which has its own default address
+func (s *Server) httpListenOptions() ListenOptions {
+	options := *s.HTTP
+	if options.Address == "" && (options.Network == "" || options.Network == NetworkTCP) {
+		options.Address = defaultHTTPAddress
+	}
+	return options.withDefaults()
+}
+
+// newHTTPServer returns the server of the HTTP/JSON API, with the same TLS identity and authentication as the gRPC
+// server so that clients such as curl can fetch credentials with their SVID
+func (s *Server) newHTTPServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/credentials", s.handleGetCredentials)
+	return &http.Server{
+		Handler:           mux,
+		TLSConfig:         s.tlsConfig(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// handleGetCredentials serves GET /v1/credentials, returning the GetCredentialsResponse as JSON. The request is passed
+// to GetCredentials as a gRPC request would be, so that the same authentication and ACLs apply.
+func (s *Server) handleGetCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeHTTPError(w, status.Errorf(codes.Unimplemented, "method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	if r.TLS != nil {
+		ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{State: *r.TLS}})
+	}
+	if authorization := r.Header.Values("Authorization"); len(authorization) > 0 {
+		ctx = metadata.NewIncomingContext(ctx, metadata.MD{authorizationMetadata: authorization})
+	}
+
+	resp, err := s.GetCredentials(ctx, &emptypb.Empty{})
+	if err != nil {
+		writeHTTPError(w, err, httpStatusFromCode(status.Code(err)))
+		return
+	}
+	writeJSON(w, resp, http.StatusOK)
+}
+
+// writeHTTPError writes the gRPC status of err as JSON, in the form used by gRPC-Gateway
+func writeHTTPError(w http.ResponseWriter, err error, code int) {
+	writeJSON(w, status.Convert(err).Proto(), code)
+}
+
+func writeJSON(w http.ResponseWriter, m goproto.Message, code int) {
+	data, err := protojson.Marshal(m)
+	if err != nil {
+		log.Printf("failed to marshal HTTP response: %s", err)
+		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("failed to write HTTP response: %s", err)
+	}
+}
+
+// httpStatusFromCode maps gRPC status codes to HTTP status codes, as gRPC-Gateway does
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// serveHTTP serves the HTTP/JSON API on the listener until the context is cancelled, then waits for requests in
+// flight to finish
+func serveHTTP(ctx context.Context, server *http.Server, listener net.Listener) error {
+	stopped := make(chan struct{})
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+			defer cancel()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.Printf("failed to shut down HTTP server: %s", err)
+			}
+		case <-stopped:
+		}
+	}()
+
+	err := server.ServeTLS(listener, "", "")
+	close(stopped)
+	<-shutdown
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve HTTP: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/config"
+	"github.com/jetstack/spiffe-connector/internal/pkg/cryptoutil"
+	"github.com/jetstack/spiffe-connector/internal/pkg/provider"
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+func TestServer_Start_HTTP(t *testing.T) {
+	certs, err := cryptoutil.GenerateTestCerts("spiffe://example.com/server", "spiffe://example.com/client")
+	require.NoError(t, err)
+	serverSVID := inMemorySVID(t, certs[0])
+	clientSVID := inMemorySVID(t, certs[1])
+	signer := newJWTSigner(t, "example.com")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverSource, err := config.ConstructSpiffeConnectorSource(ctx, cancel, &types.SpiffeConfig{
+		SVIDSources:  types.SVIDSources{InMemory: serverSVID},
+		TrustDomains: []types.TrustDomainConfig{{Name: "example.com", JWTBundle: signer.bundle}},
+	})
+	require.NoError(t, err)
+	config.StoreCurrentSource(serverSource)
+	clientSource, err := config.ConstructSpiffeConnectorSource(ctx, cancel, &types.SpiffeConfig{
+		SVIDSources: types.SVIDSources{InMemory: clientSVID},
+	})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "server.sock")
+	httpSocket := filepath.Join(dir, "http.sock")
+	s := &Server{
+		ACLs: []types.ACL{
+			{
+				MatchPrincipal: "spiffe://example.com/client",
+				Credentials:    []types.Credential{{Provider: "RenewingProvider", ObjectReference: "token"}},
+			},
+			{
+				MatchPrincipal: "spiffe://example.com/broken",
+				Credentials:    []types.Credential{{Provider: "MissingProvider", ObjectReference: "token"}},
+			},
+		},
+		Providers: map[string]provider.Provider{"RenewingProvider": &renewingProvider{lifetime: time.Hour}},
+		Listen:    &ListenOptions{Network: NetworkUnix, Address: socket},
+		HTTP:      &ListenOptions{Network: NetworkUnix, Address: httpSocket},
+		Auth: &types.AuthConfig{
+			Methods:     []string{types.AuthMethodX509, types.AuthMethodJWT},
+			JWTAudience: []string{"spiffe-connector"},
+		},
+	}
+	serverErr := make(chan error)
+	go func() {
+		serverErr <- s.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-serverErr)
+	}()
+	waitForSocket(t, socket)
+	waitForSocket(t, httpSocket)
+
+	bundle, err := x509bundle.Parse(spiffeid.RequireTrustDomainFromString("example.com"), serverSVID.TrustDomainCA)
+	require.NoError(t, err)
+	// clients connect to the HTTP socket, as curl --unix-socket does
+	client := func(tlsConfig *tls.Config) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, NetworkUnix, httpSocket)
+			},
+			TLSClientConfig: tlsConfig,
+		}}
+	}
+	mtlsClient := client(tlsconfig.MTLSClientConfig(clientSource, bundle, tlsconfig.AuthorizeAny()))
+	tlsClient := client(tlsconfig.TLSClientConfig(bundle, tlsconfig.AuthorizeAny()))
+
+	testCases := map[string]struct {
+		client         *http.Client
+		method         string
+		path           string
+		token          string
+		expectedStatus int
+		expectedCode   codes.Code
+		expectedToken  string
+	}{
+		"credentials for a client certificate": {
+			client:         mtlsClient,
+			method:         http.MethodGet,
+			path:           "/v1/credentials",
+			expectedStatus: http.StatusOK,
+			expectedToken:  "token-1",
+		},
+		"credentials for a JWT-SVID": {
+			client:         tlsClient,
+			method:         http.MethodGet,
+			path:           "/v1/credentials",
+			token:          signer.sign(t, "spiffe://example.com/client", []string{"spiffe-connector"}, time.Now().Add(time.Hour)),
+			expectedStatus: http.StatusOK,
+			expectedToken:  "token-1",
+		},
+		"no credentials for clients without an ACL": {
+			client:         tlsClient,
+			method:         http.MethodGet,
+			path:           "/v1/credentials",
+			token:          signer.sign(t, "spiffe://example.com/other", []string{"spiffe-connector"}, time.Now().Add(time.Hour)),
+			expectedStatus: http.StatusOK,
+		},
+		"unauthenticated": {
+			client:         tlsClient,
+			method:         http.MethodGet,
+			path:           "/v1/credentials",
+			expectedStatus: http.StatusUnauthorized,
+			expectedCode:   codes.Unauthenticated,
+		},
+		"provider errors": {
+			client:         tlsClient,
+			method:         http.MethodGet,
+			path:           "/v1/credentials",
+			token:          signer.sign(t, "spiffe://example.com/broken", []string{"spiffe-connector"}, time.Now().Add(time.Hour)),
+			expectedStatus: http.StatusInternalServerError,
+			expectedCode:   codes.Unknown,
+		},
+		"other methods are not allowed": {
+			client:         mtlsClient,
+			method:         http.MethodPost,
+			path:           "/v1/credentials",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedCode:   codes.Unimplemented,
+		},
+		"unknown path": {
+			client:         mtlsClient,
+			method:         http.MethodGet,
+			path:           "/v1/other",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			req, err := http.NewRequest(testCase.method, "https://spiffe-connector"+testCase.path, nil)
+			require.NoError(t, err)
+			if testCase.token != "" {
+				req.Header.Set("Authorization", "Bearer "+testCase.token)
+			}
+			resp, err := testCase.client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, testCase.expectedStatus, resp.StatusCode, string(body))
+			switch testCase.expectedStatus {
+			case http.StatusOK:
+				credentials := &proto.GetCredentialsResponse{}
+				require.NoError(t, protojson.Unmarshal(body, credentials))
+				if testCase.expectedToken == "" {
+					assert.Empty(t, credentials.Credentials)
+					return
+				}
+				require.Len(t, credentials.Credentials, 1)
+				assert.Equal(t, testCase.expectedToken, credentials.Credentials[0].GetToken())
+			case http.StatusNotFound:
+			default:
+				var status struct {
+					Code    codes.Code `json:"code"`
+					Message string     `json:"message"`
+				}
+				require.NoError(t, json.Unmarshal(body, &status))
+				assert.Equal(t, testCase.expectedCode, status.Code)
+				assert.NotEmpty(t, status.Message)
+			}
+		})
+	}
+}
+
+func TestHTTPStatusFromCode(t *testing.T) {
+	testCases := map[codes.Code]int{
+		codes.OK:               http.StatusOK,
+		codes.Unauthenticated:  http.StatusUnauthorized,
+		codes.PermissionDenied: http.StatusForbidden,
+		codes.NotFound:         http.StatusNotFound,
+		codes.Unavailable:      http.StatusServiceUnavailable,
+		codes.DeadlineExceeded: http.StatusGatewayTimeout,
+		codes.Unknown:          http.StatusInternalServerError,
+		codes.Internal:         http.StatusInternalServerError,
+	}
+
+	for code, expected := range testCases {
+		t.Run(code.String(), func(t *testing.T) {
+			assert.Equal(t, expected, httpStatusFromCode(code))
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	// NetworkTCP listens on a TCP address such as [::]:9090
+	NetworkTCP = "tcp"
+	// NetworkUnix listens on a Unix domain socket, so that the server can run alongside its workloads on each node
+	NetworkUnix = "unix"
+)
+
+// ListenOptions configure where the server listens and the gRPC connection settings
+type ListenOptions struct {
+	// Network is either tcp or unix, defaults to tcp
+	Network string
+
+	// Address is the host:port to listen on for tcp, or the socket path for unix. Defaults to [::]:9090 for tcp.
+	Address string
+
+	// SocketMode is the file mode of a Unix domain socket, left as the umask allows if zero
+	SocketMode os.FileMode
+
+	// KeepaliveTime and KeepaliveTimeout are how long a connection is idle before the server pings the client, and
+	// how long it then waits for a reply before closing the connection. Both use the gRPC defaults if zero.
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+
+	// KeepaliveMinTime is the most often a client may ping the server, which closes connections pinging more often.
+	// Uses the gRPC default if zero.
+	KeepaliveMinTime time.Duration
+
+	// MaxRecvMsgSize and MaxSendMsgSize are the largest messages in bytes the server receives and sends, both use the
+	// gRPC defaults if zero
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+}
+
+func (o *ListenOptions) withDefaults() ListenOptions {
+	var options ListenOptions
+	if o != nil {
+		options = *o
+	}
+	if options.Network == "" {
+		options.Network = NetworkTCP
+	}
+	if options.Address == "" && options.Network == NetworkTCP {
+		options.Address = "[::]:9090"
+	}
+	return options
+}
+
+// listen opens the listener. A socket left behind by a server which did not shut down cleanly is removed first.
+func (o ListenOptions) listen() (net.Listener, error) {
+	switch o.Network {
+	case NetworkTCP:
+		return net.Listen(NetworkTCP, o.Address)
+	case NetworkUnix:
+		if o.Address == "" {
+			return nil, errors.New("a socket path is required")
+		}
+		if info, err := os.Lstat(o.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(o.Address); err != nil {
+				return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+			}
+		}
+		listener, err := net.Listen(NetworkUnix, o.Address)
+		if err != nil {
+			return nil, err
+		}
+		if o.SocketMode != 0 {
+			if err := os.Chmod(o.Address, o.SocketMode); err != nil {
+				listener.Close()
+				return nil, fmt.Errorf("failed to set socket mode: %w", err)
+			}
+		}
+		return listener, nil
+	default:
+		return nil, fmt.Errorf("network must be %s or %s", NetworkTCP, NetworkUnix)
+	}
+}
+
+// serverOptions returns the gRPC options for the keepalive and message size settings which are set
+func (o ListenOptions) serverOptions() []grpc.ServerOption {
+	var options []grpc.ServerOption
+	if o.KeepaliveTime > 0 || o.KeepaliveTimeout > 0 {
+		options = append(options, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    o.KeepaliveTime,
+			Timeout: o.KeepaliveTimeout,
+		}))
+	}
+	if o.KeepaliveMinTime > 0 {
+		options = append(options, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             o.KeepaliveMinTime,
+			PermitWithoutStream: true,
+		}))
+	}
+	if o.MaxRecvMsgSize > 0 {
+		options = append(options, grpc.MaxRecvMsgSize(o.MaxRecvMsgSize))
+	}
+	if o.MaxSendMsgSize > 0 {
+		options = append(options, grpc.MaxSendMsgSize(o.MaxSendMsgSize))
+	}
+	return options
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenOptions_Listen(t *testing.T) {
+	dir := t.TempDir()
+
+	// a socket left behind by a server which was killed
+	stale := filepath.Join(dir, "stale.sock")
+	staleListener, err := net.Listen(NetworkUnix, stale)
+	require.NoError(t, err)
+	staleListener.(*net.UnixListener).SetUnlinkOnClose(false)
+	staleListener.Close()
+
+	notSocket := filepath.Join(dir, "not-a-socket")
+	require.NoError(t, os.WriteFile(notSocket, []byte("data"), 0600))
+
+	testCases := map[string]struct {
+		options       ListenOptions
+		expectedMode  os.FileMode
+		expectedError error
+	}{
+		"tcp": {
+			options: ListenOptions{Network: NetworkTCP, Address: "localhost:0"},
+		},
+		"unix socket with a mode": {
+			options:      ListenOptions{Network: NetworkUnix, Address: filepath.Join(dir, "server.sock"), SocketMode: 0660},
+			expectedMode: 0660,
+		},
+		"stale unix socket is replaced": {
+			options: ListenOptions{Network: NetworkUnix, Address: stale},
+		},
+		"other files are not replaced": {
+			options:       ListenOptions{Network: NetworkUnix, Address: notSocket},
+			expectedError: errors.New("listen unix " + notSocket + ": bind: address already in use"),
+		},
+		"unix without a path": {
+			options:       ListenOptions{Network: NetworkUnix},
+			expectedError: errors.New("a socket path is required"),
+		},
+		"unknown network": {
+			options:       ListenOptions{Network: "udp", Address: "localhost:0"},
+			expectedError: errors.New("network must be tcp or unix"),
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			listener, err := testCase.options.withDefaults().listen()
+			if testCase.expectedError != nil {
+				assert.EqualError(t, err, testCase.expectedError.Error())
+				return
+			}
+			require.NoError(t, err)
+			defer listener.Close()
+
+			if testCase.expectedMode != 0 {
+				info, err := os.Stat(testCase.options.Address)
+				require.NoError(t, err)
+				assert.Equal(t, testCase.expectedMode, info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestListenOptions_WithDefaults(t *testing.T) {
+	var unset *ListenOptions
+	assert.Equal(t, ListenOptions{Network: NetworkTCP, Address: "[::]:9090"}, unset.withDefaults())
+	assert.Equal(t, ListenOptions{Network: NetworkUnix, Address: "/run/spiffe-connector.sock"}, (&ListenOptions{Network: NetworkUnix, Address: "/run/spiffe-connector.sock"}).withDefaults())
+	assert.Len(t, (&ListenOptions{KeepaliveTime: time.Minute, KeepaliveMinTime: time.Second, MaxRecvMsgSize: 1 << 20}).withDefaults().serverOptions(), 3)
+}
+
+func TestServer_Start(t *testing.T) {
+	listener, err := net.Listen(NetworkTCP, "localhost:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// listen errors are returned rather than panicking
+	s := Server{Listen: &ListenOptions{Address: listener.Addr().String()}}
+	err = s.Start(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to listen on tcp")
+
+	// the server stops when its context is cancelled
+	socket := filepath.Join(t.TempDir(), "server.sock")
+	s = Server{Listen: &ListenOptions{Network: NetworkUnix, Address: socket}}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- s.Start(ctx)
+	}()
+	waitForSocket(t, socket)
+
+	cancel()
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err), "the socket is removed when the server stops")
+}
+
+// waitForSocket waits for a server started in the background to listen on the socket
+func waitForSocket(t *testing.T, socket string) {
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	goproto "google.golang.org/protobuf/proto"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/provider"
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+// applyOutput rewrites the files and environment variables of a credential according to the output overrides of the
+// ACL credential. Files are referred to by the name given in the provider's FileOutputs or by their default path. A
+// file which the provider describes but did not write this time is not an error, a name which matches nothing is. The
+// credential is cloned before being changed, as it may be held in the store.
+func applyOutput(credential *proto.Credential, output *types.CredentialOutput, described []provider.FileOutput) (*proto.Credential, error) {
+	if output == nil {
+		return credential, nil
+	}
+
+	clone := goproto.Clone(credential).(*proto.Credential)
+
+	// files are matched against their original paths, so that overrides cannot affect each other
+	originalPaths := make([]string, len(clone.Files))
+	for i, f := range clone.Files {
+		originalPaths[i] = f.Path
+	}
+
+	names := make([]string, 0, len(output.Files))
+	for name := range output.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		override := output.Files[name]
+		matches, err := matchFiles(name, originalPaths, described)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) > 1 && override.Path != "" && !strings.HasSuffix(override.Path, "/") {
+			return nil, fmt.Errorf("output for file %q matches %d files, path must be a directory ending in /", name, len(matches))
+		}
+
+		mode, hasMode, err := override.FileMode()
+		if err != nil {
+			return nil, fmt.Errorf("output for file %q: %w", name, err)
+		}
+
+		for _, i := range matches {
+			switch {
+			case strings.HasSuffix(override.Path, "/"):
+				clone.Files[i].Path = override.Path + path.Base(originalPaths[i])
+			case override.Path != "":
+				clone.Files[i].Path = override.Path
+			}
+			if hasMode {
+				clone.Files[i].Mode = mode
+			}
+		}
+	}
+
+	for _, from := range sortedKeys(output.EnvVars) {
+		value, ok := clone.EnvVars[from]
+		if !ok {
+			return nil, fmt.Errorf("env var %q is not set by the credential", from)
+		}
+		delete(clone.EnvVars, from)
+		clone.EnvVars[output.EnvVars[from]] = value
+	}
+
+	for _, envVar := range sortedKeys(output.FileEnvVars) {
+		name := output.FileEnvVars[envVar]
+		matches, err := matchFiles(name, originalPaths, described)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) != 1 {
+			return nil, fmt.Errorf("env var %q must refer to exactly one file, %q matches %d", envVar, name, len(matches))
+		}
+		if clone.EnvVars == nil {
+			clone.EnvVars = make(map[string]string)
+		}
+		clone.EnvVars[envVar] = clone.Files[matches[0]].Path
+	}
+
+	return clone, nil
+}
+
+// matchFiles returns the indexes of the paths referred to by name, which is either the name of a described file or a
+// default path
+func matchFiles(name string, paths []string, described []provider.FileOutput) ([]int, error) {
+	pattern, known := name, false
+	for _, d := range described {
+		if d.Name == name {
+			pattern, known = d.Path, true
+			break
+		}
+	}
+
+	var matches []int
+	for i, p := range paths {
+		matched, err := path.Match(pattern, p)
+		if err != nil {
+			return nil, fmt.Errorf("file %q is not a valid path pattern: %w", name, err)
+		}
+		if matched {
+			matches = append(matches, i)
+		}
+	}
+
+	if len(matches) == 0 && !known {
+		return nil, fmt.Errorf("output for file %q matches no file written by the credential", name)
+	}
+	return matches, nil
+}
+
+// sortedKeys returns the keys of m in order, so overrides are applied the same way every time
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
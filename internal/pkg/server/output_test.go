@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/provider"
+	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+func TestApplyOutput(t *testing.T) {
+	described := []provider.FileOutput{
+		{Name: "application_default_credentials", Path: "~/.config/gcloud/application_default_credentials.json"},
+		{Name: "token", Path: "~/.config/spiffe-connector/tokens/*.jwt"},
+		{Name: "config", Path: "~/.aws/config"},
+	}
+	credential := &proto.Credential{
+		Files: []*proto.File{
+			{Path: "~/.config/gcloud/application_default_credentials.json", Mode: 0644, Contents: []byte("{}")},
+			{Path: "~/.config/spiffe-connector/tokens/orders-api.jwt", Mode: 0600, Contents: []byte("jwt")},
+		},
+		EnvVars: map[string]string{"CLOUDSDK_AUTH_ACCESS_TOKEN": "token"},
+	}
+
+	testCases := map[string]struct {
+		output          *types.CredentialOutput
+		expectedFiles   map[string]uint32
+		expectedEnvVars map[string]string
+		expectedError   error
+	}{
+		"without overrides": {
+			expectedFiles: map[string]uint32{
+				"~/.config/gcloud/application_default_credentials.json": 0644,
+				"~/.config/spiffe-connector/tokens/orders-api.jwt":      0600,
+			},
+			expectedEnvVars: map[string]string{"CLOUDSDK_AUTH_ACCESS_TOKEN": "token"},
+		},
+		"file path and mode by name, with an env var pointing at it": {
+			output: &types.CredentialOutput{
+				Files: map[string]types.FileOutput{
+					"application_default_credentials": {Path: "/var/run/secrets/gcp/adc.json", Mode: "0600"},
+				},
+				FileEnvVars: map[string]string{"GOOGLE_APPLICATION_CREDENTIALS": "application_default_credentials"},
+			},
+			expectedFiles: map[string]uint32{
+				"/var/run/secrets/gcp/adc.json":                    0600,
+				"~/.config/spiffe-connector/tokens/orders-api.jwt": 0600,
+			},
+			expectedEnvVars: map[string]string{
+				"CLOUDSDK_AUTH_ACCESS_TOKEN":     "token",
+				"GOOGLE_APPLICATION_CREDENTIALS": "/var/run/secrets/gcp/adc.json",
+			},
+		},
+		"file moved to a directory by its default path": {
+			output: &types.CredentialOutput{
+				Files: map[string]types.FileOutput{
+					"~/.config/spiffe-connector/tokens/orders-api.jwt": {Path: "/tokens/"},
+				},
+				FileEnvVars: map[string]string{"ORDERS_TOKEN_FILE": "token"},
+			},
+			expectedFiles: map[string]uint32{
+				"~/.config/gcloud/application_default_credentials.json": 0644,
+				"/tokens/orders-api.jwt":                                0600,
+			},
+			expectedEnvVars: map[string]string{
+				"CLOUDSDK_AUTH_ACCESS_TOKEN": "token",
+				"ORDERS_TOKEN_FILE":          "/tokens/orders-api.jwt",
+			},
+		},
+		"env var renamed": {
+			output: &types.CredentialOutput{
+				EnvVars: map[string]string{"CLOUDSDK_AUTH_ACCESS_TOKEN": "GCP_TOKEN"},
+			},
+			expectedFiles: map[string]uint32{
+				"~/.config/gcloud/application_default_credentials.json": 0644,
+				"~/.config/spiffe-connector/tokens/orders-api.jwt":      0600,
+			},
+			expectedEnvVars: map[string]string{"GCP_TOKEN": "token"},
+		},
+		"described file which was not written": {
+			output: &types.CredentialOutput{
+				Files: map[string]types.FileOutput{"config": {Mode: "0600"}},
+			},
+			expectedFiles: map[string]uint32{
+				"~/.config/gcloud/application_default_credentials.json": 0644,
+				"~/.config/spiffe-connector/tokens/orders-api.jwt":      0600,
+			},
+			expectedEnvVars: map[string]string{"CLOUDSDK_AUTH_ACCESS_TOKEN": "token"},
+		},
+		"unknown file": {
+			output: &types.CredentialOutput{
+				Files: map[string]types.FileOutput{"kubeconfig": {Mode: "0600"}},
+			},
+			expectedError: errors.New(`output for file "kubeconfig" matches no file written by the credential`),
+		},
+		"unknown env var": {
+			output: &types.CredentialOutput{
+				EnvVars: map[string]string{"AWS_ACCESS_KEY_ID": "KEY"},
+			},
+			expectedError: errors.New(`env var "AWS_ACCESS_KEY_ID" is not set by the credential`),
+		},
+		"env var for a file which was not written": {
+			output: &types.CredentialOutput{
+				FileEnvVars: map[string]string{"AWS_CONFIG_FILE": "config"},
+			},
+			expectedError: errors.New(`env var "AWS_CONFIG_FILE" must refer to exactly one file, "config" matches 0`),
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			result, err := applyOutput(credential, testCase.output, described)
+			if testCase.expectedError != nil {
+				assert.EqualError(t, err, testCase.expectedError.Error())
+				return
+			}
+			require.NoError(t, err)
+
+			files := make(map[string]uint32)
+			for _, f := range result.Files {
+				files[f.Path] = f.Mode
+			}
+			assert.Equal(t, testCase.expectedFiles, files)
+			assert.Equal(t, testCase.expectedEnvVars, result.EnvVars)
+
+			// the credential passed in may be cached, so must not be changed
+			assert.Equal(t, "~/.config/gcloud/application_default_credentials.json", credential.Files[0].Path)
+			assert.Equal(t, map[string]string{"CLOUDSDK_AUTH_ACCESS_TOKEN": "token"}, credential.EnvVars)
+		})
+	}
+
+	tokens := &proto.Credential{Files: []*proto.File{
+		{Path: "~/.config/spiffe-connector/tokens/orders-api.jwt"},
+		{Path: "~/.config/spiffe-connector/tokens/payments-api.jwt"},
+	}}
+	_, err := applyOutput(tokens, &types.CredentialOutput{
+		Files: map[string]types.FileOutput{"token": {Path: "/secrets/token"}},
+	}, described)
+	assert.EqualError(t, err, `output for file "token" matches 2 files, path must be a directory ending in /`)
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/cache"
+)
+
+// RefreshOptions configure the background refresh of stored credentials
+type RefreshOptions struct {
+	// Fraction is how far through its lifetime a credential is refreshed, defaults to 0.75
+	Fraction float64
+
+	// Jitter is the largest fraction of the lifetime by which a refresh is randomly brought forward, so that
+	// credentials issued together are not all refreshed together. Defaults to 0.1, or half of Fraction if smaller.
+	Jitter float64
+
+	// Interval is how often stored credentials are checked, defaults to 10s
+	Interval time.Duration
+
+	// IdleTimeout is how long a credential can go unrequested before it is dropped rather than refreshed, defaults
+	// to 1h
+	IdleTimeout time.Duration
+}
+
+func (o *RefreshOptions) withDefaults() RefreshOptions {
+	options := *o
+	if options.Fraction <= 0 {
+		options.Fraction = 0.75
+	}
+	if options.Jitter <= 0 {
+		options.Jitter = 0.1
+		if options.Jitter > options.Fraction/2 {
+			options.Jitter = options.Fraction / 2
+		}
+	}
+	if options.Interval <= 0 {
+		options.Interval = 10 * time.Second
+	}
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = time.Hour
+	}
+	return options
+}
+
+// refreshAt returns when the credential in the entry should be refreshed, or zero if it does not expire
+func (o *RefreshOptions) refreshAt(entry *cache.Entry) time.Time {
+	if entry.Credential.NotAfter == nil {
+		return time.Time{}
+	}
+	lifetime := entry.Credential.NotAfter.AsTime().Sub(entry.IssuedAt)
+	if lifetime <= 0 {
+		return time.Time{}
+	}
+
+	options := o.withDefaults()
+	fraction := options.Fraction - options.Jitter*rand.Float64()
+	return entry.IssuedAt.Add(time.Duration(float64(lifetime) * fraction))
+}
+
+// refreshLoop refreshes stored credentials every interval until the context is cancelled
+func (s *Server) refreshLoop(ctx context.Context, options RefreshOptions) {
+	t := time.NewTicker(options.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.refresh(ctx, time.Now().UTC(), options.IdleTimeout)
+		}
+	}
+}
+
+// refresh issues the stored credentials which are due to be refreshed again, and drops those which have not been
+// requested within idleTimeout so that credentials are not issued for workloads which have gone away. A credential
+// which fails to refresh is kept, and tried again next time. Credentials loaded from a persistent cache have not been
+// requested since the server started, so are treated as requested at now the first time they are seen.
+//
+// When the cache is shared with other servers, idle credentials are left for those servers rather than dropped, as
+// they may still be requested there, and each refresh is locked so that only one server issues it.
+func (s *Server) refresh(ctx context.Context, now time.Time, idleTimeout time.Duration) {
+	c := s.cache()
+	locker, shared := c.(cache.Locker)
+	keys, err := c.Keys()
+	if err != nil {
+		log.Printf("failed to list cached credentials to refresh: %s", err)
+		return
+	}
+
+	// idle credentials are found while holding the lock, but dropped after releasing it so that requests are not held
+	// up by a slow cache
+	idle := make(map[string]bool)
+	s.mu.Lock()
+	if s.lastRequested == nil {
+		s.lastRequested = make(map[string]time.Time)
+	}
+	for _, key := range keys {
+		lastRequested, ok := s.lastRequested[key]
+		if !ok {
+			lastRequested = now
+			s.lastRequested[key] = now
+		}
+		if now.Sub(lastRequested) > idleTimeout {
+			idle[key] = true
+			if !shared {
+				delete(s.lastRequested, key)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if !shared {
+		for key := range idle {
+			if err := c.Delete(key); err != nil {
+				log.Printf("failed to drop idle credential %q from the cache: %s", key, err)
+			}
+		}
+	}
+
+	due := make(map[string]*cache.Entry)
+	listed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		listed[key] = true
+		if idle[key] {
+			continue
+		}
+
+		entry, ok, err := c.Get(key)
+		if err != nil {
+			log.Printf("failed to read credential %q from the cache: %s", key, err)
+			continue
+		}
+		if ok && !entry.RefreshAt.IsZero() && !now.Before(entry.RefreshAt) {
+			due[key] = entry
+		}
+	}
+
+	if shared {
+		// forget credentials which have expired from the shared cache, so that their idle time does not grow forever
+		s.mu.Lock()
+		for key := range s.lastRequested {
+			if !listed[key] {
+				delete(s.lastRequested, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	for key, entry := range due {
+		s.refreshEntry(ctx, c, locker, key, entry)
+	}
+}
+
+// refreshEntry issues the credential in entry again, replacing it in the cache unless it has been replaced or dropped
+// while it was being issued
+func (s *Server) refreshEntry(ctx context.Context, c cache.Cache, locker cache.Locker, key string, entry *cache.Entry) {
+	p, ok := s.Providers[entry.Request.Credential.Provider]
+	if !ok {
+		log.Printf("failed to refresh credential %q in the background: server is not configured with %q provider", key, entry.Request.Credential.Provider)
+		return
+	}
+
+	if locker != nil {
+		unlock, err := locker.Lock(key)
+		if err != nil {
+			log.Printf("failed to lock credential %q to refresh it in the background: %s", key, err)
+			return
+		}
+		defer unlock()
+		// another server may have refreshed the credential while this one waited for the lock
+		if current, ok, err := c.Get(key); err != nil || !ok || !current.IssuedAt.Equal(entry.IssuedAt) {
+			return
+		}
+	}
+
+	refreshed, err := s.issue(ctx, p, entry.Request, entry)
+	if err != nil {
+		log.Printf("failed to refresh credential %q in the background: %s", key, err)
+		return
+	}
+	refreshed.RefreshAt = s.Refresh.refreshAt(refreshed)
+
+	// the credential may have been replaced by a request, or dropped, while it was being refreshed. With a Locker this
+	// is checked under the lock taken above. Without one a request may still store a credential between the check
+	// and the write, in which case the refreshed credential replaces another which is equally valid.
+	if current, ok, err := c.Get(key); err == nil && ok && current.IssuedAt.Equal(entry.IssuedAt) {
+		if err := c.Set(key, refreshed); err != nil {
+			log.Printf("failed to write refreshed credential %q to the cache: %s", key, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jetstack/spiffe-connector/internal/pkg/cache"
+	"github.com/jetstack/spiffe-connector/internal/pkg/provider"
+	"github.com/jetstack/spiffe-connector/types"
+)
+
+func TestServer_Refresh(t *testing.T) {
+	testCases := map[string]struct {
+		renewErr, issueErr error
+		after              time.Duration
+		expectedToken      string
+		expectedIssued     int
+		expectedRenewals   int
+		expectedStored     bool
+	}{
+		"credentials are left alone before they are due": {
+			after:          20 * time.Minute,
+			expectedToken:  "token-1",
+			expectedIssued: 1,
+			expectedStored: true,
+		},
+		"due credentials are renewed": {
+			after:            40 * time.Minute,
+			expectedToken:    "token-1",
+			expectedIssued:   1,
+			expectedRenewals: 1,
+			expectedStored:   true,
+		},
+		"due credentials which cannot be renewed are issued again": {
+			renewErr:       errors.New("lease not found"),
+			after:          40 * time.Minute,
+			expectedToken:  "token-2",
+			expectedIssued: 2,
+			expectedStored: true,
+		},
+		"credentials which fail to refresh are kept": {
+			renewErr:       errors.New("lease not found"),
+			issueErr:       errors.New("upstream unavailable"),
+			after:          40 * time.Minute,
+			expectedToken:  "token-1",
+			expectedIssued: 1,
+			expectedStored: true,
+		},
+		"idle credentials are dropped": {
+			after:          2 * time.Hour,
+			expectedIssued: 1,
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			p := &renewingProvider{lifetime: time.Hour, renewErr: testCase.renewErr}
+			s := Server{
+				Providers: map[string]provider.Provider{"RenewingProvider": p},
+				Refresh:   &RefreshOptions{Fraction: 0.5, Jitter: 0.01},
+			}
+			request := provider.Request{
+				ObjectReference: "lease",
+				Credential:      types.Credential{Provider: "RenewingProvider", ObjectReference: "lease"},
+			}
+
+			_, err := s.credential(context.Background(), p, request, "RenewingProvider/lease")
+			require.NoError(t, err)
+			entry, ok, err := s.Cache.Get("RenewingProvider/lease")
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.WithinDuration(t, entry.IssuedAt.Add(30*time.Minute), entry.RefreshAt, 40*time.Second, "refresh is half way through the lifetime, with jitter")
+
+			p.issueErr = testCase.issueErr
+			s.refresh(context.Background(), time.Now().UTC().Add(testCase.after), time.Hour)
+
+			assert.Equal(t, testCase.expectedIssued, p.issued)
+			assert.Equal(t, testCase.expectedRenewals, p.renewals)
+			entry, ok, err = s.Cache.Get("RenewingProvider/lease")
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedStored, ok)
+			if ok {
+				assert.Equal(t, testCase.expectedToken, *entry.Credential.Token)
+			}
+		})
+	}
+}
+
+// hookCache calls onSet and onDelete, if set, before writing to the cache it wraps
+type hookCache struct {
+	cache.Cache
+	onSet, onDelete func(key string)
+}
+
+func (c *hookCache) Set(key string, entry *cache.Entry) error {
+	if c.onSet != nil {
+		c.onSet(key)
+	}
+	return c.Cache.Set(key, entry)
+}
+
+func (c *hookCache) Delete(key string) error {
+	if c.onDelete != nil {
+		c.onDelete(key)
+	}
+	return c.Cache.Delete(key)
+}
+
+func TestServer_Refresh_DropsIdleWithoutLock(t *testing.T) {
+	p := &renewingProvider{lifetime: time.Hour}
+	s := &Server{Providers: map[string]provider.Provider{"RenewingProvider": p}}
+	// a request arriving while an idle credential is dropped must not wait for the cache
+	s.Cache = &hookCache{Cache: cache.NewMemory(), onDelete: func(string) { s.touch("RenewingProvider/other", time.Now()) }}
+	request := provider.Request{
+		ObjectReference: "lease",
+		Credential:      types.Credential{Provider: "RenewingProvider", ObjectReference: "lease"},
+	}
+	_, err := s.credential(context.Background(), p, request, "RenewingProvider/lease")
+	require.NoError(t, err)
+
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+		s.refresh(context.Background(), time.Now().UTC().Add(2*time.Hour), time.Hour)
+	}()
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresh held the server lock while dropping an idle credential")
+	}
+
+	_, ok, err := s.Cache.Get("RenewingProvider/lease")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestRefreshOptions_WithDefaults(t *testing.T) {
+	assert.Equal(t, RefreshOptions{Fraction: 0.75, Jitter: 0.1, Interval: 10 * time.Second, IdleTimeout: time.Hour}, (&RefreshOptions{}).withDefaults())
+	assert.Equal(t, 0.05, (&RefreshOptions{Fraction: 0.1}).withDefaults().Jitter, "jitter cannot bring a refresh forward to before issue")
+}
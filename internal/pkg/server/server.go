@@ -2,18 +2,20 @@ package server
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 
-	"github.com/spiffe/go-spiffe/v2/spiffegrpc/grpccredentials"
-	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	goproto "google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
-	"github.com/jetstack/spiffe-connector/internal/pkg/config"
+	"github.com/jetstack/spiffe-connector/internal/pkg/cache"
 	"github.com/jetstack/spiffe-connector/internal/pkg/principal"
 	"github.com/jetstack/spiffe-connector/internal/pkg/provider"
 	"github.com/jetstack/spiffe-connector/internal/pkg/server/proto"
@@ -27,7 +29,35 @@ type Server struct {
 	// Providers is a list of the credential providers available to get credentials
 	Providers map[string]provider.Provider
 
-	credentialStore map[string]proto.Credential
+	// Refresh enables issuing stored credentials again in the background before they expire, if set
+	Refresh *RefreshOptions
+
+	// Freshness decides how long stored credentials are handed out for. ProviderFreshness overrides it for the named
+	// providers, and the freshness of an ACL credential overrides both.
+	Freshness         *types.FreshnessPolicy
+	ProviderFreshness map[string]types.FreshnessPolicy
+
+	// Listen configures where the server listens, defaults to tcp on [::]:9090
+	Listen *ListenOptions
+
+	// HTTP serves the HTTP/JSON API on a second listener when set, with the same TLS identity and authentication as
+	// the gRPC API. Only the network, address and socket mode are used, the address defaults to [::]:9443 for tcp.
+	HTTP *ListenOptions
+
+	// Auth configures how clients authenticate, defaults to mTLS with an X.509-SVID only
+	Auth *types.AuthConfig
+
+	// Cache holds the credentials which have been issued, defaults to an in memory cache
+	Cache cache.Cache
+
+	// cacheOnce creates the default cache the first time it is needed. The cache does its own locking, and the
+	// writes of servers sharing it are serialized with its Locker.
+	cacheOnce sync.Once
+
+	// mu guards lastRequested. When each stored credential was last requested is kept in memory, so that the cache is
+	// only written when credentials are issued.
+	mu            sync.Mutex
+	lastRequested map[string]time.Time
 
 	proto.UnimplementedSpiffeConnectorServer
 }
@@ -36,11 +66,12 @@ func (s *Server) GetCredentials(ctx context.Context, empty *emptypb.Empty) (*pro
 	resp := &proto.GetCredentialsResponse{}
 
 	// Get the connecting SPIFFE ID
-	clientSVID, hasSVID := grpccredentials.PeerIDFromContext(ctx)
-	if !hasSVID {
-		return resp, errors.New("no SVID provided")
+	clientSVID, authMethod, err := s.authenticate(ctx)
+	if err != nil {
+		log.Printf("failed to authenticate client: %s", err)
+		return resp, status.Error(codes.Unauthenticated, err.Error())
 	}
-	log.Printf("Obtaining credentials for %s\n", clientSVID.String())
+	log.Printf("Obtaining credentials for %s (auth: %s)\n", clientSVID.String(), authMethod)
 
 	// find any ACL matches for the caller. If there are no matches, an empty list of credentials will be returned
 	acl, err := principal.MatchingACL(s.ACLs, clientSVID.String())
@@ -53,6 +84,8 @@ func (s *Server) GetCredentials(ctx context.Context, empty *emptypb.Empty) (*pro
 		return resp, nil
 	}
 
+	// issuers holds the provider of each credential in resp, so that their files can be merged
+	var issuers []provider.Provider
 	for _, aclCred := range acl.Credentials {
 		// if the config references a provider not initialized for the server, then we error out. This is most likely
 		// invalid config
@@ -63,43 +96,285 @@ func (s *Server) GetCredentials(ctx context.Context, empty *emptypb.Empty) (*pro
 			return nil, err
 		}
 
-		fmt.Println(aclCred.Key())
-		existingCredential, ok := s.credentialStore[aclCred.Key()]
-		if ok {
-			// TODO make this expiry logic based on the lifetime of the credential?
-			if existingCredential.NotAfter.AsTime().After(time.Now().UTC().Add(5 * time.Minute)) {
-				resp.Credentials = append(resp.Credentials, &existingCredential)
-				continue
-			}
+		request := provider.Request{
+			ObjectReference: aclCred.ObjectReference,
+			Principal:       clientSVID,
+			MatchPrincipal:  acl.MatchPrincipal,
+			Credential:      aclCred,
 		}
 
-		credential, err := p.GetCredential(aclCred.ObjectReference)
+		// credentials which are specific to the caller are stored separately for each principal
+		storeKey := aclCred.Key()
+		if provider.PerPrincipal(p, request) {
+			storeKey = fmt.Sprintf("%s/%s", storeKey, clientSVID.String())
+		}
+
+		stored, err := s.credential(ctx, p, request, storeKey)
 		if err != nil {
 			err := fmt.Errorf("failed to get credential %q from %q provider: %w", aclCred.ObjectReference, aclCred.Provider, err)
 			log.Println(err)
 			return nil, err
 		}
 
-		if s.credentialStore == nil {
-			s.credentialStore = make(map[string]proto.Credential)
+		credential, err := applyOutput(stored, aclCred.Output, provider.FileOutputs(p))
+		if err != nil {
+			err := fmt.Errorf("failed to apply output of credential %q from %q provider: %w", aclCred.ObjectReference, aclCred.Provider, err)
+			log.Println(err)
+			return nil, err
 		}
-		s.credentialStore[aclCred.Key()] = *credential
-
 		resp.Credentials = append(resp.Credentials, credential)
+		issuers = append(issuers, p)
+	}
+
+	resp.Credentials, err = mergeFiles(resp.Credentials, issuers)
+	if err != nil {
+		err := fmt.Errorf("failed to merge credential files: %w", err)
+		log.Println(err)
+		return nil, err
 	}
 
 	return resp, nil
 }
 
-func (s *Server) Start(ctx context.Context) {
-	server := grpc.NewServer(grpc.Creds(grpccredentials.MTLSServerCredentials(config.CurrentSource, config.CurrentSource, tlsconfig.AuthorizeAny())))
-	proto.RegisterSpiffeConnectorServer(server, s)
-	listener, err := net.Listen("tcp", "[::]:9090")
+// credential returns the credential held in the cache under storeKey. If there is none, or it is about to expire, it is
+// renewed if the provider supports it, or issued again. Cache errors are logged rather than failing the request, as
+// the credential can always be issued again.
+func (s *Server) credential(ctx context.Context, p provider.Provider, request provider.Request, storeKey string) (*proto.Credential, error) {
+	s.touch(storeKey, time.Now().UTC())
+
+	entry, ok, err := s.cache().Get(storeKey)
 	if err != nil {
-		panic("fail")
+		log.Printf("failed to read credential %q from the cache: %s", storeKey, err)
+	}
+	if ok && s.freshnessFor(request.Credential).fresh(entry, time.Now().UTC()) {
+		return entry.Credential, nil
 	}
 
-	if err := server.Serve(listener); err != nil {
-		panic(err)
+	// when the cache is shared, only one server issues the credential, and the others hand out what it stored
+	if locker, ok := s.cache().(cache.Locker); ok {
+		unlock, err := locker.Lock(storeKey)
+		if err != nil {
+			log.Printf("failed to lock credential %q, issuing it anyway: %s", storeKey, err)
+		} else {
+			defer unlock()
+			if current, ok, err := s.cache().Get(storeKey); err == nil && ok && (entry == nil || !current.IssuedAt.Equal(entry.IssuedAt)) {
+				if s.freshnessFor(request.Credential).fresh(current, time.Now().UTC()) {
+					return current.Credential, nil
+				}
+				entry = current
+			}
+		}
+	}
+
+	// the server is not locked while the provider is called, so that other credentials can still be handed out
+	entry, err = s.issue(ctx, p, request, entry)
+	if err != nil {
+		return nil, err
+	}
+	s.store(storeKey, entry)
+	return entry.Credential, nil
+}
+
+// cache returns the cache of issued credentials, creating an in memory one if none was configured
+func (s *Server) cache() cache.Cache {
+	s.cacheOnce.Do(func() {
+		if s.Cache == nil {
+			s.Cache = cache.NewMemory()
+		}
+	})
+	return s.Cache
+}
+
+// touch records that the credential stored under storeKey was requested at now
+func (s *Server) touch(storeKey string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastRequested == nil {
+		s.lastRequested = make(map[string]time.Time)
+	}
+	s.lastRequested[storeKey] = now
+}
+
+// store puts the entry in the cache under storeKey, scheduling its background refresh if enabled
+func (s *Server) store(storeKey string, entry *cache.Entry) {
+	if s.Refresh != nil {
+		entry.RefreshAt = s.Refresh.refreshAt(entry)
+	}
+
+	if err := s.cache().Set(storeKey, entry); err != nil {
+		log.Printf("failed to write credential %q to the cache: %s", storeKey, err)
+	}
+}
+
+// issue renews the previous credential if there is one and the provider implements provider.Renewer, or issues a new
+// credential otherwise. Renewal failures are logged, as the credential is issued again instead.
+func (s *Server) issue(ctx context.Context, p provider.Provider, request provider.Request, previous *cache.Entry) (*cache.Entry, error) {
+	f := s.freshnessFor(request.Credential)
+	if renewer, ok := p.(provider.Renewer); ok && previous != nil {
+		credential, err := renewer.Renew(request, previous.Credential)
+		if err == nil {
+			return s.issued(p, request, newCacheEntry(request, credential, f)), nil
+		}
+		log.Printf("failed to renew credential %q from %q provider, issuing a new one: %s", request.Credential.ObjectReference, request.Credential.Provider, err)
+	}
+
+	credential, err := provider.GetCredential(ctx, p, request)
+	if err != nil {
+		return nil, err
+	}
+	return s.issued(p, request, newCacheEntry(request, credential, f)), nil
+}
+
+// issued tells providers implementing provider.IssueObserver about the entry they issued, once its renewal hint is set
+func (s *Server) issued(p provider.Provider, request provider.Request, entry *cache.Entry) *cache.Entry {
+	if observer, ok := p.(provider.IssueObserver); ok {
+		observer.Issued(request, entry.Credential)
+	}
+	return entry
+}
+
+// newCacheEntry wraps a credential which has just been issued or renewed. Unless the provider set one, the credential
+// is given a renewal hint of when the server will stop handing it out, or half way through its lifetime if that is
+// later, so that short lived credentials are not requested continuously.
+func newCacheEntry(request provider.Request, credential *proto.Credential, f freshness) *cache.Entry {
+	now := time.Now().UTC()
+	entry := &cache.Entry{Credential: credential, IssuedAt: now, Request: request}
+	if credential.RenewAfter == nil {
+		renewAfter := f.staleAt(entry)
+		if credential.NotAfter != nil {
+			if halfway := now.Add(credential.NotAfter.AsTime().Sub(now) / 2); halfway.After(renewAfter) {
+				renewAfter = halfway
+			}
+		}
+		// credentials which are never stale, or are issued for every request, have no hint
+		if renewAfter.After(now) {
+			credential.RenewAfter = timestamppb.New(renewAfter)
+		}
+	}
+	return entry
+}
+
+// mergeFiles combines files written to the same path by more than one credential from a provider implementing
+// provider.FileMerger. The merged file replaces the first occurrence and is removed from the later credentials. Other
+// duplicate paths are left as they are. Credentials are cloned before being changed, as they may be held in the store.
+func mergeFiles(credentials []*proto.Credential, issuers []provider.Provider) ([]*proto.Credential, error) {
+	type location struct {
+		credential, file int
+	}
+	seen := make(map[string]location)
+
+	merged := make([]*proto.Credential, len(credentials))
+	for i, credential := range credentials {
+		merged[i] = credential
+		if len(credential.Files) == 0 {
+			continue
+		}
+		merger, ok := issuers[i].(provider.FileMerger)
+
+		var files []*proto.File
+		for _, f := range credential.Files {
+			first, found := seen[f.Path]
+			if !found || !ok || issuers[first.credential] != issuers[i] {
+				if !found {
+					seen[f.Path] = location{credential: i, file: len(files)}
+				}
+				files = append(files, f)
+				continue
+			}
+
+			mergedFile, err := merger.MergeFiles(merged[first.credential].Files[first.file], f)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Path, err)
+			}
+			if first.credential != i {
+				merged[first.credential] = cloneWithFile(merged[first.credential], first.file, mergedFile)
+			} else {
+				files[first.file] = mergedFile
+			}
+		}
+
+		if len(files) != len(credential.Files) {
+			clone := goproto.Clone(credential).(*proto.Credential)
+			clone.Files = files
+			merged[i] = clone
+		}
+	}
+
+	return merged, nil
+}
+
+// cloneWithFile returns a copy of the credential with the file at index i replaced
+func cloneWithFile(credential *proto.Credential, i int, f *proto.File) *proto.Credential {
+	clone := goproto.Clone(credential).(*proto.Credential)
+	clone.Files[i] = f
+	return clone
+}
+
+// Start serves the gRPC API, and the HTTP/JSON API if it is enabled, until the context is cancelled, when the server
+// stops accepting connections and waits for the requests in progress to finish
+func (s *Server) Start(ctx context.Context) error {
+	listenOptions := s.Listen.withDefaults()
+	listener, err := listenOptions.listen()
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s %q: %w", listenOptions.Network, listenOptions.Address, err)
+	}
+
+	var httpOptions ListenOptions
+	var httpListener net.Listener
+	if s.HTTP != nil {
+		httpOptions = s.httpListenOptions()
+		httpListener, err = httpOptions.listen()
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to listen for HTTP on %s %q: %w", httpOptions.Network, httpOptions.Address, err)
+		}
+	}
+
+	// both APIs stop when either of them does, rather than one running on alone
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if s.Refresh != nil {
+		go s.refreshLoop(ctx, s.Refresh.withDefaults())
+	}
+
+	serverOptions := append([]grpc.ServerOption{
+		grpc.Creds(s.transportCredentials()),
+	}, listenOptions.serverOptions()...)
+	server := grpc.NewServer(serverOptions...)
+	proto.RegisterSpiffeConnectorServer(server, s)
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Printf("shutting down server on %s %q", listenOptions.Network, listenOptions.Address)
+			server.GracefulStop()
+		case <-stopped:
+		}
+	}()
+
+	httpErr := make(chan error, 1)
+	if httpListener != nil {
+		go func() {
+			log.Printf("serving HTTP on %s %q", httpOptions.Network, httpOptions.Address)
+			err := serveHTTP(ctx, s.newHTTPServer(), httpListener)
+			cancel()
+			httpErr <- err
+		}()
+	} else {
+		httpErr <- nil
+	}
+
+	log.Printf("serving on %s %q", listenOptions.Network, listenOptions.Address)
+	serveErr := server.Serve(listener)
+	cancel()
+	if err := <-httpErr; err != nil && serveErr == nil {
+		return err
+	}
+	if serveErr != nil {
+		return fmt.Errorf("failed to serve: %w", serveErr)
 	}
+	return nil
 }
@@ -1,17 +1,21 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/maxatome/go-testdeep/td"
 	"github.com/spiffe/go-spiffe/v2/spiffegrpc/grpccredentials"
@@ -24,6 +28,7 @@ import (
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"github.com/jetstack/spiffe-connector/internal/pkg/cache"
 	"github.com/jetstack/spiffe-connector/internal/pkg/config"
 	"github.com/jetstack/spiffe-connector/internal/pkg/cryptoutil"
 	"github.com/jetstack/spiffe-connector/internal/pkg/provider"
@@ -84,6 +89,7 @@ func TestServer_GetCredentials(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
+	config.StoreCurrentSource(serverConfigSource)
 
 	// create providers
 	googleSAKeyFileData := "ewogICJ0eXBlIjogInNlcnZpY2VfYWNjb3VudCIsCiAgInByb2plY3RfaWQiOiAiMTIzNCIsCiAgInByaXZhdGVfa2V5X2lkIjogInh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHgiLAogICJwcml2YXRlX2tleSI6ICJ4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHgiLAogICJjbGllbnRfZW1haWwiOiAib2stc2FAMTIzNC5pYW0uZ3NlcnZpY2VhY2NvdW50LmNvbSIsCiAgImNsaWVudF9pZCI6ICJ4eHh4eHh4eHh4eHh4eHh4eHh4eHgiLAogICJhdXRoX3VyaSI6ICJodHRwczovL2FjY291bnRzLmdvb2dsZS5jb20vby9vYXV0aDIvYXV0aCIsCiAgInRva2VuX3VyaSI6ICJodHRwczovL29hdXRoMi5nb29nbGVhcGlzLmNvbS90b2tlbiIsCiAgImF1dGhfcHJvdmlkZXJfeDUwOV9jZXJ0X3VybCI6ICJodHRwczovL3d3dy5nb29nbGVhcGlzLmNvbS9vYXV0aDIvdjEvY2VydHMiLAogICJjbGllbnRfeDUwOV9jZXJ0X3VybCI6ICJodHRwczovL3d3dy5nb29nbGVhcGlzLmNvbS9yb2JvdC92MS9tZXRhZGF0YS94NTA5L29rLXNhJTQwMTIzNC5pYW0uZ3NlcnZpY2VhY2NvdW50LmNvbSIKfQo="
@@ -191,7 +197,8 @@ func TestServer_GetCredentials(t *testing.T) {
 			ExpectedCredentials: []td.TestDeep{
 				td.Slice([]*proto.Credential{}, td.ArrayEntries{
 					0: &proto.Credential{
-						NotAfter: timestamppb.New(time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)),
+						NotAfter:   timestamppb.New(time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)),
+						RenewAfter: timestamppb.New(time.Date(9999, 12, 31, 23, 54, 59, 0, time.UTC)),
 						Files: []*proto.File{
 							{
 								Path:     "~/.config/gcloud/application_default_credentials.json",
@@ -248,7 +255,8 @@ aws_session_token = sessiontoken-1
 			ExpectedCredentials: []td.TestDeep{
 				td.Slice([]*proto.Credential{}, td.ArrayEntries{
 					0: &proto.Credential{
-						NotAfter: timestamppb.New(time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)),
+						NotAfter:   timestamppb.New(time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)),
+						RenewAfter: timestamppb.New(time.Date(9999, 12, 31, 23, 54, 59, 0, time.UTC)),
 						Files: []*proto.File{
 							{
 								Path:     "~/.config/gcloud/application_default_credentials.json",
@@ -284,7 +292,8 @@ aws_session_token = sessiontoken-1
 				}),
 				td.Slice([]*proto.Credential{}, td.ArrayEntries{
 					0: &proto.Credential{
-						NotAfter: timestamppb.New(time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)),
+						NotAfter:   timestamppb.New(time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)),
+						RenewAfter: timestamppb.New(time.Date(9999, 12, 31, 23, 54, 59, 0, time.UTC)),
 						Files: []*proto.File{
 							{
 								Path:     "~/.config/gcloud/application_default_credentials.json",
@@ -320,6 +329,57 @@ aws_session_token = sessiontoken-2
 				}),
 			},
 		},
+		"when there are two AWS credentials, their profiles are merged": {
+			Invocations: 1,
+			ACLs: []types.ACL{
+				{
+					MatchPrincipal: "spiffe://example.com/client",
+					Credentials: []types.Credential{
+						{
+							Provider:        "AWSSTSAssumeRoleProvider",
+							ObjectReference: "arn:aws:iam::111111111111:role/Role",
+							AWS:             &types.AWSCredential{Profile: "staging"},
+						},
+						{
+							Provider:        "AWSSTSAssumeRoleProvider",
+							ObjectReference: "arn:aws:iam::222222222222:role/Role",
+							AWS:             &types.AWSCredential{Profile: "production"},
+						},
+					},
+				},
+			},
+			AWSExpectedInvocations: 2,
+			AWSCredentialLifetimes: []time.Duration{time.Hour, time.Hour},
+			ExpectedCredentials: []td.TestDeep{
+				td.Slice([]*proto.Credential{}, td.ArrayEntries{
+					0: td.Struct(
+						&proto.Credential{
+							Files: []*proto.File{
+								{
+									Path: "~/.aws/credentials",
+									Mode: 0644,
+									Contents: []byte(`[staging]
+aws_access_key_id = keyid
+aws_secret_access_key = key
+aws_session_token = sessiontoken-1
+
+[production]
+aws_access_key_id = keyid
+aws_secret_access_key = key
+aws_session_token = sessiontoken-2
+`),
+								},
+							},
+						},
+						td.StructFields{"NotAfter": td.NotNil()},
+					),
+					1: td.Struct(
+						&proto.Credential{},
+						td.StructFields{"NotAfter": td.NotNil(), "Files": td.Empty()},
+					),
+				}),
+			},
+		},
 	}
 
 	for testCaseName, testCase := range testCases {
@@ -344,27 +404,31 @@ aws_session_token = sessiontoken-2
 			})
 			require.NoError(t, err)
 
-			// create the server
-			lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", 3000))
-			require.NoError(t, err)
-			s := grpc.NewServer(grpc.Creds(grpccredentials.MTLSServerCredentials(serverConfigSource, serverConfigSource, tlsconfig.AuthorizeAny())))
+			// start the server on a unix socket, stopping it when the test case is done
+			socket := filepath.Join(t.TempDir(), "server.sock")
 			ss := Server{
 				ACLs: testCase.ACLs,
 				Providers: map[string]provider.Provider{
 					"AWSSTSAssumeRoleProvider":           &awsProvider,
 					"GoogleIAMServiceAccountKeyProvider": &googleProvider,
 				},
+				Listen: &ListenOptions{Network: NetworkUnix, Address: socket},
 			}
-			proto.RegisterSpiffeConnectorServer(s, &ss)
+			serverCtx, serverCancel := context.WithCancel(context.Background())
+			serverErr := make(chan error)
 			go func() {
-				s.Serve(lis)
+				serverErr <- ss.Start(serverCtx)
+			}()
+			defer func() {
+				serverCancel()
+				assert.NoError(t, <-serverErr, "the server stops cleanly when its context is cancelled")
 			}()
-			defer s.Stop()
+			waitForSocket(t, socket)
 
 			// create the connection and client
 			var opts []grpc.DialOption
 			opts = append(opts, grpc.WithTransportCredentials(grpccredentials.MTLSClientCredentials(clientConfigSource, clientConfigSource, tlsconfig.AuthorizeAny())))
-			conn, err := grpc.Dial("localhost:3000", opts...)
+			conn, err := grpc.Dial("unix://"+socket, opts...)
 			require.NoError(t, err)
 			defer conn.Close()
 			client := proto.NewSpiffeConnectorClient(conn)
@@ -388,3 +452,254 @@ aws_session_token = sessiontoken-2
 		})
 	}
 }
+
+func TestMergeFiles(t *testing.T) {
+	awsProvider, err := provider.NewAWSSTSAssumeRoleProvider(context.Background(), provider.AWSSTSAssumeRoleProviderOptions{
+		CredentialsOverride: credentials.NewStaticCredentials("foo", "bar", "baz"),
+	})
+	require.NoError(t, err)
+	mockProvider, err := provider.NewMockProvider(provider.MockProviderOptions{})
+	require.NoError(t, err)
+
+	staging := &proto.Credential{Files: []*proto.File{
+		{Path: "~/.aws/credentials", Mode: 0644, Contents: []byte("[staging]\naws_access_key_id = a\n")},
+		{Path: "~/.aws/config", Mode: 0644, Contents: []byte("[profile staging]\nregion = eu-west-1\n")},
+	}}
+	production := &proto.Credential{Files: []*proto.File{
+		{Path: "~/.aws/credentials", Mode: 0600, Contents: []byte("[production]\naws_access_key_id = b\n")},
+	}}
+	other := &proto.Credential{Files: []*proto.File{
+		{Path: "~/.aws/credentials", Mode: 0644, Contents: []byte("not merged")},
+	}}
+
+	merged, err := mergeFiles(
+		[]*proto.Credential{staging, production, other},
+		[]provider.Provider{&awsProvider, &awsProvider, &mockProvider},
+	)
+	require.NoError(t, err)
+	require.Len(t, merged, 3)
+
+	require.Len(t, merged[0].Files, 2)
+	assert.Equal(t, "[staging]\naws_access_key_id = a\n\n[production]\naws_access_key_id = b\n", string(merged[0].Files[0].Contents))
+	assert.Equal(t, uint32(0600), merged[0].Files[0].Mode)
+	assert.Empty(t, merged[1].Files)
+	assert.Equal(t, other, merged[2], "files from providers which cannot merge are left alone")
+
+	// the credentials passed in may be cached, so must not be changed
+	assert.Equal(t, "[staging]\naws_access_key_id = a\n", string(staging.Files[0].Contents))
+	assert.Len(t, production.Files, 1)
+
+	_, err = mergeFiles(
+		[]*proto.Credential{staging, staging},
+		[]provider.Provider{&awsProvider, &awsProvider},
+	)
+	assert.EqualError(t, err, "~/.aws/credentials: section [staging] is written by more than one credential")
+}
+
+// renewingProvider issues credentials with the given lifetime and counts calls, renewing them unless renewErr is set
+type renewingProvider struct {
+	lifetime           time.Duration
+	issueErr, renewErr error
+	issued, renewals   int
+}
+
+func (p *renewingProvider) Name() string { return "RenewingProvider" }
+
+func (p *renewingProvider) Ping() error { return nil }
+
+func (p *renewingProvider) GetCredential(objectReference string) (*proto.Credential, error) {
+	if p.issueErr != nil {
+		return nil, p.issueErr
+	}
+	p.issued++
+	token := fmt.Sprintf("token-%d", p.issued)
+	return &proto.Credential{Token: &token, NotAfter: timestamppb.New(time.Now().Add(p.lifetime))}, nil
+}
+
+func (p *renewingProvider) Renew(request provider.Request, credential *proto.Credential) (*proto.Credential, error) {
+	if p.renewErr != nil {
+		return nil, p.renewErr
+	}
+	p.renewals++
+	return &proto.Credential{Token: credential.Token, NotAfter: timestamppb.New(time.Now().Add(time.Hour))}, nil
+}
+
+func TestServer_Credential_Renew(t *testing.T) {
+	testCases := map[string]struct {
+		lifetime         time.Duration
+		renewErr         error
+		expectedToken    string
+		expectedIssued   int
+		expectedRenewed  int
+		expectedNotAfter time.Duration
+	}{
+		"fresh credentials are reused": {
+			lifetime:         time.Hour,
+			expectedToken:    "token-1",
+			expectedIssued:   1,
+			expectedNotAfter: time.Hour,
+		},
+		"expiring credentials are renewed": {
+			lifetime:         time.Minute,
+			expectedToken:    "token-1",
+			expectedIssued:   1,
+			expectedRenewed:  1,
+			expectedNotAfter: time.Hour,
+		},
+		"credentials which cannot be renewed are issued again": {
+			lifetime:         time.Minute,
+			renewErr:         errors.New("lease not found"),
+			expectedToken:    "token-2",
+			expectedIssued:   2,
+			expectedNotAfter: time.Minute,
+		},
+	}
+
+	for testName, testCase := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			p := &renewingProvider{lifetime: testCase.lifetime, renewErr: testCase.renewErr}
+			s := Server{}
+			request := provider.Request{ObjectReference: "lease"}
+
+			first, err := s.credential(context.Background(), p, request, "RenewingProvider/lease")
+			require.NoError(t, err)
+			assert.Equal(t, "token-1", *first.Token)
+
+			second, err := s.credential(context.Background(), p, request, "RenewingProvider/lease")
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectedToken, *second.Token)
+			assert.Equal(t, testCase.expectedIssued, p.issued)
+			assert.Equal(t, testCase.expectedRenewed, p.renewals)
+			assert.WithinDuration(t, time.Now().Add(testCase.expectedNotAfter), second.NotAfter.AsTime(), 5*time.Second)
+
+			// clients are told to come back before the server would stop handing the credential out, or half way
+			// through the lifetime of short lived credentials
+			require.NotNil(t, second.RenewAfter)
+			expectedRenewAfter := second.NotAfter.AsTime().Add(-5 * time.Minute)
+			if testCase.expectedNotAfter < 10*time.Minute {
+				expectedRenewAfter = time.Now().Add(testCase.expectedNotAfter / 2)
+			}
+			assert.WithinDuration(t, expectedRenewAfter, second.RenewAfter.AsTime(), 5*time.Second)
+		})
+	}
+}
+
+// observingProvider records the credentials the server reports it issued
+type observingProvider struct {
+	*renewingProvider
+	observed []*proto.Credential
+}
+
+func (p *observingProvider) Issued(request provider.Request, credential *proto.Credential) {
+	p.observed = append(p.observed, credential)
+}
+
+func TestServer_Credential_IssueObserver(t *testing.T) {
+	p := &observingProvider{renewingProvider: &renewingProvider{lifetime: time.Hour}}
+	s := Server{}
+
+	credential, err := s.credential(context.Background(), p, provider.Request{ObjectReference: "lease"}, "RenewingProvider/lease")
+	require.NoError(t, err)
+
+	// the provider is told when clients will renew the credential
+	require.Len(t, p.observed, 1)
+	assert.Same(t, credential, p.observed[0])
+	require.NotNil(t, p.observed[0].RenewAfter)
+	assert.WithinDuration(t, time.Now().Add(55*time.Minute), p.observed[0].RenewAfter.AsTime(), 5*time.Second)
+}
+
+func TestServer_Credential_PersistentCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	key := bytes.Repeat([]byte{1}, 32)
+	p := &renewingProvider{lifetime: time.Hour}
+	request := provider.Request{ObjectReference: "lease"}
+
+	fileCache, err := cache.NewFile(path, key)
+	require.NoError(t, err)
+	s := Server{Cache: fileCache}
+	first, err := s.credential(context.Background(), p, request, "RenewingProvider/lease")
+	require.NoError(t, err)
+
+	// a restarted server hands out the credential issued before the restart
+	fileCache, err = cache.NewFile(path, key)
+	require.NoError(t, err)
+	restarted := Server{Cache: fileCache}
+	second, err := restarted.credential(context.Background(), p, request, "RenewingProvider/lease")
+	require.NoError(t, err)
+
+	assert.Equal(t, *first.Token, *second.Token)
+	assert.Equal(t, 1, p.issued)
+}
+
+// slowProvider takes a while to issue each credential, counting how many it has issued
+type slowProvider struct {
+	issued int32
+}
+
+func (p *slowProvider) Name() string { return "SlowProvider" }
+
+func (p *slowProvider) Ping() error { return nil }
+
+func (p *slowProvider) GetCredential(objectReference string) (*proto.Credential, error) {
+	time.Sleep(100 * time.Millisecond)
+	token := fmt.Sprintf("token-%d", atomic.AddInt32(&p.issued, 1))
+	return &proto.Credential{Token: &token, NotAfter: timestamppb.New(time.Now().Add(time.Hour))}, nil
+}
+
+func TestServer_Credential_SlowCache(t *testing.T) {
+	p := &slowProvider{}
+	release := make(chan struct{})
+	s := &Server{Cache: &hookCache{Cache: cache.NewMemory(), onSet: func(key string) {
+		if key == "SlowProvider/slow" {
+			<-release
+		}
+	}}}
+
+	// a request held up writing to the cache does not hold up requests for other credentials
+	slow := make(chan error)
+	go func() {
+		_, err := s.credential(context.Background(), p, provider.Request{ObjectReference: "slow"}, "SlowProvider/slow")
+		slow <- err
+	}()
+	other := make(chan error)
+	go func() {
+		_, err := s.credential(context.Background(), p, provider.Request{ObjectReference: "other"}, "SlowProvider/other")
+		other <- err
+	}()
+
+	select {
+	case err := <-other:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was held up by a write of another credential to the cache")
+	}
+	close(release)
+	assert.NoError(t, <-slow)
+}
+
+func TestServer_Credential_SharedCache(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	p := &slowProvider{}
+	request := provider.Request{ObjectReference: "role"}
+
+	// replicas sharing a cache issue each credential once, however many are asked for it at the same time
+	tokens := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		redisCache, err := cache.NewRedis(cache.RedisOptions{Address: redisServer.Addr(), Key: bytes.Repeat([]byte{1}, 32)})
+		require.NoError(t, err)
+		replica := &Server{Cache: redisCache}
+		go func() {
+			credential, err := replica.credential(context.Background(), p, request, "SlowProvider/role")
+			if err != nil {
+				tokens <- err.Error()
+				return
+			}
+			tokens <- *credential.Token
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "token-1", <-tokens)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&p.issued))
+}
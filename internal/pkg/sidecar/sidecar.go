@@ -105,18 +105,9 @@ func (c *CredentialManager) applyCredentials() error {
 			if f == nil {
 				continue
 			}
-			filePath := f.Path
-			if strings.HasPrefix(f.Path, "~/") {
-				home, err := os.UserHomeDir()
-				if err != nil {
-					return fmt.Errorf("received credential contains path %s but could not determine user home directory: %w", f.Path, err)
-				}
-				// TODO: maybe consider what to do with non-unixy hosts
-				if home == "/" {
-					filePath = strings.TrimPrefix(filePath, "~")
-				} else {
-					filePath = strings.Replace(filePath, "~", home, 1)
-				}
+			filePath, err := expandHome(f.Path)
+			if err != nil {
+				return err
 			}
 
 			if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
@@ -128,6 +119,11 @@ func (c *CredentialManager) applyCredentials() error {
 			}
 		}
 		for k, v := range cred.EnvVars {
+			// env vars may be set to the path of a file in the credential
+			v, err := expandHome(v)
+			if err != nil {
+				return err
+			}
 			// TODO: This won't actually be useful as a sidecar. TODO: implement a container init / wrapper mode
 			if err := os.Setenv(k, v); err != nil {
 				return err
@@ -138,6 +134,22 @@ func (c *CredentialManager) applyCredentials() error {
 	return nil
 }
 
+// expandHome replaces a leading ~/ in p with the home directory of the user
+func expandHome(p string) (string, error) {
+	if !strings.HasPrefix(p, "~/") {
+		return p, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("received credential contains path %s but could not determine user home directory: %w", p, err)
+	}
+	// TODO: maybe consider what to do with non-unixy hosts
+	if home == "/" {
+		return strings.TrimPrefix(p, "~"), nil
+	}
+	return strings.Replace(p, "~", home, 1), nil
+}
+
 func (c *CredentialManager) scheduleNext() {
 	creds := c.currentCredentials.Load().([]*proto.Credential)
 	next := time.Now().Add(math.MaxInt)
@@ -145,15 +157,22 @@ func (c *CredentialManager) scheduleNext() {
 		if cred == nil {
 			continue
 		}
-		if cred.NotAfter == nil {
+		// the server's renewal hint is preferred, otherwise credentials are refreshed two thirds of the way to expiry
+		var due time.Time
+		switch {
+		case cred.RenewAfter != nil:
+			due = cred.RenewAfter.AsTime()
+		case cred.NotAfter != nil:
+			due = time.Now().Add(time.Until(cred.NotAfter.AsTime()) / 3 * 2)
+		default:
 			continue
 		}
-		if cred.NotAfter.AsTime().Before(next) {
-			next = cred.NotAfter.AsTime()
+		if due.Before(next) {
+			next = due
 		}
 	}
 	go func(c *CredentialManager, at time.Time) {
-		time.Sleep(time.Until(at) / 3 * 2)
+		time.Sleep(time.Until(at))
 		c.refresh <- struct{}{}
 	}(c, next)
 }
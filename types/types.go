@@ -2,8 +2,13 @@
 package types
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
 )
@@ -29,8 +34,24 @@ func (a *ACL) Validate() []error {
 		errors = append(errors, err)
 	}
 
+	for _, credential := range a.Credentials {
+		errors = append(errors, credential.Validate()...)
+	}
+
 	seenProviders := make(map[string]int)
+	seenAWSProfiles := make(map[string]int)
+	var awsEnvVarCredentials int
 	for _, provider := range a.Credentials {
+		// AWS credentials are written to distinct profiles which are merged into one file, so only the profiles need to
+		// be unique
+		if provider.Provider == "AWSSTSAssumeRoleProvider" {
+			if provider.AWS.OutputStyle() == AWSOutputEnvVars {
+				awsEnvVarCredentials++
+			} else {
+				seenAWSProfiles[provider.AWS.ProfileName()]++
+			}
+			continue
+		}
 		if _, found := seenProviders[provider.Provider]; !found {
 			seenProviders[provider.Provider] = 1
 		} else {
@@ -42,6 +63,14 @@ func (a *ACL) Validate() []error {
 			errors = append(errors, fmt.Errorf("duplicate provider %q (seen %d times)", provider, count))
 		}
 	}
+	for profile, count := range seenAWSProfiles {
+		if count > 1 {
+			errors = append(errors, fmt.Errorf("duplicate AWS profile %q (seen %d times)", profile, count))
+		}
+	}
+	if awsEnvVarCredentials > 1 {
+		errors = append(errors, fmt.Errorf("only one AWS credential can use the %s output (seen %d times)", AWSOutputEnvVars, awsEnvVarCredentials))
+	}
 
 	return errors
 }
@@ -50,16 +79,250 @@ func (a *ACL) Validate() []error {
 type Credential struct {
 	Provider        string `yaml:"provider"`
 	ObjectReference string `yaml:"object_reference"`
+
+	// AWS contains options for the AWSSTSAssumeRoleProvider
+	AWS *AWSCredential `yaml:"aws,omitempty"`
+
+	// Google contains options for the GoogleAccessTokenProvider
+	Google *GoogleCredential `yaml:"google,omitempty"`
+
+	// Output overrides where the credential is written on the client
+	Output *CredentialOutput `yaml:"output,omitempty"`
+
+	// Issuance is either shared, where every principal matching the ACL is handed the same credential, or
+	// per-principal, where each is issued its own. Defaults to shared, unless the provider always issues credentials
+	// for a specific principal. Providers which are not told the principal, such as the StaticSecretProvider, cannot
+	// issue per-principal credentials.
+	Issuance string `yaml:"issuance,omitempty"`
+
+	// Freshness overrides the freshness policy of the server and provider for this credential
+	Freshness *FreshnessPolicy `yaml:"freshness,omitempty"`
+
+	// Options are provider specific settings for this credential, such as the session duration, which are checked by
+	// the provider when the server starts
+	Options map[string]string `yaml:"options,omitempty"`
+}
+
+const (
+	// IssuanceShared hands the same credential to every principal matching the ACL
+	IssuanceShared = "shared"
+	// IssuancePerPrincipal issues a separate credential to each principal matching the ACL
+	IssuancePerPrincipal = "per-principal"
+)
+
+// CredentialOutput overrides the files and environment variables produced by a provider. Files are referred to either
+// by the name the provider gives them, such as "credentials" for the AWSSTSAssumeRoleProvider, or by their default
+// path.
+type CredentialOutput struct {
+	// Files overrides the path or mode of files
+	Files map[string]FileOutput `yaml:"files,omitempty"`
+	// EnvVars renames environment variables, from the name set by the provider to the new name
+	EnvVars map[string]string `yaml:"env_vars,omitempty"`
+	// FileEnvVars sets environment variables to the final path of a file, for example
+	// GOOGLE_APPLICATION_CREDENTIALS: application_default_credentials
+	FileEnvVars map[string]string `yaml:"file_env_vars,omitempty"`
+}
+
+// FileOutput overrides where and how a single file is written
+type FileOutput struct {
+	// Path is where the file is written instead, a path ending in "/" is a directory and keeps the file's name
+	Path string `yaml:"path,omitempty"`
+	// Mode is the octal file mode, for example "0600"
+	Mode string `yaml:"mode,omitempty"`
+}
+
+// FileMode returns the parsed Mode, and false if it is not set
+func (f FileOutput) FileMode() (uint32, bool, error) {
+	if f.Mode == "" {
+		return 0, false, nil
+	}
+	mode, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, false, fmt.Errorf("mode %q must be an octal file mode such as 0600", f.Mode)
+	}
+	return uint32(mode), true, nil
+}
+
+// AWSCredential restricts the credentials issued by the AWSSTSAssumeRoleProvider to less than the full permissions of
+// the assumed role. Both fields may use templates such as {{ index .PathSegments 1 }} to refer to the caller.
+type AWSCredential struct {
+	// SessionPolicy is an inline IAM policy document passed as the session policy
+	SessionPolicy string `yaml:"session_policy,omitempty"`
+	// PolicyARNs are managed policies passed as session policies
+	PolicyARNs []string `yaml:"policy_arns,omitempty"`
+
+	// Profile is the name of the profile the credentials are written to, defaults to default
+	Profile string `yaml:"profile,omitempty"`
+	// Output is how the credentials are given to the client, one of credentials_file, config_file or env_vars.
+	// Defaults to credentials_file.
+	Output string `yaml:"output,omitempty"`
+	// Region is written alongside the credentials if set
+	Region string `yaml:"region,omitempty"`
+}
+
+const (
+	// AWSOutputCredentialsFile writes the profile to ~/.aws/credentials, and the region to ~/.aws/config
+	AWSOutputCredentialsFile = "credentials_file"
+	// AWSOutputConfigFile writes the profile, including the region, to ~/.aws/config
+	AWSOutputConfigFile = "config_file"
+	// AWSOutputEnvVars sets the AWS_* environment variables
+	AWSOutputEnvVars = "env_vars"
+)
+
+// ProfileName returns the configured profile, or default. It is safe to call on a nil AWSCredential.
+func (c *AWSCredential) ProfileName() string {
+	if c == nil || c.Profile == "" {
+		return "default"
+	}
+	return c.Profile
+}
+
+// OutputStyle returns the configured output, or credentials_file. It is safe to call on a nil AWSCredential.
+func (c *AWSCredential) OutputStyle() string {
+	if c == nil || c.Output == "" {
+		return AWSOutputCredentialsFile
+	}
+	return c.Output
+}
+
+// maxSessionPolicyARNs is the most managed session policies AWS accepts in a single AssumeRole
+const maxSessionPolicyARNs = 10
+
+// GoogleCredential restricts the access tokens issued by the GoogleAccessTokenProvider to less than the full permissions
+// of the service account. Any string field may use templates such as {{ index .PathSegments 1 }} to refer to the
+// caller.
+type GoogleCredential struct {
+	// AccessBoundary is the Credential Access Boundary applied to the token, see
+	// https://cloud.google.com/iam/docs/downscoping-short-lived-credentials
+	AccessBoundary []GoogleAccessBoundaryRule `yaml:"access_boundary"`
 }
 
+// GoogleAccessBoundaryRule limits the permissions available on a single resource
+type GoogleAccessBoundaryRule struct {
+	// AvailableResource is the full resource name of a Cloud Storage bucket, for example
+	// //storage.googleapis.com/projects/_/buckets/bucket-name
+	AvailableResource string `yaml:"available_resource"`
+	// AvailablePermissions are the roles whose permissions are available, for example inRole:roles/storage.objectViewer
+	AvailablePermissions []string `yaml:"available_permissions"`
+	// Condition optionally restricts the permissions to some objects in the bucket
+	Condition *GoogleAvailabilityCondition `yaml:"condition,omitempty"`
+}
+
+// GoogleAvailabilityCondition is an IAM condition restricting a GoogleAccessBoundaryRule
+type GoogleAvailabilityCondition struct {
+	Expression  string `yaml:"expression"`
+	Title       string `yaml:"title,omitempty"`
+	Description string `yaml:"description,omitempty"`
+}
+
+// maxAccessBoundaryRules is the most rules Google accepts in a Credential Access Boundary
+const maxAccessBoundaryRules = 10
+
 func (c *Credential) Key() string {
-	return fmt.Sprintf("%s/%s", c.Provider, c.ObjectReference)
+	key := fmt.Sprintf("%s/%s", c.Provider, c.ObjectReference)
+	// credentials for the same object with different restrictions grant different access, so must not be shared
+	if c.AWS != nil || c.Google != nil {
+		// marshalling these structs cannot fail
+		restrictions, _ := json.Marshal(struct {
+			AWS    *AWSCredential
+			Google *GoogleCredential
+		}{c.AWS, c.Google})
+		key = fmt.Sprintf("%s/policy-%x", key, sha256.Sum256(restrictions))
+	}
+	if len(c.Options) > 0 {
+		options := url.Values{}
+		for k, v := range c.Options {
+			options.Set(k, v)
+		}
+		// Encode sorts by key, so equal options always produce the same key
+		key = fmt.Sprintf("%s/options-%s", key, options.Encode())
+	}
+	return key
+}
+
+func (c *Credential) Validate() []error {
+	var errors []error
+
+	name := fmt.Sprintf("%s/%s", c.Provider, c.ObjectReference)
+	if c.AWS != nil {
+		// templated policies can only be checked once rendered for a caller
+		if c.AWS.SessionPolicy != "" && !strings.Contains(c.AWS.SessionPolicy, "{{") && !json.Valid([]byte(c.AWS.SessionPolicy)) {
+			errors = append(errors, fmt.Errorf("credential %q: aws session_policy must be a JSON policy document", name))
+		}
+		if len(c.AWS.PolicyARNs) > maxSessionPolicyARNs {
+			errors = append(errors, fmt.Errorf("credential %q: aws policy_arns cannot contain more than %d policies", name, maxSessionPolicyARNs))
+		}
+		for _, arn := range c.AWS.PolicyARNs {
+			if arn == "" {
+				errors = append(errors, fmt.Errorf("credential %q: aws policy_arns cannot contain empty values", name))
+			}
+		}
+		switch c.AWS.OutputStyle() {
+		case AWSOutputCredentialsFile, AWSOutputConfigFile:
+			if strings.ContainsAny(c.AWS.Profile, "[]\n") {
+				errors = append(errors, fmt.Errorf("credential %q: aws profile %q is not a valid profile name", name, c.AWS.Profile))
+			}
+		case AWSOutputEnvVars:
+			if c.AWS.Profile != "" {
+				errors = append(errors, fmt.Errorf("credential %q: aws profile cannot be set with the %s output", name, AWSOutputEnvVars))
+			}
+		default:
+			errors = append(errors, fmt.Errorf("credential %q: aws output must be one of %s, %s or %s", name, AWSOutputCredentialsFile, AWSOutputConfigFile, AWSOutputEnvVars))
+		}
+	}
+
+	if c.Issuance != "" && c.Issuance != IssuanceShared && c.Issuance != IssuancePerPrincipal {
+		errors = append(errors, fmt.Errorf("credential %q: issuance must be one of %s or %s", name, IssuanceShared, IssuancePerPrincipal))
+	}
+
+	for _, e := range c.Freshness.Validate() {
+		errors = append(errors, fmt.Errorf("credential %q: freshness: %s", name, e))
+	}
+
+	if c.Output != nil {
+		for file, output := range c.Output.Files {
+			if output.Path == "" && output.Mode == "" {
+				errors = append(errors, fmt.Errorf("credential %q: output for file %q must set path or mode", name, file))
+			}
+			if _, _, err := output.FileMode(); err != nil {
+				errors = append(errors, fmt.Errorf("credential %q: output for file %q: %s", name, file, err))
+			}
+		}
+		for from, to := range c.Output.EnvVars {
+			if to == "" {
+				errors = append(errors, fmt.Errorf("credential %q: env var %q cannot be renamed to an empty name", name, from))
+			}
+		}
+		for envVar, file := range c.Output.FileEnvVars {
+			if envVar == "" || file == "" {
+				errors = append(errors, fmt.Errorf("credential %q: file_env_vars must map env var names to files", name))
+			}
+		}
+	}
+
+	if c.Google != nil {
+		if len(c.Google.AccessBoundary) == 0 || len(c.Google.AccessBoundary) > maxAccessBoundaryRules {
+			errors = append(errors, fmt.Errorf("credential %q: google access_boundary must contain between 1 and %d rules", name, maxAccessBoundaryRules))
+		}
+		for i, rule := range c.Google.AccessBoundary {
+			if rule.AvailableResource == "" || len(rule.AvailablePermissions) == 0 {
+				errors = append(errors, fmt.Errorf("credential %q: google access_boundary rule %d must set available_resource and available_permissions", name, i))
+			}
+			if rule.Condition != nil && rule.Condition.Expression == "" {
+				errors = append(errors, fmt.Errorf("credential %q: google access_boundary rule %d condition must set expression", name, i))
+			}
+		}
+	}
+
+	return errors
 }
 
 // ConfigFile represents the config file that will be loaded from disk, or some other mechanism.
 type ConfigFile struct {
-	SPIFFE *SpiffeConfig `yaml:"spiffe"`
-	ACLs   []ACL         `yaml:"acls"`
+	SPIFFE    *SpiffeConfig    `yaml:"spiffe"`
+	Server    *ServerConfig    `yaml:"server,omitempty"`
+	Providers *ProvidersConfig `yaml:"providers,omitempty"`
+	ACLs      []ACL            `yaml:"acls"`
 }
 
 func (c *ConfigFile) Validate() []error {
@@ -87,12 +350,708 @@ func (c *ConfigFile) Validate() []error {
 		}
 	}
 
+	if c.SPIFFE != nil {
+		for _, e := range c.SPIFFE.Validate() {
+			errors = append(errors, fmt.Errorf("spiffe config is invalid: %w", e))
+		}
+	}
+
+	if c.Server != nil {
+		for _, e := range c.Server.Validate() {
+			errors = append(errors, fmt.Errorf("server config is invalid: %w", e))
+		}
+		if c.Server.Auth.Accepts(AuthMethodJWT) && (c.SPIFFE == nil || !c.SPIFFE.HasJWTBundles()) {
+			errors = append(errors, fmt.Errorf("server config is invalid: auth: the %s method needs JWT bundles from the workload API, a jwt_bundle_file or a bundle endpoint", AuthMethodJWT))
+		}
+	}
+
+	if c.Providers != nil {
+		for _, e := range c.Providers.Validate() {
+			errors = append(errors, fmt.Errorf("providers config is invalid: %w", e))
+		}
+	}
+
+	return errors
+}
+
+// ServerConfig contains the configuration of the credential server
+type ServerConfig struct {
+	// Refresh enables issuing stored credentials again in the background before they expire
+	Refresh *RefreshConfig `yaml:"refresh,omitempty"`
+
+	// Freshness decides how long stored credentials are handed out for
+	Freshness *FreshnessPolicy `yaml:"freshness,omitempty"`
+
+	// ProviderFreshness overrides Freshness for the named providers
+	ProviderFreshness map[string]FreshnessPolicy `yaml:"provider_freshness,omitempty"`
+
+	// Cache chooses where issued credentials are stored, defaults to memory
+	Cache *CacheConfig `yaml:"cache,omitempty"`
+
+	// Listen configures where the server listens and its gRPC connection settings, defaults to tcp on [::]:9090
+	Listen *ListenConfig `yaml:"listen,omitempty"`
+
+	// Auth configures how clients authenticate, defaults to mTLS with an X.509-SVID only
+	Auth *AuthConfig `yaml:"auth,omitempty"`
+
+	// HTTP enables the HTTP/JSON API, GET /v1/credentials, served with the same TLS identity and authentication as
+	// the gRPC API
+	HTTP *HTTPConfig `yaml:"http,omitempty"`
+}
+
+// HTTPConfig configures where the HTTP/JSON API listens
+type HTTPConfig struct {
+	// Network is either tcp or unix, defaults to tcp
+	Network string `yaml:"network,omitempty"`
+	// Address is the host:port to listen on for tcp, defaults to [::]:9443, or the socket path for unix
+	Address string `yaml:"address,omitempty"`
+	// SocketMode is the octal file mode of a unix socket, for example "0660"
+	SocketMode string `yaml:"socket_mode,omitempty"`
+}
+
+// SocketFileMode returns the parsed SocketMode, and false if it is not set
+func (c HTTPConfig) SocketFileMode() (uint32, bool, error) {
+	return FileOutput{Mode: c.SocketMode}.FileMode()
+}
+
+// AuthConfig configures how clients authenticate to the server
+type AuthConfig struct {
+	// Methods are the accepted authentication methods, x509 for mTLS with an X.509-SVID and jwt for a JWT-SVID sent
+	// in the authorization metadata. When both are accepted a client certificate takes precedence. Defaults to x509.
+	Methods []string `yaml:"methods,omitempty"`
+
+	// JWTAudience are the audiences accepted in JWT-SVIDs, a token must have at least one of them. Required for the
+	// jwt method.
+	JWTAudience []string `yaml:"jwt_audience,omitempty"`
+}
+
+const (
+	// AuthMethodX509 authenticates clients by the X.509-SVID they present in the mTLS handshake
+	AuthMethodX509 = "x509"
+	// AuthMethodJWT authenticates clients by a JWT-SVID in the authorization metadata, for clients behind proxies
+	// which terminate TLS
+	AuthMethodJWT = "jwt"
+)
+
+// Accepts reports whether the authentication method is accepted, only x509 is if no methods are configured
+func (c *AuthConfig) Accepts(method string) bool {
+	if c == nil || len(c.Methods) == 0 {
+		return method == AuthMethodX509
+	}
+	for _, m := range c.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenConfig configures where the server listens and its gRPC connection settings
+type ListenConfig struct {
+	// Network is either tcp or unix, defaults to tcp
+	Network string `yaml:"network,omitempty"`
+	// Address is the host:port to listen on for tcp, or the socket path for unix
+	Address string `yaml:"address,omitempty"`
+	// SocketMode is the octal file mode of a unix socket, for example "0660"
+	SocketMode string `yaml:"socket_mode,omitempty"`
+
+	// Keepalive configures the gRPC keepalive pings
+	Keepalive *KeepaliveConfig `yaml:"keepalive,omitempty"`
+
+	// MaxRecvMsgSize and MaxSendMsgSize are the largest messages in bytes the server receives and sends
+	MaxRecvMsgSize int `yaml:"max_recv_msg_size,omitempty"`
+	MaxSendMsgSize int `yaml:"max_send_msg_size,omitempty"`
+}
+
+// SocketFileMode returns the parsed SocketMode, and false if it is not set
+func (c ListenConfig) SocketFileMode() (uint32, bool, error) {
+	return FileOutput{Mode: c.SocketMode}.FileMode()
+}
+
+// KeepaliveConfig configures the gRPC keepalive pings between the server and its clients
+type KeepaliveConfig struct {
+	// Time is how long a connection is idle before the server pings the client
+	Time time.Duration `yaml:"time,omitempty"`
+	// Timeout is how long the server waits for a reply to a ping before closing the connection
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// MinTime is the most often a client may ping the server
+	MinTime time.Duration `yaml:"min_time,omitempty"`
+}
+
+// CacheConfig configures where the server stores the credentials it has issued
+type CacheConfig struct {
+	// Backend is either memory, file to keep credentials across restarts, or redis to share them between servers
+	Backend string `yaml:"backend"`
+	// Path is the file credentials are written to, for the file backend
+	Path string `yaml:"path,omitempty"`
+	// KeyFile or KeyEnv name the file or environment variable holding the 32 byte key the cache is encrypted with,
+	// either raw or base64 encoded. Exactly one must be set for the file and redis backends.
+	KeyFile string `yaml:"key_file,omitempty"`
+	KeyEnv  string `yaml:"key_env,omitempty"`
+
+	// Redis configures the connection to Redis, for the redis backend
+	Redis *RedisCacheConfig `yaml:"redis,omitempty"`
+}
+
+// RedisCacheConfig configures the connection to a Redis server shared by the credential servers
+type RedisCacheConfig struct {
+	// Address is the host:port of the Redis server
+	Address string `yaml:"address"`
+	// Username and PasswordEnv, the environment variable holding the password, are optional
+	Username    string `yaml:"username,omitempty"`
+	PasswordEnv string `yaml:"password_env,omitempty"`
+	DB          int    `yaml:"db,omitempty"`
+	// KeyPrefix is prepended to the Redis keys written, defaults to "spiffe-connector:"
+	KeyPrefix string `yaml:"key_prefix,omitempty"`
+	// LockTTL is how long a server can hold the lock for a credential while it is issued, defaults to 10s
+	LockTTL time.Duration `yaml:"lock_ttl,omitempty"`
+}
+
+const (
+	// CacheBackendMemory holds issued credentials in memory, so they are lost when the server restarts
+	CacheBackendMemory = "memory"
+	// CacheBackendFile writes issued credentials to an encrypted file
+	CacheBackendFile = "file"
+	// CacheBackendRedis shares issued credentials between servers in Redis, encrypted
+	CacheBackendRedis = "redis"
+)
+
+// FreshnessPolicy decides how long a stored credential is handed out for before a new one is issued. Unset fields fall
+// back to the policy of the provider, then the server, then the defaults.
+type FreshnessPolicy struct {
+	// RenewBefore is how much of its lifetime a credential must have left to be handed out, either a duration such as
+	// "10m" or a percentage of its total lifetime such as "25%". Defaults to 5m.
+	RenewBefore string `yaml:"renew_before,omitempty"`
+
+	// WithoutExpiry decides what happens to credentials without a NotAfter time: "reissue" issues a new one for every
+	// request, "reuse" hands out the same one for as long as the server runs, and a duration such as "1h" hands out
+	// the same one for that long. Defaults to reissue.
+	WithoutExpiry string `yaml:"without_expiry,omitempty"`
+}
+
+// FreshnessReissue and FreshnessReuse are the keyword values of FreshnessPolicy.WithoutExpiry
+const (
+	FreshnessReissue = "reissue"
+	FreshnessReuse   = "reuse"
+)
+
+// ParseRenewBefore returns RenewBefore as either a duration or a fraction of the lifetime, both are zero if it is not
+// set
+func (f *FreshnessPolicy) ParseRenewBefore() (time.Duration, float64, error) {
+	if f == nil || f.RenewBefore == "" {
+		return 0, 0, nil
+	}
+	if strings.HasSuffix(f.RenewBefore, "%") {
+		percentage, err := strconv.ParseFloat(strings.TrimSuffix(f.RenewBefore, "%"), 64)
+		if err != nil || percentage <= 0 || percentage >= 100 {
+			return 0, 0, fmt.Errorf("renew_before %q must be a percentage between 0%% and 100%%", f.RenewBefore)
+		}
+		return 0, percentage / 100, nil
+	}
+	d, err := time.ParseDuration(f.RenewBefore)
+	if err != nil || d <= 0 {
+		return 0, 0, fmt.Errorf("renew_before %q must be a positive duration or a percentage", f.RenewBefore)
+	}
+	return d, 0, nil
+}
+
+// ParseWithoutExpiry returns whether credentials without an expiry are reused, and for how long if limited
+func (f *FreshnessPolicy) ParseWithoutExpiry() (bool, time.Duration, error) {
+	if f == nil {
+		return false, 0, nil
+	}
+	switch f.WithoutExpiry {
+	case "", FreshnessReissue:
+		return false, 0, nil
+	case FreshnessReuse:
+		return true, 0, nil
+	}
+	d, err := time.ParseDuration(f.WithoutExpiry)
+	if err != nil || d <= 0 {
+		return false, 0, fmt.Errorf("without_expiry %q must be reissue, reuse or a positive duration", f.WithoutExpiry)
+	}
+	return true, d, nil
+}
+
+// Validate checks both fields of the policy can be parsed
+func (f *FreshnessPolicy) Validate() []error {
+	var errors []error
+	if _, _, err := f.ParseRenewBefore(); err != nil {
+		errors = append(errors, err)
+	}
+	if _, _, err := f.ParseWithoutExpiry(); err != nil {
+		errors = append(errors, err)
+	}
 	return errors
 }
 
+// RefreshConfig configures the background refresh of stored credentials
+type RefreshConfig struct {
+	// Fraction is how far through its lifetime a credential is refreshed, defaults to 0.75
+	Fraction float64 `yaml:"fraction"`
+	// Jitter is the largest fraction of the lifetime by which a refresh is randomly brought forward, defaults to 0.1
+	Jitter float64 `yaml:"jitter"`
+	// Interval is how often stored credentials are checked, defaults to 10s
+	Interval time.Duration `yaml:"interval"`
+	// IdleTimeout is how long a credential can go unrequested before it is dropped rather than refreshed, defaults
+	// to 1h
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+func (c *ServerConfig) Validate() []error {
+	var errors []error
+
+	if c.Refresh != nil {
+		if c.Refresh.Fraction < 0 || c.Refresh.Fraction >= 1 {
+			errors = append(errors, fmt.Errorf("refresh: fraction must be between 0 and 1"))
+		}
+		if c.Refresh.Jitter < 0 || (c.Refresh.Fraction > 0 && c.Refresh.Jitter >= c.Refresh.Fraction) {
+			errors = append(errors, fmt.Errorf("refresh: jitter cannot be negative or as large as fraction"))
+		}
+		if c.Refresh.Interval < 0 || c.Refresh.IdleTimeout < 0 {
+			errors = append(errors, fmt.Errorf("refresh: interval and idle_timeout cannot be negative"))
+		}
+	}
+
+	for _, e := range c.Freshness.Validate() {
+		errors = append(errors, fmt.Errorf("freshness: %w", e))
+	}
+	for name, policy := range c.ProviderFreshness {
+		for _, e := range policy.Validate() {
+			errors = append(errors, fmt.Errorf("provider_freshness: %s: %w", name, e))
+		}
+	}
+
+	if c.Cache != nil {
+		switch c.Cache.Backend {
+		case "", CacheBackendMemory:
+		case CacheBackendFile, CacheBackendRedis:
+			if c.Cache.Backend == CacheBackendFile && c.Cache.Path == "" {
+				errors = append(errors, fmt.Errorf("cache: path is required for the %s backend", CacheBackendFile))
+			}
+			if c.Cache.Backend == CacheBackendRedis && (c.Cache.Redis == nil || c.Cache.Redis.Address == "") {
+				errors = append(errors, fmt.Errorf("cache: redis address is required for the %s backend", CacheBackendRedis))
+			}
+			if (c.Cache.KeyFile == "") == (c.Cache.KeyEnv == "") {
+				errors = append(errors, fmt.Errorf("cache: exactly one of key_file or key_env is required for the %s backend", c.Cache.Backend))
+			}
+		default:
+			errors = append(errors, fmt.Errorf("cache: backend must be one of %s, %s or %s", CacheBackendMemory, CacheBackendFile, CacheBackendRedis))
+		}
+	}
+
+	if c.Listen != nil {
+		switch c.Listen.Network {
+		case "", "tcp":
+		case "unix":
+			if c.Listen.Address == "" {
+				errors = append(errors, fmt.Errorf("listen: address must be a socket path for the unix network"))
+			}
+		default:
+			errors = append(errors, fmt.Errorf("listen: network must be tcp or unix"))
+		}
+		if _, _, err := c.Listen.SocketFileMode(); err != nil {
+			errors = append(errors, fmt.Errorf("listen: socket_mode: %w", err))
+		}
+		if c.Listen.MaxRecvMsgSize < 0 || c.Listen.MaxSendMsgSize < 0 {
+			errors = append(errors, fmt.Errorf("listen: message sizes cannot be negative"))
+		}
+		if k := c.Listen.Keepalive; k != nil && (k.Time < 0 || k.Timeout < 0 || k.MinTime < 0) {
+			errors = append(errors, fmt.Errorf("listen: keepalive durations cannot be negative"))
+		}
+	}
+
+	if c.HTTP != nil {
+		switch c.HTTP.Network {
+		case "", "tcp":
+		case "unix":
+			if c.HTTP.Address == "" {
+				errors = append(errors, fmt.Errorf("http: address must be a socket path for the unix network"))
+			}
+		default:
+			errors = append(errors, fmt.Errorf("http: network must be tcp or unix"))
+		}
+		if _, _, err := c.HTTP.SocketFileMode(); err != nil {
+			errors = append(errors, fmt.Errorf("http: socket_mode: %w", err))
+		}
+	}
+
+	if c.Auth != nil {
+		seen := make(map[string]bool)
+		for _, method := range c.Auth.Methods {
+			switch method {
+			case AuthMethodX509, AuthMethodJWT:
+			default:
+				errors = append(errors, fmt.Errorf("auth: method %q must be one of %s or %s", method, AuthMethodX509, AuthMethodJWT))
+			}
+			if seen[method] {
+				errors = append(errors, fmt.Errorf("auth: duplicate method %q", method))
+			}
+			seen[method] = true
+		}
+		if c.Auth.Accepts(AuthMethodJWT) && len(c.Auth.JWTAudience) == 0 {
+			errors = append(errors, fmt.Errorf("auth: jwt_audience is required for the %s method", AuthMethodJWT))
+		}
+		if !c.Auth.Accepts(AuthMethodJWT) && len(c.Auth.JWTAudience) > 0 {
+			errors = append(errors, fmt.Errorf("auth: jwt_audience is only used with the %s method", AuthMethodJWT))
+		}
+	}
+
+	return errors
+}
+
+// ProvidersConfig contains the configuration for the optional credential providers. Each provider is only enabled when
+// its section is present.
+type ProvidersConfig struct {
+	SSHUserCertificate    *SSHUserCertificateProviderConfig    `yaml:"ssh_user_certificate,omitempty"`
+	X509ClientCertificate *X509ClientCertificateProviderConfig `yaml:"x509_client_certificate,omitempty"`
+	JWTSigner             *JWTSignerProviderConfig             `yaml:"jwt_signer,omitempty"`
+	PostgresRole          *PostgresRoleProviderConfig          `yaml:"postgres_role,omitempty"`
+	StaticSecret          *StaticSecretProviderConfig          `yaml:"static_secret,omitempty"`
+	Webhook               *WebhookProviderConfig               `yaml:"webhook,omitempty"`
+	ConsulACLToken        *ConsulACLTokenProviderConfig        `yaml:"consul_acl_token,omitempty"`
+	Mock                  *MockProviderConfig                  `yaml:"mock,omitempty"`
+	GoogleAccessToken     *GoogleAccessTokenProviderConfig     `yaml:"google_access_token,omitempty"`
+}
+
+func (p *ProvidersConfig) Validate() []error {
+	var errors []error
+
+	if p.SSHUserCertificate != nil {
+		if p.SSHUserCertificate.CAKeyFile == "" {
+			errors = append(errors, fmt.Errorf("ssh_user_certificate: ca_key_file must be set"))
+		}
+		if p.SSHUserCertificate.Duration < 0 {
+			errors = append(errors, fmt.Errorf("ssh_user_certificate: duration cannot be negative"))
+		}
+	}
+
+	if p.X509ClientCertificate != nil {
+		if p.X509ClientCertificate.CACertFile == "" || p.X509ClientCertificate.CAKeyFile == "" {
+			errors = append(errors, fmt.Errorf("x509_client_certificate: ca_cert_file and ca_key_file must be set"))
+		}
+		if p.X509ClientCertificate.Lifetime < 0 {
+			errors = append(errors, fmt.Errorf("x509_client_certificate: lifetime cannot be negative"))
+		}
+	}
+
+	if p.JWTSigner != nil {
+		if p.JWTSigner.Algorithm != "HS256" && p.JWTSigner.Algorithm != "RS256" {
+			errors = append(errors, fmt.Errorf("jwt_signer: algorithm must be one of HS256 or RS256"))
+		}
+		if p.JWTSigner.KeyFile == "" {
+			errors = append(errors, fmt.Errorf("jwt_signer: key_file must be set"))
+		}
+		if p.JWTSigner.TTL < 0 {
+			errors = append(errors, fmt.Errorf("jwt_signer: ttl cannot be negative"))
+		}
+	}
+
+	if p.PostgresRole != nil {
+		if p.PostgresRole.DSN == "" {
+			errors = append(errors, fmt.Errorf("postgres_role: dsn must be set"))
+		}
+		if p.PostgresRole.Duration < 0 {
+			errors = append(errors, fmt.Errorf("postgres_role: duration cannot be negative"))
+		}
+		if p.PostgresRole.SweepInterval < 0 {
+			errors = append(errors, fmt.Errorf("postgres_role: sweep_interval cannot be negative"))
+		}
+	}
+
+	if p.StaticSecret != nil {
+		if p.StaticSecret.Root == "" {
+			errors = append(errors, fmt.Errorf("static_secret: root must be set"))
+		}
+		if p.StaticSecret.RefreshInterval < 0 {
+			errors = append(errors, fmt.Errorf("static_secret: refresh_interval cannot be negative"))
+		}
+	}
+
+	if p.Webhook != nil {
+		if !strings.HasPrefix(p.Webhook.URL, "https://") {
+			errors = append(errors, fmt.Errorf("webhook: url must be set and use https"))
+		}
+		if p.Webhook.Timeout < 0 || p.Webhook.RetryBackoff < 0 {
+			errors = append(errors, fmt.Errorf("webhook: timeout and retry_backoff cannot be negative"))
+		}
+		if p.Webhook.Retries != nil && *p.Webhook.Retries < 0 {
+			errors = append(errors, fmt.Errorf("webhook: retries cannot be negative"))
+		}
+	}
+
+	if p.ConsulACLToken != nil {
+		if p.ConsulACLToken.TokenFile == "" {
+			errors = append(errors, fmt.Errorf("consul_acl_token: token_file must be set"))
+		}
+		if p.ConsulACLToken.TTL < 0 {
+			errors = append(errors, fmt.Errorf("consul_acl_token: ttl cannot be negative"))
+		}
+	}
+
+	if p.GoogleAccessToken != nil {
+		if p.GoogleAccessToken.Lifetime < 0 {
+			errors = append(errors, fmt.Errorf("google_access_token: lifetime cannot be negative"))
+		}
+	}
+
+	if p.Mock != nil {
+		if p.Mock.ErrorRate < 0 || p.Mock.ErrorRate > 1 {
+			errors = append(errors, fmt.Errorf("mock: error_rate must be between 0 and 1"))
+		}
+		if p.Mock.Lifetime < 0 || p.Mock.Latency < 0 {
+			errors = append(errors, fmt.Errorf("mock: lifetime and latency cannot be negative"))
+		}
+		for _, name := range p.Mock.Replaces {
+			if name == "" || name == "MockProvider" {
+				errors = append(errors, fmt.Errorf("mock: replaces must contain provider names, got %q", name))
+			}
+		}
+	}
+
+	return errors
+}
+
+// SSHUserCertificateProviderConfig configures the SSHUserCertificateProvider
+type SSHUserCertificateProviderConfig struct {
+	// CAKeyFile is the path to the private key of the SSH certificate authority
+	CAKeyFile string `yaml:"ca_key_file"`
+	// Duration is how long issued certificates are valid for
+	Duration time.Duration `yaml:"duration,omitempty"`
+}
+
+// X509ClientCertificateProviderConfig configures the X509ClientCertificateProvider
+type X509ClientCertificateProviderConfig struct {
+	// CACertFile is the path to the CA certificate, optionally followed by intermediates
+	CACertFile string `yaml:"ca_cert_file"`
+	// CAKeyFile is the path to the private key of the CA
+	CAKeyFile string `yaml:"ca_key_file"`
+	// Lifetime is how long issued certificates are valid for, unless overridden in the object reference
+	Lifetime time.Duration `yaml:"lifetime,omitempty"`
+}
+
+// JWTSignerProviderConfig configures the JWTSignerProvider
+type JWTSignerProviderConfig struct {
+	// Algorithm is either HS256 or RS256
+	Algorithm string `yaml:"algorithm"`
+	// KeyFile is the path to the shared secret for HS256, or the PEM encoded RSA private key for RS256
+	KeyFile string `yaml:"key_file"`
+	// KeyID is set as the kid header of minted tokens if not empty
+	KeyID string `yaml:"key_id,omitempty"`
+	// Issuer is set as the iss claim of minted tokens if not empty
+	Issuer string `yaml:"issuer,omitempty"`
+	// ClaimsTemplate is a Go template rendering a JSON object of claims, it can reference the caller with {{ .SpiffeID }},
+	// the matched ACL with {{ .ACL }} and the time of issue with {{ .Now }}
+	ClaimsTemplate string `yaml:"claims_template,omitempty"`
+	// TTL is how long minted tokens are valid for, unless overridden in the object reference
+	TTL time.Duration `yaml:"ttl,omitempty"`
+}
+
+// PostgresRoleProviderConfig configures the PostgresRoleProvider
+type PostgresRoleProviderConfig struct {
+	// DSN is the connection string of a user with the CREATEROLE attribute
+	DSN string `yaml:"dsn"`
+	// Host and Port are written to the .pgpass file given to clients, they default to matching any server
+	Host string `yaml:"host,omitempty"`
+	Port string `yaml:"port,omitempty"`
+	// Duration is how long created roles are valid for
+	Duration time.Duration `yaml:"duration,omitempty"`
+	// RolePrefix is prepended to the name of each created role
+	RolePrefix string `yaml:"role_prefix,omitempty"`
+	// SweepInterval is how often expired roles are dropped, defaults to 5m
+	SweepInterval time.Duration `yaml:"sweep_interval,omitempty"`
+}
+
+// StaticSecretProviderConfig configures the StaticSecretProvider
+type StaticSecretProviderConfig struct {
+	// Root is the directory secrets are served from, object references are paths relative to it
+	Root string `yaml:"root"`
+	// TargetDir is the directory secret files are written to on clients
+	TargetDir string `yaml:"target_dir,omitempty"`
+	// RefreshInterval is how often clients should fetch secrets again to pick up changes
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// WebhookProviderConfig configures the WebhookProvider
+type WebhookProviderConfig struct {
+	// URL is the https endpoint of the issuer, it is called over mTLS using the connector's SVID
+	URL string `yaml:"url"`
+	// ServerSPIFFEID is the SPIFFE ID the issuer must present, any trusted SVID is accepted if unset
+	ServerSPIFFEID string `yaml:"server_spiffe_id,omitempty"`
+	// Timeout limits each attempt to call the issuer
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Retries is how many times connection errors, 429 and 503 responses are retried, defaults to 2 if unset
+	Retries *int `yaml:"retries,omitempty"`
+	// RetryBackoff is the delay before the first retry, it doubles with each attempt
+	RetryBackoff time.Duration `yaml:"retry_backoff,omitempty"`
+}
+
+// ConsulACLTokenProviderConfig configures the ConsulACLTokenProvider
+type ConsulACLTokenProviderConfig struct {
+	// Address is the URL of the Consul HTTP API
+	Address string `yaml:"address,omitempty"`
+	// TokenFile contains the ACL token used to create tokens, it needs acl:write
+	TokenFile string `yaml:"token_file"`
+	// TTL is the default expiration TTL of created tokens
+	TTL time.Duration `yaml:"ttl,omitempty"`
+}
+
+// GoogleAccessTokenProviderConfig configures the GoogleAccessTokenProvider. Credentials are discovered by the Google
+// Cloud SDK.
+type GoogleAccessTokenProviderConfig struct {
+	// Lifetime is how long access tokens are valid for
+	Lifetime time.Duration `yaml:"lifetime,omitempty"`
+	// Scopes are the OAuth scopes of access tokens
+	Scopes []string `yaml:"scopes,omitempty"`
+	// Endpoint overrides the IAM credentials API endpoint
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// STSEndpoint overrides the token exchange endpoint used to apply access boundaries
+	STSEndpoint string `yaml:"sts_endpoint,omitempty"`
+}
+
+// MockProviderConfig configures the MockProvider, which returns fake credentials for local development and testing
+type MockProviderConfig struct {
+	// Replaces lists providers, such as AWSSTSAssumeRoleProvider, which are served by the mock instead, so that
+	// existing ACLs can be used without access to the real services
+	Replaces []string `yaml:"replaces,omitempty"`
+	// Lifetime is how long fake credentials are valid for
+	Lifetime time.Duration `yaml:"lifetime,omitempty"`
+	// Latency is added to every credential request
+	Latency time.Duration `yaml:"latency,omitempty"`
+	// ErrorRate is the fraction of credential requests, between 0 and 1, which fail
+	ErrorRate float64 `yaml:"error_rate,omitempty"`
+	// Errors maps object references to an error which is always returned for them
+	Errors map[string]string `yaml:"errors,omitempty"`
+	// PingError makes the provider fail health checks with the given error
+	PingError string `yaml:"ping_error,omitempty"`
+	// Seed makes injected failures reproducible
+	Seed int64 `yaml:"seed,omitempty"`
+}
+
 // SpiffeConfig represents the SPIFFE configuration section of spiffe-connector's config file
 type SpiffeConfig struct {
 	SVIDSources SVIDSources `yaml:"svid_sources"`
+
+	// TrustDomains are the trust domains whose workloads may connect, in addition to the trust domain of the server's
+	// own SVID which is always accepted. Listing other trust domains federates with them.
+	TrustDomains []TrustDomainConfig `yaml:"trust_domains,omitempty"`
+}
+
+func (c *SpiffeConfig) Validate() []error {
+	var errors []error
+
+	seen := make(map[string]bool)
+	for _, td := range c.TrustDomains {
+		if _, err := spiffeid.TrustDomainFromString(td.Name); err != nil {
+			errors = append(errors, fmt.Errorf("trust domain %q is invalid: %w", td.Name, err))
+			continue
+		}
+		if seen[td.Name] {
+			errors = append(errors, fmt.Errorf("duplicate trust domain %q", td.Name))
+		}
+		seen[td.Name] = true
+
+		if td.BundleEndpoint != nil {
+			for _, e := range td.BundleEndpoint.Validate() {
+				errors = append(errors, fmt.Errorf("trust domain %q: bundle_endpoint: %w", td.Name, e))
+			}
+			if td.BundleFile != "" && td.BundleEndpoint.Profile != BundleEndpointProfileSPIFFE {
+				errors = append(errors, fmt.Errorf("trust domain %q: bundle_file is only used with a bundle endpoint to bootstrap the %s profile", td.Name, BundleEndpointProfileSPIFFE))
+			}
+			if td.JWTBundleFile != "" {
+				errors = append(errors, fmt.Errorf("trust domain %q: jwt_bundle_file cannot be used with a bundle endpoint, which serves the JWT authorities", td.Name))
+			}
+		}
+	}
+
+	return errors
+}
+
+// HasJWTBundles reports whether JWT bundles are loaded for any trust domain, which authenticating clients with
+// JWT-SVIDs needs
+func (c *SpiffeConfig) HasJWTBundles() bool {
+	if c.SVIDSources.WorkloadAPI != nil && c.SVIDSources.WorkloadAPI.JWTBundles {
+		return true
+	}
+	for _, td := range c.TrustDomains {
+		if td.JWTBundleFile != "" || td.JWTBundle != nil || td.BundleEndpoint != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustDomainConfig is a trust domain whose workloads may connect, and where its bundle of CAs comes from
+type TrustDomainConfig struct {
+	// Name is the trust domain, such as example.com
+	Name string `yaml:"name"`
+
+	// BundleFile is a PEM file of the CAs of the trust domain, which is reloaded when it changes. If no bundle is
+	// configured, it comes from the Workload API, or from svid_sources.files.trust_domain_ca for the server's own
+	// trust domain.
+	BundleFile string `yaml:"bundle_file,omitempty"`
+
+	// BundleEndpoint fetches the bundle from the SPIFFE bundle endpoint of the trust domain, refreshing it as the
+	// endpoint advises. With the https_spiffe profile, BundleFile or Bundle may be set to bootstrap the first fetch.
+	BundleEndpoint *BundleEndpointConfig `yaml:"bundle_endpoint,omitempty"`
+
+	// JWTBundleFile is a JWKS file of the JWT authorities of the trust domain in the SPIFFE bundle format, used to
+	// validate JWT-SVIDs. It is reloaded when it changes. A bundle endpoint serves the JWT authorities itself.
+	JWTBundleFile string `yaml:"jwt_bundle_file,omitempty"`
+
+	// Bundle and JWTBundle are only used in testing
+	Bundle    []byte `yaml:"-"`
+	JWTBundle []byte `yaml:"-"`
+}
+
+const (
+	// BundleEndpointProfileWeb authenticates a bundle endpoint with Web PKI
+	BundleEndpointProfileWeb = "https_web"
+	// BundleEndpointProfileSPIFFE authenticates a bundle endpoint by its SPIFFE ID
+	BundleEndpointProfileSPIFFE = "https_spiffe"
+)
+
+// BundleEndpointConfig configures where the bundle of a federated trust domain is fetched from
+type BundleEndpointConfig struct {
+	// URL is the https URL of the bundle endpoint
+	URL string `yaml:"url"`
+	// Profile is how the endpoint is authenticated, either https_web or https_spiffe
+	Profile string `yaml:"profile"`
+	// EndpointSPIFFEID is the SPIFFE ID the endpoint must present, for the https_spiffe profile
+	EndpointSPIFFEID string `yaml:"endpoint_spiffe_id,omitempty"`
+	// CAFile is a PEM file of the CAs trusted to issue the certificate of the endpoint, instead of the system roots,
+	// for the https_web profile
+	CAFile string `yaml:"ca_file,omitempty"`
+	// RefreshInterval is how often the bundle is fetched if the endpoint gives no refresh hint, defaults to 5m
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+func (c *BundleEndpointConfig) Validate() []error {
+	var errors []error
+
+	if u, err := url.Parse(c.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+		errors = append(errors, fmt.Errorf("url %q must be an https URL", c.URL))
+	}
+	switch c.Profile {
+	case BundleEndpointProfileWeb:
+		if c.EndpointSPIFFEID != "" {
+			errors = append(errors, fmt.Errorf("endpoint_spiffe_id is only used with the %s profile", BundleEndpointProfileSPIFFE))
+		}
+	case BundleEndpointProfileSPIFFE:
+		if _, err := spiffeid.FromString(c.EndpointSPIFFEID); err != nil {
+			errors = append(errors, fmt.Errorf("endpoint_spiffe_id %q is invalid: %w", c.EndpointSPIFFEID, err))
+		}
+		if c.CAFile != "" {
+			errors = append(errors, fmt.Errorf("ca_file is only used with the %s profile", BundleEndpointProfileWeb))
+		}
+	default:
+		errors = append(errors, fmt.Errorf("profile must be one of %s or %s", BundleEndpointProfileWeb, BundleEndpointProfileSPIFFE))
+	}
+	if c.RefreshInterval < 0 {
+		errors = append(errors, fmt.Errorf("refresh_interval cannot be negative"))
+	}
+
+	return errors
 }
 
 // SVIDSources determines where spiffe-connector will obtain its own SVID and trust domain information.
@@ -107,6 +1066,9 @@ type SVIDSources struct {
 
 type WorkloadAPI struct {
 	SocketPath string `yaml:"socket_path"`
+
+	// JWTBundles also watches the JWT bundles from the Workload API, to authenticate clients with JWT-SVIDs
+	JWTBundles bool `yaml:"jwt_bundles,omitempty"`
 }
 
 type Files struct {
@@ -85,6 +85,142 @@ func TestACLValidate(t *testing.T) {
 				errors.New("duplicate provider \"google\" (seen 2 times)"),
 			},
 		},
+		"with AWS session policies": {
+			ACL: ACL{
+				MatchPrincipal: "spiffe://bar/ns/*",
+				Credentials: []Credential{
+					{
+						Provider:        "AWSSTSAssumeRoleProvider",
+						ObjectReference: "arn:aws:iam::123456789012:role/Shared",
+						AWS: &AWSCredential{
+							SessionPolicy: `{"Version": "2012-10-17", "Statement": [{"Effect": "Allow", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::data/{{ index .PathSegments 1 }}/*"}]}`,
+							PolicyARNs:    []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+						},
+					},
+				},
+			},
+			ExpectedErrors: []error{},
+		},
+		"with invalid AWS session policies": {
+			ACL: ACL{
+				MatchPrincipal: "spiffe://bar/things",
+				Credentials: []Credential{
+					{
+						Provider:        "AWSSTSAssumeRoleProvider",
+						ObjectReference: "arn:aws:iam::123456789012:role/Shared",
+						AWS: &AWSCredential{
+							SessionPolicy: `{"Version": "2012-10-17"`,
+							PolicyARNs:    []string{""},
+						},
+					},
+				},
+			},
+			ExpectedErrors: []error{
+				errors.New(`credential "AWSSTSAssumeRoleProvider/arn:aws:iam::123456789012:role/Shared": aws session_policy must be a JSON policy document`),
+				errors.New(`credential "AWSSTSAssumeRoleProvider/arn:aws:iam::123456789012:role/Shared": aws policy_arns cannot contain empty values`),
+			},
+		},
+		"with invalid Google access boundary": {
+			ACL: ACL{
+				MatchPrincipal: "spiffe://bar/things",
+				Credentials: []Credential{
+					{
+						Provider:        "GoogleAccessTokenProvider",
+						ObjectReference: "reader@project.iam.gserviceaccount.com",
+						Google: &GoogleCredential{
+							AccessBoundary: []GoogleAccessBoundaryRule{
+								{AvailableResource: "//storage.googleapis.com/projects/_/buckets/data"},
+							},
+						},
+					},
+				},
+			},
+			ExpectedErrors: []error{
+				errors.New(`credential "GoogleAccessTokenProvider/reader@project.iam.gserviceaccount.com": google access_boundary rule 0 must set available_resource and available_permissions`),
+			},
+		},
+		"with AWS credentials for different profiles": {
+			ACL: ACL{
+				MatchPrincipal: "spiffe://bar/things",
+				Credentials: []Credential{
+					{Provider: "AWSSTSAssumeRoleProvider", ObjectReference: "arn:aws:iam::111111111111:role/Role"},
+					{Provider: "AWSSTSAssumeRoleProvider", ObjectReference: "arn:aws:iam::222222222222:role/Role", AWS: &AWSCredential{Profile: "production"}},
+					{Provider: "AWSSTSAssumeRoleProvider", ObjectReference: "arn:aws:iam::333333333333:role/Role", AWS: &AWSCredential{Output: AWSOutputEnvVars}},
+				},
+			},
+			ExpectedErrors: []error{},
+		},
+		"with AWS credentials for the same profile": {
+			ACL: ACL{
+				MatchPrincipal: "spiffe://bar/things",
+				Credentials: []Credential{
+					{Provider: "AWSSTSAssumeRoleProvider", ObjectReference: "arn:aws:iam::111111111111:role/Role"},
+					{Provider: "AWSSTSAssumeRoleProvider", ObjectReference: "arn:aws:iam::222222222222:role/Role", AWS: &AWSCredential{Profile: "default", Output: AWSOutputConfigFile}},
+					{Provider: "AWSSTSAssumeRoleProvider", ObjectReference: "arn:aws:iam::333333333333:role/Role", AWS: &AWSCredential{Output: AWSOutputEnvVars}},
+					{Provider: "AWSSTSAssumeRoleProvider", ObjectReference: "arn:aws:iam::444444444444:role/Role", AWS: &AWSCredential{Output: AWSOutputEnvVars}},
+				},
+			},
+			ExpectedErrors: []error{
+				errors.New(`duplicate AWS profile "default" (seen 2 times)`),
+				errors.New("only one AWS credential can use the env_vars output (seen 2 times)"),
+			},
+		},
+		"with invalid AWS output": {
+			ACL: ACL{
+				MatchPrincipal: "spiffe://bar/things",
+				Credentials: []Credential{
+					{Provider: "AWSSTSAssumeRoleProvider", ObjectReference: "arn:aws:iam::111111111111:role/Role", AWS: &AWSCredential{Output: "dotenv"}},
+				},
+			},
+			ExpectedErrors: []error{
+				errors.New(`credential "AWSSTSAssumeRoleProvider/arn:aws:iam::111111111111:role/Role": aws output must be one of credentials_file, config_file or env_vars`),
+			},
+		},
+		"with invalid output overrides": {
+			ACL: ACL{
+				MatchPrincipal: "spiffe://bar/things",
+				Credentials: []Credential{
+					{Provider: "GoogleIAMServiceAccountKeyProvider", ObjectReference: "sa@project.iam.gserviceaccount.com", Output: &CredentialOutput{
+						Files: map[string]FileOutput{
+							"application_default_credentials": {Mode: "0888"},
+							"~/.config/gcloud/other.json":     {},
+						},
+						EnvVars: map[string]string{"GOOGLE_OAUTH_ACCESS_TOKEN": ""},
+					}},
+				},
+			},
+			ExpectedErrors: []error{
+				errors.New(`credential "GoogleIAMServiceAccountKeyProvider/sa@project.iam.gserviceaccount.com": output for file "application_default_credentials": mode "0888" must be an octal file mode such as 0600`),
+				errors.New(`credential "GoogleIAMServiceAccountKeyProvider/sa@project.iam.gserviceaccount.com": output for file "~/.config/gcloud/other.json" must set path or mode`),
+				errors.New(`credential "GoogleIAMServiceAccountKeyProvider/sa@project.iam.gserviceaccount.com": env var "GOOGLE_OAUTH_ACCESS_TOKEN" cannot be renamed to an empty name`),
+			},
+		},
+		"with invalid freshness policy": {
+			ACL: ACL{
+				MatchPrincipal: "spiffe://bar/things",
+				Credentials: []Credential{
+					{Provider: "GoogleIAMServiceAccountKeyProvider", ObjectReference: "sa@project.iam.gserviceaccount.com", Freshness: &FreshnessPolicy{
+						RenewBefore:   "150%",
+						WithoutExpiry: "never",
+					}},
+				},
+			},
+			ExpectedErrors: []error{
+				errors.New(`credential "GoogleIAMServiceAccountKeyProvider/sa@project.iam.gserviceaccount.com": freshness: renew_before "150%" must be a percentage between 0% and 100%`),
+				errors.New(`credential "GoogleIAMServiceAccountKeyProvider/sa@project.iam.gserviceaccount.com": freshness: without_expiry "never" must be reissue, reuse or a positive duration`),
+			},
+		},
+		"with invalid issuance": {
+			ACL: ACL{
+				MatchPrincipal: "spiffe://bar/things",
+				Credentials: []Credential{
+					{Provider: "AWSSTSAssumeRoleProvider", ObjectReference: "arn:aws:iam::111111111111:role/Role", Issuance: "per-pod"},
+				},
+			},
+			ExpectedErrors: []error{
+				errors.New(`credential "AWSSTSAssumeRoleProvider/arn:aws:iam::111111111111:role/Role": issuance must be one of shared or per-principal`),
+			},
+		},
 		`malformed spiffe ID with "//"`: {
 			ACL: ACL{
 				MatchPrincipal: "spiffe://bar/things//baz",
@@ -105,3 +241,24 @@ func TestACLValidate(t *testing.T) {
 		})
 	}
 }
+
+func TestCredentialKey(t *testing.T) {
+	plain := Credential{Provider: "AWSSTSAssumeRoleProvider", ObjectReference: "arn:aws:iam::123456789012:role/Shared"}
+	assert.Equal(t, "AWSSTSAssumeRoleProvider/arn:aws:iam::123456789012:role/Shared", plain.Key())
+
+	readOnly := plain
+	readOnly.AWS = &AWSCredential{PolicyARNs: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}}
+	bucketScoped := plain
+	bucketScoped.AWS = &AWSCredential{SessionPolicy: `{"Version": "2012-10-17", "Statement": []}`}
+
+	keys := map[string]bool{plain.Key(): true, readOnly.Key(): true, bucketScoped.Key(): true}
+	assert.Len(t, keys, 3, "credentials with different session policies must have different keys")
+	assert.Equal(t, readOnly.Key(), readOnly.Key())
+
+	short := plain
+	short.Options = map[string]string{"duration": "15m", "a": "b"}
+	assert.Equal(t, "AWSSTSAssumeRoleProvider/arn:aws:iam::123456789012:role/Shared/options-a=b&duration=15m", short.Key())
+	long := plain
+	long.Options = map[string]string{"duration": "1h"}
+	assert.NotEqual(t, short.Key(), long.Key(), "credentials with different options must have different keys")
+}